@@ -0,0 +1,399 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bsmetric keeps counters and gauges about bs itself and exposes them
+// using the Prometheus text format.
+package bsmetric
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const contentType = "text/plain; version=0.0.4"
+
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var registry struct {
+	mu      sync.Mutex
+	metrics []collector
+}
+
+type collector interface {
+	metricName() string
+	write(w io.Writer)
+}
+
+type byName []collector
+
+func (l byName) Len() int           { return len(l) }
+func (l byName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byName) Less(i, j int) bool { return l[i].metricName() < l[j].metricName() }
+
+func register(c collector) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.metrics = append(registry.metrics, c)
+}
+
+type desc struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+}
+
+func (d *desc) metricName() string {
+	return d.name
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labelNames) {
+		panic(fmt.Sprintf("bsmetric: %s expects %d label values, got %d", d.name, len(d.labelNames), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d *desc) formatLabels(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range d.labelNames {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%s=\"%s\"", extra[i], escapeLabel(extra[i+1]))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec is a set of counters with the same name, partitioned by label
+// values.
+type CounterVec struct {
+	desc
+	mu       sync.Mutex
+	counters map[string]*Counter
+	labels   map[string][]string
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{
+		desc:     desc{name: name, help: help, kind: "counter", labelNames: labelNames},
+		counters: make(map[string]*Counter),
+		labels:   make(map[string][]string),
+	}
+	register(v)
+	return v
+}
+
+// NewCounter returns an unlabeled counter.
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).WithLabelValues()
+}
+
+// WithLabelValues returns the counter for the given label values, creating it
+// if needed. Callers in hot paths should keep the returned counter instead of
+// calling WithLabelValues on every increment.
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	key := v.key(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c := v.counters[key]
+	if c == nil {
+		c = &Counter{}
+		v.counters[key] = c
+		v.labels[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+func (v *CounterVec) Delete(values ...string) {
+	key := v.key(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.counters, key)
+	delete(v.labels, key)
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.writeHeader(w)
+	for _, key := range sortedKeys(v.labels) {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, v.formatLabels(v.labels[key]), v.counters[key].Value())
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits uint64
+}
+
+func (g *Gauge) Set(value float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&g.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// GaugeVec is a set of gauges with the same name, partitioned by label
+// values. Each gauge either holds a value or calls a function when metrics
+// are collected.
+type GaugeVec struct {
+	desc
+	mu     sync.Mutex
+	gauges map[string]*Gauge
+	funcs  map[string]func() float64
+	labels map[string][]string
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	v := &GaugeVec{
+		desc:   desc{name: name, help: help, kind: "gauge", labelNames: labelNames},
+		gauges: make(map[string]*Gauge),
+		funcs:  make(map[string]func() float64),
+		labels: make(map[string][]string),
+	}
+	register(v)
+	return v
+}
+
+// NewGauge returns an unlabeled gauge.
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).WithLabelValues()
+}
+
+func (v *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	key := v.key(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	g := v.gauges[key]
+	if g == nil {
+		g = &Gauge{}
+		v.gauges[key] = g
+		v.labels[key] = append([]string(nil), values...)
+		delete(v.funcs, key)
+	}
+	return g
+}
+
+// SetFunc makes fn be called to obtain the gauge value for the given label
+// values every time metrics are collected.
+func (v *GaugeVec) SetFunc(fn func() float64, values ...string) {
+	key := v.key(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.gauges, key)
+	v.funcs[key] = fn
+	v.labels[key] = append([]string(nil), values...)
+}
+
+func (v *GaugeVec) Delete(values ...string) {
+	key := v.key(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.gauges, key)
+	delete(v.funcs, key)
+	delete(v.labels, key)
+}
+
+func (v *GaugeVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.writeHeader(w)
+	for _, key := range sortedKeys(v.labels) {
+		var value float64
+		if fn := v.funcs[key]; fn != nil {
+			value = fn()
+		} else {
+			value = v.gauges[key].Value()
+		}
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.formatLabels(v.labels[key]), formatFloat(value))
+	}
+}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	desc
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram"},
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if value <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// ObserveSince observes the number of seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(nil, "le", formatFloat(upper)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(nil, "le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// WriteTo writes every registered metric to w using the Prometheus text
+// format.
+func WriteTo(w io.Writer) {
+	registry.mu.Lock()
+	metrics := make([]collector, len(registry.metrics))
+	copy(metrics, registry.metrics)
+	registry.mu.Unlock()
+	sort.Stable(byName(metrics))
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		WriteTo(w)
+	})
+}
+
+// Server is an HTTP server exposing the registered metrics at /metrics.
+type Server struct {
+	listener net.Listener
+	done     chan struct{}
+}
+
+func NewServer(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	s := &Server{listener: listener, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		http.Serve(listener, mux)
+	}()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Stop stops the server.
+func (s *Server) Stop() {
+	s.listener.Close()
+}
+
+// Wait blocks until the server stops.
+func (s *Server) Wait() {
+	<-s.done
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bsmetric
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&S{})
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type S struct{}
+
+func (s *S) SetUpTest(c *check.C) {
+	registry.metrics = nil
+}
+
+func (s *S) TestCounterVec(c *check.C) {
+	v := NewCounterVec("test_total", "Test counter.", "backend", "destination")
+	v.WithLabelValues("syslog", "udp://b").Add(3)
+	v.WithLabelValues("syslog", "udp://a").Inc()
+	v.WithLabelValues("syslog", "udp://a").Inc()
+	var buf bytes.Buffer
+	WriteTo(&buf)
+	c.Assert(buf.String(), check.Equals, `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{backend="syslog",destination="udp://a"} 2
+test_total{backend="syslog",destination="udp://b"} 3
+`)
+	v.Delete("syslog", "udp://a")
+	buf.Reset()
+	WriteTo(&buf)
+	c.Assert(buf.String(), check.Equals, `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{backend="syslog",destination="udp://b"} 3
+`)
+}
+
+func (s *S) TestCounterWrongLabels(c *check.C) {
+	v := NewCounterVec("test_total", "Test counter.", "backend")
+	c.Assert(func() { v.WithLabelValues("a", "b") }, check.PanicMatches, `bsmetric: test_total expects 1 label values, got 2`)
+}
+
+func (s *S) TestGaugeVec(c *check.C) {
+	v := NewGaugeVec("test_gauge", "Test\ngauge.", "name")
+	v.WithLabelValues(`a"b`).Set(1.5)
+	v.WithLabelValues(`a"b`).Add(-0.5)
+	n := 0
+	v.SetFunc(func() float64 {
+		n++
+		return float64(n)
+	}, "fn")
+	var buf bytes.Buffer
+	WriteTo(&buf)
+	WriteTo(&buf)
+	c.Assert(buf.String(), check.Equals, `# HELP test_gauge Test\ngauge.
+# TYPE test_gauge gauge
+test_gauge{name="a\"b"} 1
+test_gauge{name="fn"} 1
+# HELP test_gauge Test\ngauge.
+# TYPE test_gauge gauge
+test_gauge{name="a\"b"} 1
+test_gauge{name="fn"} 2
+`)
+}
+
+func (s *S) TestHistogram(c *check.C) {
+	h := NewHistogram("test_seconds", "Test histogram.", []float64{1, 5})
+	h.Observe(0.5)
+	h.Observe(2)
+	h.Observe(10)
+	var buf bytes.Buffer
+	WriteTo(&buf)
+	c.Assert(buf.String(), check.Equals, `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="5"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 12.5
+test_seconds_count 3
+`)
+}
+
+func (s *S) TestServer(c *check.C) {
+	NewCounter("b_total", "B.").Inc()
+	NewGauge("a_value", "A.").Set(2)
+	srv, err := NewServer("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer func() {
+		srv.Stop()
+		srv.Wait()
+	}()
+	rsp, err := http.Get("http://" + srv.Addr() + "/metrics")
+	c.Assert(err, check.IsNil)
+	defer rsp.Body.Close()
+	c.Assert(rsp.StatusCode, check.Equals, http.StatusOK)
+	c.Assert(rsp.Header.Get("Content-Type"), check.Equals, "text/plain; version=0.0.4")
+	data, err := ioutil.ReadAll(rsp.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, `# HELP a_value A.
+# TYPE a_value gauge
+a_value 2
+# HELP b_total B.
+# TYPE b_total counter
+b_total 1
+`)
+}
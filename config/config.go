@@ -22,14 +22,15 @@ const (
 )
 
 var Config struct {
-	DockerEndpoint      string
-	TsuruEndpoint       string
-	TsuruToken          string
-	MetricsInterval     time.Duration
-	MetricsBackend      string
-	StatusInterval      time.Duration
-	SyslogListenAddress string
-	LogBackends         []string
+	DockerEndpoint       string
+	TsuruEndpoint        string
+	TsuruToken           string
+	MetricsInterval      time.Duration
+	MetricsBackend       string
+	StatusInterval       time.Duration
+	SyslogListenAddress  string
+	LogBackends          []string
+	MetricsListenAddress string
 }
 
 func init() {
@@ -46,6 +47,7 @@ func LoadConfig() {
 	Config.MetricsInterval = SecondsEnvOrDefault(DefaultInterval, "METRICS_INTERVAL")
 	Config.MetricsBackend = os.Getenv("METRICS_BACKEND")
 	Config.LogBackends = StringsEnvOrDefault([]string{"tsuru", "syslog"}, "LOG_BACKENDS")
+	Config.MetricsListenAddress = os.Getenv("BS_METRICS_LISTEN_ADDRESS")
 }
 
 func envOrDefault(convert func(string) interface{}, defaultValue interface{}, envs ...string) interface{} {
@@ -13,10 +13,16 @@ import (
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/hashicorp/golang-lru"
+	"github.com/tsuru/bs/bsmetric"
 )
 
 var ErrTsuruVariablesNotFound = errors.New("could not find wanted envs")
 
+var (
+	cacheHits   = bsmetric.NewCounter("bs_container_info_cache_hits_total", "Number of container lookups served from cache.")
+	cacheMisses = bsmetric.NewCounter("bs_container_info_cache_misses_total", "Number of container lookups not found in cache.")
+)
+
 type InfoClient struct {
 	endpoint       string
 	client         *docker.Client
@@ -99,8 +105,10 @@ func (c *InfoClient) GetAppContainer(containerId string, useCache bool) (*Contai
 func (c *InfoClient) getContainer(containerId string, useCache bool) (*Container, error) {
 	if useCache {
 		if val, ok := c.containerCache.Get(containerId); ok {
+			cacheHits.Inc()
 			return val.(*Container), nil
 		}
+		cacheMisses.Inc()
 	}
 	cont, err := c.client.InspectContainer(containerId)
 	if err != nil {
@@ -161,3 +169,15 @@ func (c *Container) HasEnvs(requiredEnvs []string) bool {
 	}
 	return true
 }
+
+// Setting returns the value of the env environment variable or, if it's not
+// set, the value of label. It's used for per container configuration.
+func (c *Container) Setting(env, label string) string {
+	prefix := env + "="
+	for _, val := range c.Config.Env {
+		if strings.HasPrefix(val, prefix) {
+			return val[len(prefix):]
+		}
+	}
+	return c.Config.Labels[label]
+}
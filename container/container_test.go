@@ -49,16 +49,19 @@ func (S) TestInfoClientGetContainer(c *check.C) {
 	id := createContainer(c, dockerServer.URL(), []string{"TSURU_PROCESSNAME=procx", "TSURU_APPNAME=coolappname"}, "myContName")
 	client, err := NewClient(dockerServer.URL())
 	c.Assert(err, check.IsNil)
+	hits, misses := cacheHits.Value(), cacheMisses.Value()
 	cont, err := client.GetContainer(id, true, []string{})
 	c.Assert(err, check.IsNil)
 	c.Assert(cont.ID, check.Equals, id)
 	c.Assert(cont.AppName, check.Equals, "coolappname")
 	c.Assert(cont.ProcessName, check.Equals, "procx")
 	c.Assert(dockerCalls, check.Equals, 1)
+	c.Assert(cacheMisses.Value(), check.Equals, misses+1)
 	cont, err = client.GetContainer(id, true, []string{})
 	c.Assert(err, check.IsNil)
 	c.Assert(cont.ID, check.Equals, id)
 	c.Assert(dockerCalls, check.Equals, 1)
+	c.Assert(cacheHits.Value(), check.Equals, hits+1)
 	cached, ok := client.containerCache.Get(id)
 	c.Assert(ok, check.Equals, true)
 	c.Assert(cached.(*Container), check.DeepEquals, cont)
@@ -137,3 +140,14 @@ func (S) TestContainerHasEnvs(c *check.C) {
 	c.Assert(cont.HasEnvs([]string{"ENV"}), check.Equals, false)
 	c.Assert(cont.HasEnvs([]string{"TSURU_APPNAME", "ENV"}), check.Equals, false)
 }
+
+func (S) TestContainerSetting(c *check.C) {
+	cont := Container{Container: docker.Container{Config: &docker.Config{
+		Env:    []string{"MY_ENV=envvalue", "MY_ENV_2=other", "EMPTY="},
+		Labels: map[string]string{"my.label": "labelvalue", "empty.label": "x"},
+	}}}
+	c.Assert(cont.Setting("MY_ENV", "my.label"), check.Equals, "envvalue")
+	c.Assert(cont.Setting("OTHER_ENV", "my.label"), check.Equals, "labelvalue")
+	c.Assert(cont.Setting("MY", "other.label"), check.Equals, "")
+	c.Assert(cont.Setting("EMPTY", "empty.label"), check.Equals, "")
+}
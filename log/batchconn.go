@@ -0,0 +1,133 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/bsmetric"
+)
+
+// Overridden by tests to avoid waiting between retries.
+var batchRetryInterval = 500 * time.Millisecond
+
+// batchSender sends a batch of messages. It returns the messages that should
+// be retried, errors that are not worth retrying must be returned with a nil
+// retry list.
+type batchSender func(items []LogMessage) (retry []LogMessage, err error)
+
+type batchConfig struct {
+	name       string
+	maxItems   int
+	maxSize    int
+	interval   time.Duration
+	maxRetries int
+	dropped    *bsmetric.Counter
+}
+
+// batchConn accumulates messages and sends them in batches when maxItems or
+// maxSize is reached, or periodically on interval, for backends using
+// request based protocols. Errors from periodic flushes are returned by the
+// next call to add, so the forwarder reconnects.
+type batchConn struct {
+	net.Conn
+	cfg   batchConfig
+	send  batchSender
+	mu    sync.Mutex
+	items []LogMessage
+	size  int
+	err   error
+	done  chan struct{}
+}
+
+func newBatchConn(cfg batchConfig, send batchSender) *batchConn {
+	c := &batchConn{
+		cfg:  cfg,
+		send: send,
+		done: make(chan struct{}),
+	}
+	if cfg.interval > 0 {
+		go c.flushLoop()
+	}
+	return c
+}
+
+func (c *batchConn) add(item LogMessage, size int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.items = append(c.items, item)
+	c.size += size
+	if len(c.items) >= c.cfg.maxItems || c.size >= c.cfg.maxSize {
+		return c.flush()
+	}
+	return nil
+}
+
+func (c *batchConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.done)
+	if c.err != nil {
+		return c.err
+	}
+	return c.flush()
+}
+
+func (c *batchConn) flushLoop() {
+	t := time.NewTicker(c.cfg.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			c.mu.Lock()
+			if c.err == nil {
+				c.err = c.flush()
+				if c.err != nil {
+					bslog.Errorf("[log forwarder] error sending logs to %s: %s", c.cfg.name, c.err)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// flush sends pending items, retrying the ones returned by send up to
+// maxRetries times. The interval between retries doubles on each attempt.
+func (c *batchConn) flush() error {
+	items := c.items
+	c.items = nil
+	c.size = 0
+	if len(items) == 0 {
+		return nil
+	}
+	for attempt := 0; ; attempt++ {
+		retry, err := c.send(items)
+		if err != nil && retry == nil {
+			c.cfg.dropped.Add(uint64(len(items)))
+			return err
+		}
+		if len(retry) == 0 {
+			return nil
+		}
+		if attempt >= c.cfg.maxRetries {
+			c.cfg.dropped.Add(uint64(len(retry)))
+			if err == nil {
+				err = fmt.Errorf("%d messages not sent after %d retries", len(retry), attempt)
+			}
+			return err
+		}
+		items = retry
+		time.Sleep(batchRetryInterval << uint(attempt))
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/bsmetric"
+	"github.com/tsuru/bs/config"
+)
+
+const (
+	defaultElasticsearchIndexPattern = "bs-%Y.%m.%d"
+	defaultElasticsearchBulkSize     = 5 * 1024 * 1024
+	defaultElasticsearchBulkActions  = 1000
+	elasticsearchRequestTimeout      = 30 * time.Second
+)
+
+type elasticsearchBackend struct {
+	url           *url.URL
+	bulkURL       string
+	indexPattern  string
+	docType       string
+	bulkSize      int
+	bulkActions   int
+	flushInterval time.Duration
+	maxRetries    int
+	client        *http.Client
+	dropped       *bsmetric.Counter
+	queue         *messageQueue
+}
+
+type elasticsearchDocument struct {
+	Timestamp time.Time `json:"@timestamp"`
+	Message   string    `json:"message"`
+	App       string    `json:"app"`
+	Process   string    `json:"process"`
+	Unit      string    `json:"unit"`
+	Priority  int       `json:"priority"`
+	Severity  string    `json:"severity"`
+	// Fields found in structured messages, sent as top level fields.
+	Fields []logField `json:"-"`
+}
+
+func (d *elasticsearchDocument) MarshalJSON() ([]byte, error) {
+	type document elasticsearchDocument
+	data, err := json.Marshal((*document)(d))
+	if err != nil {
+		return nil, err
+	}
+	return appendJSONFields(data, d.Fields)
+}
+
+func (d *elasticsearchDocument) UnmarshalJSON(data []byte) error {
+	type document elasticsearchDocument
+	err := json.Unmarshal(data, (*document)(d))
+	if err != nil {
+		return err
+	}
+	d.Fields, err = extractJSONFields(data, "@timestamp", "message", "app", "process", "unit", "priority", "severity")
+	return err
+}
+
+func (b *elasticsearchBackend) initialize() error {
+	var err error
+	b.url, err = url.Parse(config.StringEnvOrDefault("http://localhost:9200", "LOG_ELASTICSEARCH_URL"))
+	if err != nil {
+		return fmt.Errorf("unable to parse elasticsearch url: %s", err)
+	}
+	bulkURL := *b.url
+	bulkURL.Path = strings.TrimSuffix(bulkURL.Path, "/") + "/_bulk"
+	b.bulkURL = bulkURL.String()
+	b.indexPattern = config.StringEnvOrDefault(defaultElasticsearchIndexPattern, "LOG_ELASTICSEARCH_INDEX_PATTERN")
+	b.docType = config.StringEnvOrDefault("", "LOG_ELASTICSEARCH_DOC_TYPE")
+	b.bulkSize = config.IntEnvOrDefault(defaultElasticsearchBulkSize, "LOG_ELASTICSEARCH_BULK_SIZE")
+	b.bulkActions = config.IntEnvOrDefault(defaultElasticsearchBulkActions, "LOG_ELASTICSEARCH_BULK_ACTIONS")
+	b.flushInterval = config.SecondsEnvOrDefault(1, "LOG_ELASTICSEARCH_FLUSH_INTERVAL")
+	b.maxRetries = config.IntEnvOrDefault(3, "LOG_ELASTICSEARCH_MAX_RETRIES")
+	b.client = &http.Client{Timeout: elasticsearchRequestTimeout}
+	queueCfg := newQueueConfig("elasticsearch")
+	// Credentials in the url must not show up in metrics labels.
+	destination := *b.url
+	destination.User = nil
+	queueCfg.destination = destination.String()
+	b.dropped = messagesDropped.WithLabelValues(queueCfg.name, queueCfg.destination)
+	b.queue, err = processMessages(b, queueCfg)
+	return err
+}
+
+func (b *elasticsearchBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
+	if len(container) > containerIDTrimSize {
+		container = container[:containerIDTrimSize]
+	}
+	priority, _ := strconv.Atoi(string(parts.priority))
+	b.queue.send(&elasticsearchDocument{
+		Timestamp: parts.ts,
+		Message:   string(parts.text()),
+		App:       appName,
+		Process:   processName,
+		Unit:      container,
+		Priority:  priority,
+		Severity:  parts.severity(),
+		Fields:    parts.fields,
+	})
+}
+
+func (b *elasticsearchBackend) stop() {
+	b.queue.stop()
+}
+
+func (b *elasticsearchBackend) connect() (net.Conn, error) {
+	return newBatchConn(batchConfig{
+		name:       "elasticsearch",
+		maxItems:   b.bulkActions,
+		maxSize:    b.bulkSize,
+		interval:   b.flushInterval,
+		maxRetries: b.maxRetries,
+		dropped:    b.dropped,
+	}, b.send), nil
+}
+
+func (b *elasticsearchBackend) process(conn net.Conn, msg LogMessage) error {
+	doc := msg.(*elasticsearchDocument)
+	item, err := b.bulkItem(doc)
+	if err != nil {
+		bslog.Errorf("[log forwarder] unable to encode elasticsearch document, discarding: %s", err)
+		b.dropped.Inc()
+		return nil
+	}
+	return conn.(*batchConn).add(item, len(item))
+}
+
+// bulkItem returns the action and source lines used to index doc in a bulk
+// request.
+func (b *elasticsearchBackend) bulkItem(doc *elasticsearchDocument) ([]byte, error) {
+	action := map[string]map[string]string{
+		"index": {"_index": formatIndexName(b.indexPattern, doc.Timestamp)},
+	}
+	if b.docType != "" {
+		action["index"]["_type"] = b.docType
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	err := encoder.Encode(action)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *elasticsearchBackend) encodeMessage(msg LogMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (b *elasticsearchBackend) decodeMessage(data []byte) (LogMessage, error) {
+	var doc elasticsearchDocument
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (b *elasticsearchBackend) close(conn net.Conn) {
+	conn.Close()
+}
+
+// formatIndexName replaces %Y, %m, %d and %H in pattern with the UTC date of
+// ts, %% is replaced by a single %.
+func formatIndexName(pattern string, ts time.Time) string {
+	if !strings.Contains(pattern, "%") {
+		return pattern
+	}
+	ts = ts.UTC()
+	var buf bytes.Buffer
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i == len(pattern)-1 {
+			buf.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'Y':
+			fmt.Fprintf(&buf, "%04d", ts.Year())
+		case 'm':
+			fmt.Fprintf(&buf, "%02d", ts.Month())
+		case 'd':
+			fmt.Fprintf(&buf, "%02d", ts.Day())
+		case 'H':
+			fmt.Fprintf(&buf, "%02d", ts.Hour())
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(pattern[i])
+		}
+	}
+	return buf.String()
+}
+
+type elasticsearchBulkResponse struct {
+	Errors bool                                       `json:"errors"`
+	Items  []map[string]elasticsearchBulkResponseItem `json:"items"`
+}
+
+type elasticsearchBulkResponseItem struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// send makes a bulk request with items, each one holding the action and
+// source lines of a document.
+func (b *elasticsearchBackend) send(items []LogMessage) ([]LogMessage, error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		body.Write(item.([]byte))
+	}
+	req, err := http.NewRequest("POST", b.bulkURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rsp, err := b.client.Do(req)
+	if err != nil {
+		return items, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode >= 500 {
+		io.Copy(ioutil.Discard, rsp.Body)
+		return items, fmt.Errorf("elasticsearch bulk request failed with status %d", rsp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return items, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("elasticsearch bulk request failed with status %d: %s", rsp.StatusCode, data)
+	}
+	var bulkRsp elasticsearchBulkResponse
+	err = json.Unmarshal(data, &bulkRsp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse elasticsearch bulk response: %s", err)
+	}
+	if !bulkRsp.Errors {
+		return nil, nil
+	}
+	if len(bulkRsp.Items) != len(items) {
+		return nil, errors.New("elasticsearch bulk response doesn't match the number of documents sent")
+	}
+	var retry []LogMessage
+	var rejected int
+	var lastErr json.RawMessage
+	for i, result := range bulkRsp.Items {
+		for _, item := range result {
+			switch {
+			case item.Status == http.StatusTooManyRequests || item.Status >= 500:
+				retry = append(retry, items[i])
+			case item.Status >= 300:
+				rejected++
+				lastErr = item.Error
+			}
+		}
+	}
+	if rejected > 0 {
+		b.dropped.Add(uint64(rejected))
+		bslog.Errorf("[log forwarder] %d documents rejected by elasticsearch, last error: %s", rejected, lastErr)
+	}
+	return retry, nil
+}
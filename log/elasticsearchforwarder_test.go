@@ -0,0 +1,226 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type bulkRequest struct {
+	contentType string
+	lines       []map[string]interface{}
+}
+
+func parseBulkRequest(c *check.C, r *http.Request) bulkRequest {
+	req := bulkRequest{contentType: r.Header.Get("Content-Type")}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		c.Assert(err, check.IsNil)
+		req.lines = append(req.lines, line)
+	}
+	return req
+}
+
+func (s *S) TestLogForwarderElasticsearch(c *check.C) {
+	reqCh := make(chan bulkRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/es/_bulk")
+		reqCh <- parseBulkRequest(c, r)
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	defer srv.Close()
+	os.Setenv("LOG_ELASTICSEARCH_URL", srv.URL+"/es/")
+	os.Setenv("LOG_ELASTICSEARCH_BULK_ACTIONS", "2")
+	os.Setenv("LOG_ELASTICSEARCH_FLUSH_INTERVAL", "60")
+	os.Setenv("LOG_ELASTICSEARCH_INDEX_PATTERN", "logs-%Y.%m.%d")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"elasticsearch"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, content := range []string{"mymsg", "mymsg2"} {
+		_, err = conn.Write([]byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: %s\n", s.id, content)))
+		c.Assert(err, check.IsNil)
+	}
+	var req bulkRequest
+	select {
+	case req = <-reqCh:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for bulk request")
+	}
+	c.Assert(req.contentType, check.Equals, "application/x-ndjson")
+	c.Assert(req.lines, check.DeepEquals, []map[string]interface{}{
+		{"index": map[string]interface{}{"_index": "logs-2015.06.05"}},
+		{"@timestamp": "2015-06-05T16:13:47Z", "message": "mymsg", "app": "coolappname", "process": "procx", "unit": s.idShort, "priority": float64(30), "severity": "info"},
+		{"index": map[string]interface{}{"_index": "logs-2015.06.05"}},
+		{"@timestamp": "2015-06-05T16:13:47Z", "message": "mymsg2", "app": "coolappname", "process": "procx", "unit": s.idShort, "priority": float64(30), "severity": "info"},
+	})
+}
+
+func (s *S) TestElasticsearchConnFlushInterval(c *check.C) {
+	reqCh := make(chan bulkRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqCh <- parseBulkRequest(c, r)
+		w.Write([]byte(`{"errors":false,"items":[]}`))
+	}))
+	defer srv.Close()
+	b := &elasticsearchBackend{
+		bulkURL:       srv.URL + "/_bulk",
+		indexPattern:  "bs",
+		bulkActions:   100,
+		bulkSize:      1024 * 1024,
+		flushInterval: 100 * time.Millisecond,
+		client:        http.DefaultClient,
+		dropped:       messagesDropped.WithLabelValues("elasticsearch", "test"),
+	}
+	conn, err := b.connect()
+	c.Assert(err, check.IsNil)
+	defer b.close(conn)
+	err = b.process(conn, &elasticsearchDocument{Message: "mymsg"})
+	c.Assert(err, check.IsNil)
+	select {
+	case req := <-reqCh:
+		c.Assert(req.lines, check.HasLen, 2)
+		c.Assert(req.lines[0], check.DeepEquals, map[string]interface{}{"index": map[string]interface{}{"_index": "bs"}})
+		c.Assert(req.lines[1]["message"], check.Equals, "mymsg")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for bulk request")
+	}
+}
+
+func (s *S) TestElasticsearchConnRetry(c *check.C) {
+	oldInterval := batchRetryInterval
+	batchRetryInterval = time.Millisecond
+	defer func() { batchRetryInterval = oldInterval }()
+	var requests [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := parseBulkRequest(c, r)
+		var messages []string
+		for i := 1; i < len(req.lines); i += 2 {
+			messages = append(messages, req.lines[i]["message"].(string))
+		}
+		requests = append(requests, messages)
+		switch len(requests) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Write([]byte(`{"errors":true,"items":[
+				{"index":{"status":201}},
+				{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},
+				{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}},
+				{"index":{"status":503,"error":{"type":"unavailable_shards_exception"}}}
+			]}`))
+		default:
+			w.Write([]byte(`{"errors":false,"items":[{"index":{"status":201}},{"index":{"status":201}}]}`))
+		}
+	}))
+	defer srv.Close()
+	dropped := messagesDropped.WithLabelValues("elasticsearch", "test-retry")
+	b := &elasticsearchBackend{
+		bulkURL:      srv.URL + "/_bulk",
+		indexPattern: "bs",
+		bulkActions:  4,
+		bulkSize:     1024 * 1024,
+		maxRetries:   3,
+		client:       http.DefaultClient,
+		dropped:      dropped,
+	}
+	conn, err := b.connect()
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 4; i++ {
+		err = b.process(conn, &elasticsearchDocument{Message: fmt.Sprintf("msg-%d", i)})
+		c.Assert(err, check.IsNil)
+	}
+	b.close(conn)
+	c.Assert(requests, check.DeepEquals, [][]string{
+		{"msg-0", "msg-1", "msg-2", "msg-3"},
+		{"msg-0", "msg-1", "msg-2", "msg-3"},
+		{"msg-1", "msg-3"},
+	})
+	c.Assert(dropped.Value(), check.Equals, uint64(1))
+}
+
+func (s *S) TestElasticsearchConnRetryExhausted(c *check.C) {
+	oldInterval := batchRetryInterval
+	batchRetryInterval = time.Millisecond
+	defer func() { batchRetryInterval = oldInterval }()
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		requests++
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	dropped := messagesDropped.WithLabelValues("elasticsearch", "test-exhausted")
+	b := &elasticsearchBackend{
+		bulkURL:      srv.URL + "/_bulk",
+		indexPattern: "bs",
+		bulkActions:  1,
+		bulkSize:     1024 * 1024,
+		maxRetries:   2,
+		client:       http.DefaultClient,
+		dropped:      dropped,
+	}
+	conn, err := b.connect()
+	c.Assert(err, check.IsNil)
+	defer b.close(conn)
+	err = b.process(conn, &elasticsearchDocument{Message: "mymsg"})
+	c.Assert(err, check.ErrorMatches, "elasticsearch bulk request failed with status 429")
+	c.Assert(requests, check.Equals, 3)
+	c.Assert(dropped.Value(), check.Equals, uint64(1))
+}
+
+func (s *S) TestFormatIndexName(c *check.C) {
+	ts := time.Date(2017, 3, 9, 22, 5, 0, 0, time.FixedZone("", -3*3600))
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{"bs", "bs"},
+		{"bs-%Y.%m.%d", "bs-2017.03.10"},
+		{"bs-%Y.%m.%d.%H", "bs-2017.03.10.01"},
+		{"bs-%%-%x-%", "bs-%-%x-%"},
+	}
+	for _, tt := range tests {
+		c.Assert(formatIndexName(tt.pattern, ts), check.Equals, tt.expected)
+	}
+}
+
+func (s *S) TestElasticsearchCodec(c *check.C) {
+	b := &elasticsearchBackend{}
+	doc := &elasticsearchDocument{
+		Timestamp: time.Date(2017, 3, 21, 21, 28, 22, 0, time.UTC),
+		Message:   "mymsg",
+		App:       "myapp",
+		Process:   "web",
+		Unit:      "cont1",
+		Priority:  30,
+	}
+	data, err := b.encodeMessage(doc)
+	c.Assert(err, check.IsNil)
+	msg, err := b.decodeMessage(data)
+	c.Assert(err, check.IsNil)
+	c.Assert(msg, check.DeepEquals, doc)
+	c.Assert(bytes.Contains(data, []byte(`"@timestamp"`)), check.Equals, true)
+}
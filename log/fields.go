@@ -0,0 +1,262 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tsuru/bs/config"
+)
+
+// logField is a field extracted from structured message content. Values are
+// strings, bools, json.Number, nil or, for nested JSON values, maps and
+// slices.
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// fieldString returns the value of a field as a string, nested values are
+// encoded as JSON.
+func fieldString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// structuredParser extracts the level, message, timestamp and other fields
+// from structured message content.
+type structuredParser struct {
+	formats       []string
+	levelFields   []string
+	messageFields []string
+	timeFields    []string
+}
+
+// newStructuredParser loads the parser settings from LOG_PARSE_*
+// environment variables. It returns nil if parsing is disabled.
+func newStructuredParser() (*structuredParser, error) {
+	formats := config.StringsEnvOrDefault(nil, "LOG_PARSE_FORMATS")
+	if len(formats) == 0 {
+		return nil, nil
+	}
+	for _, format := range formats {
+		if format != "json" && format != "logfmt" {
+			return nil, fmt.Errorf("invalid log parse format %q, expected json or logfmt", format)
+		}
+	}
+	return &structuredParser{
+		formats:       formats,
+		levelFields:   config.StringsEnvOrDefault(defaultLevelFields, "LOG_PARSE_LEVEL_FIELDS"),
+		messageFields: config.StringsEnvOrDefault([]string{"msg", "message"}, "LOG_PARSE_MESSAGE_FIELDS"),
+		timeFields:    config.StringsEnvOrDefault([]string{"time", "timestamp", "ts", "@timestamp"}, "LOG_PARSE_TIME_FIELDS"),
+	}, nil
+}
+
+// parse sets the fields of parts if its content is structured, content is
+// kept unchanged.
+func (p *structuredParser) parse(parts *rawLogParts) {
+	var fields []logField
+	for _, format := range p.formats {
+		if format == "json" {
+			fields = parseJSONFields(parts.content)
+		} else {
+			fields = parseLogfmtFields(parts.content)
+		}
+		if fields != nil {
+			break
+		}
+	}
+	if fields == nil {
+		return
+	}
+	var message, level, ts bool
+	remaining := fields[:0]
+	for _, field := range fields {
+		switch {
+		case !message && containsString(p.messageFields, field.key):
+			if value, ok := field.value.(string); ok {
+				parts.message = []byte(value)
+				message = true
+				continue
+			}
+		case !level && containsString(p.levelFields, field.key):
+			if value, ok := field.value.(string); ok {
+				if name := parseLevel(value); name != "" {
+					parts.level = name
+					level = true
+					continue
+				}
+			}
+		case !ts && containsString(p.timeFields, field.key):
+			if t, ok := parseFieldTime(field.value); ok {
+				parts.ts = t
+				ts = true
+				continue
+			}
+		}
+		remaining = append(remaining, field)
+	}
+	parts.structured = true
+	parts.fields = append(parts.fields, remaining...)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFieldTime parses RFC 3339 timestamps and numeric unix timestamps, in
+// seconds or milliseconds.
+func parseFieldTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			if n <= 0 {
+				return time.Time{}, false
+			}
+			if n > 1e12 {
+				return time.Unix(0, n*int64(time.Millisecond)).UTC(), true
+			}
+			return time.Unix(n, 0).UTC(), true
+		}
+		f, err := v.Float64()
+		if err != nil || f <= 0 {
+			return time.Time{}, false
+		}
+		if f > 1e12 {
+			f /= 1000
+		}
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9)).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// parseJSONFields returns the fields of content, in order, if it's a JSON
+// object.
+func parseJSONFields(content []byte) []logField {
+	content = bytes.TrimSpace(content)
+	if len(content) < 2 || content[0] != '{' || content[len(content)-1] != '}' {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if _, err := decoder.Token(); err != nil {
+		return nil
+	}
+	fields := []logField{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		key, ok := token.(string)
+		if !ok {
+			return nil
+		}
+		var value interface{}
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil
+		}
+		fields = append(fields, logField{key: key, value: value})
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil
+	}
+	return fields
+}
+
+// appendJSONFields adds fields as top level keys of the JSON object in data.
+// Keys already present in data are not overwritten.
+func appendJSONFields(data []byte, fields []logField) ([]byte, error) {
+	if len(fields) == 0 {
+		return data, nil
+	}
+	var existing map[string]json.RawMessage
+	err := json.Unmarshal(data, &existing)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(data[:bytes.LastIndexByte(data, '}')])
+	for _, field := range fields {
+		if _, ok := existing[field.key]; ok {
+			continue
+		}
+		key, err := json.Marshal(field.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		existing[field.key] = value
+		if len(existing) > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// extractJSONFields returns the keys of the JSON object in data not in known
+// as fields, sorted by key.
+func extractJSONFields(data []byte, known ...string) ([]logField, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	err := decoder.Decode(&values)
+	if err != nil {
+		return nil, err
+	}
+	var fields []logField
+	for key, value := range values {
+		if !containsString(known, key) {
+			fields = append(fields, logField{key: key, value: value})
+		}
+	}
+	sort.Sort(fieldsByKey(fields))
+	return fields, nil
+}
+
+type fieldsByKey []logField
+
+func (l fieldsByKey) Len() int           { return len(l) }
+func (l fieldsByKey) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l fieldsByKey) Less(i, j int) bool { return l[i].key < l[j].key }
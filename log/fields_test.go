@@ -0,0 +1,189 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Graylog2/go-gelf/gelf"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestStructuredParserJSON(c *check.C) {
+	os.Setenv("LOG_PARSE_FORMATS", "json")
+	p, err := newStructuredParser()
+	c.Assert(err, check.IsNil)
+	ts := time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC)
+	parts := &rawLogParts{
+		ts:      ts,
+		content: []byte(` {"level":"ERROR","msg":"request failed","time":"2017-03-09T10:00:00.5Z","status":500,"ok":false,"user":{"id":1},"message":"other"} `),
+	}
+	p.parse(parts)
+	c.Assert(string(parts.message), check.Equals, "request failed")
+	c.Assert(parts.level, check.Equals, "err")
+	c.Assert(parts.severity(), check.Equals, "err")
+	c.Assert(parts.ts.Equal(time.Date(2017, 3, 9, 10, 0, 0, 5e8, time.UTC)), check.Equals, true)
+	c.Assert(parts.fields, check.DeepEquals, []logField{
+		{key: "status", value: json.Number("500")},
+		{key: "ok", value: false},
+		{key: "user", value: map[string]interface{}{"id": json.Number("1")}},
+		{key: "message", value: "other"},
+	})
+	c.Assert(string(parts.text()), check.Equals, "request failed")
+}
+
+func (s *S) TestStructuredParserJSONUnknownLevelAndTime(c *check.C) {
+	os.Setenv("LOG_PARSE_FORMATS", "json")
+	os.Setenv("LOG_PARSE_LEVEL_FIELDS", "lvl")
+	os.Setenv("LOG_PARSE_MESSAGE_FIELDS", "text")
+	p, err := newStructuredParser()
+	c.Assert(err, check.IsNil)
+	ts := time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC)
+	parts := &rawLogParts{ts: ts, content: []byte(`{"lvl":"verbose","level":"error","text":"hi","ts":1489053600123}`)}
+	p.parse(parts)
+	c.Assert(string(parts.message), check.Equals, "hi")
+	c.Assert(parts.level, check.Equals, "")
+	c.Assert(parts.ts.Equal(time.Date(2017, 3, 9, 10, 0, 0, 123e6, time.UTC)), check.Equals, true)
+	c.Assert(parts.fields, check.DeepEquals, []logField{
+		{key: "lvl", value: "verbose"},
+		{key: "level", value: "error"},
+	})
+}
+
+func (s *S) TestStructuredParserIgnoresOtherContent(c *check.C) {
+	os.Setenv("LOG_PARSE_FORMATS", "json")
+	p, err := newStructuredParser()
+	c.Assert(err, check.IsNil)
+	for _, content := range []string{"plain message", `{"a":1`, `{"a":1} {"b":2}`, `[1, 2]`, `{"a":}`} {
+		parts := &rawLogParts{content: []byte(content)}
+		p.parse(parts)
+		c.Check(parts.message, check.IsNil)
+		c.Check(parts.fields, check.IsNil)
+		c.Check(string(parts.text()), check.Equals, content)
+	}
+}
+
+func (s *S) TestStructuredParserConfig(c *check.C) {
+	p, err := newStructuredParser()
+	c.Assert(err, check.IsNil)
+	c.Assert(p, check.IsNil)
+	os.Setenv("LOG_PARSE_FORMATS", "json,xml")
+	_, err = newStructuredParser()
+	c.Assert(err, check.ErrorMatches, `invalid log parse format "xml", expected json or logfmt`)
+}
+
+func (s *S) TestAppendJSONFields(c *check.C) {
+	fields := []logField{
+		{key: "status", value: json.Number("200")},
+		{key: "app", value: "ignored"},
+		{key: "path", value: "/"},
+	}
+	data, err := appendJSONFields([]byte(`{"app":"myapp"}`), fields)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, `{"app":"myapp","status":200,"path":"/"}`)
+	data, err = appendJSONFields([]byte(`{}`), fields[:1])
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, `{"status":200}`)
+	extracted, err := extractJSONFields([]byte(`{"app":"myapp","status":200,"path":"/"}`), "app")
+	c.Assert(err, check.IsNil)
+	c.Assert(extracted, check.DeepEquals, []logField{
+		{key: "path", value: "/"},
+		{key: "status", value: json.Number("200")},
+	})
+}
+
+func (s *S) TestElasticsearchCodecWithFields(c *check.C) {
+	b := &elasticsearchBackend{}
+	doc := &elasticsearchDocument{
+		Timestamp: time.Date(2017, 3, 21, 21, 28, 22, 0, time.UTC),
+		Message:   "mymsg",
+		Fields:    []logField{{key: "status", value: json.Number("200")}, {key: "message", value: "dup"}},
+	}
+	data, err := b.encodeMessage(doc)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, `{"@timestamp":"2017-03-21T21:28:22Z","message":"mymsg","app":"","process":"","unit":"","priority":0,"severity":"","status":200}`)
+	msg, err := b.decodeMessage(data)
+	c.Assert(err, check.IsNil)
+	doc.Fields = doc.Fields[:1]
+	c.Assert(msg, check.DeepEquals, doc)
+}
+
+func (s *S) TestTsuruBackendReadableMessage(c *check.C) {
+	b := &tsuruBackend{}
+	parts := &rawLogParts{
+		content: []byte(`{"msg":"done","status":200,"path":"/a b"}`),
+		message: []byte("done"),
+		fields:  []logField{{key: "status", value: json.Number("200")}, {key: "path", value: "/a b"}},
+	}
+	c.Assert(b.message(parts), check.Equals, `{"msg":"done","status":200,"path":"/a b"}`)
+	b.readableMessages = true
+	c.Assert(b.message(parts), check.Equals, `done status=200 path="/a b"`)
+	parts.message = nil
+	c.Assert(b.message(parts), check.Equals, `status=200 path="/a b"`)
+	c.Assert(b.message(&rawLogParts{content: []byte("plain")}), check.Equals, "plain")
+}
+
+func (s *S) TestLogForwarderStructuredRFC5424(c *check.C) {
+	os.Setenv("LOG_PARSE_FORMATS", "json")
+	os.Setenv("LOG_SYSLOG_FORMAT", "rfc5424")
+	os.Setenv("LOG_SYSLOG_HOSTNAME", "node1")
+	udpConn := listenUDP(c)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	nodeAddr := lf.backends[0].(*syslogBackend).nodeAddr
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte(fmt.Sprintf(`<30>2015-06-05T16:13:47Z myhost docker/%s: {"msg":"done","status":200,"a b]":"x\"y"}`+"\n", s.id)))
+	c.Assert(err, check.IsNil)
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	expected := fmt.Sprintf(`<30>1 2015-06-05T13:13:47.000000-03:00 node1 coolappname procx - [tsuru@32473 unit="%s" app="coolappname" process="procx" node="%s" status="200" a_b_="x\"y"] done`+"\n", s.idShort, nodeAddr)
+	c.Assert(string(buffer[:n]), check.Equals, expected)
+}
+
+func (s *S) TestGelfForwarderStructuredFields(c *check.C) {
+	os.Setenv("LOG_PARSE_FORMATS", "json")
+	reader, err := gelf.NewReader("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_GELF_HOST", reader.Addr())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte(fmt.Sprintf(`<30>2015-06-05T16:13:47Z myhost docker/%s: {"level":"warn","msg":"slow","duration":1.5,"id":"x","user name":"bob","app":"other"}`+"\n", s.id)))
+	c.Assert(err, check.IsNil)
+	gelfMsg, err := reader.ReadMessage()
+	c.Assert(err, check.IsNil)
+	c.Assert(gelfMsg.Short, check.Equals, "slow")
+	c.Assert(gelfMsg.Level, check.Equals, gelf.LOG_WARNING)
+	c.Assert(gelfMsg.Extra, check.DeepEquals, map[string]interface{}{
+		"_app":       "coolappname",
+		"_pid":       "procx",
+		"_duration":  1.5,
+		"_user_name": "bob",
+	})
+}
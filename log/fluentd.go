@@ -0,0 +1,230 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+var errInvalidForwardMessage = errors.New("invalid forward message")
+
+const defaultFluentdMaxChunkSize = 8 << 20
+
+// fluentdMessageKeys are the record keys holding the log message, "log" is
+// used by the docker fluentd log driver.
+var fluentdMessageKeys = []string{"log", "message", "msg"}
+
+// listenFluentd accepts connections using the fluentd forward protocol on
+// addr, a TCP address or a tcp:// or unix:// URL.
+func (l *LogForwarder) listenFluentd(addr string) error {
+	network, address := "tcp", strings.TrimPrefix(addr, "tcp://")
+	if strings.HasPrefix(addr, "unix://") {
+		network, address = "unix", strings.TrimPrefix(addr, "unix://")
+	}
+	var listener net.Listener
+	listen := func() (err error) {
+		listener, err = net.Listen(network, address)
+		return err
+	}
+	var err error
+	if network == "unix" {
+		err = listenUnixSocket(address, listen)
+	} else {
+		err = listen()
+	}
+	if err != nil {
+		return err
+	}
+	l.streamListeners = append(l.streamListeners, newStreamListener(listener, l.serveFluentd))
+	return nil
+}
+
+// serveFluentd reads forward protocol messages from conn, in the Message,
+// Forward, PackedForward and CompressedPackedForward modes, acknowledging
+// them when requested by the client.
+func (l *LogForwarder) serveFluentd(conn net.Conn) {
+	dec := newMsgpackDecoder(conn)
+	for {
+		value, err := dec.decode()
+		if err != nil {
+			if err != io.EOF {
+				bslog.Errorf("[log forwarder] unable to read forward message from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		option, err := l.handleForwardMessage(value)
+		if err != nil {
+			bslog.Errorf("[log forwarder] unable to handle forward message from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+		if chunk, ok := option["chunk"].(string); ok && chunk != "" {
+			_, err = conn.Write(appendMsgpack(nil, map[string]interface{}{"ack": chunk}))
+			if err != nil {
+				bslog.Errorf("[log forwarder] unable to write forward ack to %s: %s", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+func (l *LogForwarder) handleForwardMessage(value interface{}) (map[string]interface{}, error) {
+	msg, ok := value.([]interface{})
+	if !ok || len(msg) < 2 {
+		return nil, errInvalidForwardMessage
+	}
+	var entries []interface{}
+	var option map[string]interface{}
+	var err error
+	switch v := msg[1].(type) {
+	case []interface{}:
+		option = forwardOption(msg, 2)
+		entries = v
+	case []byte, string:
+		option = forwardOption(msg, 2)
+		entries, err = unpackForwardEntries(v, option, l.fluentdMaxChunk)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		if len(msg) < 3 {
+			return nil, errInvalidForwardMessage
+		}
+		option = forwardOption(msg, 3)
+		entries = []interface{}{[]interface{}{msg[1], msg[2]}}
+	}
+	for _, entry := range entries {
+		pair, ok := entry.([]interface{})
+		if !ok || len(pair) < 2 {
+			return nil, errInvalidForwardMessage
+		}
+		record, ok := pair[1].(map[string]interface{})
+		if !ok {
+			return nil, errInvalidForwardMessage
+		}
+		l.handleFluentdRecord(forwardTime(pair[0]), record)
+	}
+	return option, nil
+}
+
+func forwardOption(msg []interface{}, i int) map[string]interface{} {
+	if len(msg) <= i {
+		return nil
+	}
+	option, _ := msg[i].(map[string]interface{})
+	return option
+}
+
+// unpackForwardEntries decodes the entries of a PackedForward message,
+// decompressing them first if they're compressed. Compressed entries larger
+// than maxSize bytes are rejected.
+func unpackForwardEntries(packed interface{}, option map[string]interface{}, maxSize int) ([]interface{}, error) {
+	var reader io.Reader
+	var limited *io.LimitedReader
+	switch v := packed.(type) {
+	case []byte:
+		reader = bytes.NewReader(v)
+	case string:
+		reader = strings.NewReader(v)
+	}
+	if compressed, _ := option["compressed"].(string); compressed != "" {
+		if compressed != "gzip" {
+			return nil, fmt.Errorf("unsupported forward compression %q", compressed)
+		}
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		limited = &io.LimitedReader{R: gzipReader, N: int64(maxSize) + 1}
+		reader = limited
+	}
+	dec := newMsgpackDecoder(reader)
+	var entries []interface{}
+	for {
+		entry, err := dec.decode()
+		if limited != nil && limited.N == 0 {
+			return nil, fmt.Errorf("decompressed forward entries larger than %d bytes", maxSize)
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// forwardTime returns the time of a forward entry, sent as an EventTime or
+// as seconds since the epoch.
+func forwardTime(value interface{}) time.Time {
+	switch v := value.(type) {
+	case msgpackExt:
+		if t, ok := eventTime(v); ok {
+			return t
+		}
+	case int64:
+		return time.Unix(v, 0)
+	case uint64:
+		return time.Unix(int64(v), 0)
+	case float64:
+		sec := int64(v)
+		return time.Unix(sec, int64((v-float64(sec))*1e9))
+	}
+	return time.Now()
+}
+
+// handleFluentdRecord handles a record as a message received by the syslog
+// server. The container is taken from the container_id or container_name
+// keys and the remaining keys, besides the message, are sent as fields.
+func (l *LogForwarder) handleFluentdRecord(ts time.Time, record map[string]interface{}) {
+	parts := &rawLogParts{ts: ts}
+	if id, ok := record["container_id"].(string); ok {
+		parts.container = []byte(id)
+	} else if name, ok := record["container_name"].(string); ok {
+		parts.container = []byte(strings.TrimPrefix(name, "/"))
+	}
+	parts.stream, _ = record["source"].(string)
+	parts.priority = streamPriority(parts.stream)
+	var messageKey string
+	for _, key := range fluentdMessageKeys {
+		if content, ok := msgpackFieldValue(record[key]).(string); ok {
+			parts.content = bytes.TrimRight([]byte(content), "\r\n")
+			messageKey = key
+			break
+		}
+	}
+	keys := make([]string, 0, len(record))
+	for key := range record {
+		switch key {
+		case messageKey, "container_id", "container_name", "source":
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := msgpackFieldValue(record[key])
+		if parts.level == "" && containsString(defaultLevelFields, key) {
+			if level, ok := value.(string); ok && parseLevel(level) != "" {
+				parts.level = parseLevel(level)
+				continue
+			}
+		}
+		parts.fields = append(parts.fields, logField{key: key, value: value})
+	}
+	l.Handle(format.LogParts{"parts": parts}, int64(len(parts.content)), nil)
+}
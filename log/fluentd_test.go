@@ -0,0 +1,225 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type partsRecorder struct {
+	mu       sync.Mutex
+	messages []*rawLogParts
+	ch       chan struct{}
+}
+
+func (r *partsRecorder) initialize() error {
+	return nil
+}
+
+func (r *partsRecorder) sendMessage(parts *rawLogParts, appName, processName, container string) {
+	r.mu.Lock()
+	r.messages = append(r.messages, parts)
+	r.mu.Unlock()
+	r.ch <- struct{}{}
+}
+
+func (r *partsRecorder) stop() {}
+
+func (r *partsRecorder) wait(c *check.C, n int) []*rawLogParts {
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.ch:
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timeout waiting for message %d", i)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*rawLogParts(nil), r.messages...)
+}
+
+// startRecorderForwarder starts a forwarder sending messages to a recorder
+// backend and to a syslog server.
+func (s *S) startRecorderForwarder(c *check.C) (*LogForwarder, *partsRecorder, *net.UDPConn) {
+	recorder := &partsRecorder{ch: make(chan struct{}, 100)}
+	logBackends["recorder"] = func() logBackend { return recorder }
+	udpConn := listenUDP(c)
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	lf := &LogForwarder{
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"recorder", "syslog"},
+	}
+	err := lf.Start()
+	delete(logBackends, "recorder")
+	c.Assert(err, check.IsNil)
+	return lf, recorder, udpConn
+}
+
+func readForwardAck(c *check.C, conn net.Conn) interface{} {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ack, err := newMsgpackDecoder(conn).decode()
+	c.Assert(err, check.IsNil)
+	return ack
+}
+
+func (s *S) TestLogForwarderFluentdModes(c *check.C) {
+	os.Setenv("FLUENTD_LISTEN_ADDRESS", "127.0.0.1:59324")
+	lf, recorder, udpConn := s.startRecorderForwarder(c)
+	defer udpConn.Close()
+	defer lf.stopWait()
+	conn, err := net.Dial("tcp", "127.0.0.1:59324")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	ts := time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC)
+	record := func(msg string) map[string]interface{} {
+		return map[string]interface{}{"container_id": s.id, "source": "stdout", "log": msg}
+	}
+	// Message mode
+	_, err = conn.Write(appendMsgpack(nil, []interface{}{"docker.app", ts.Unix(), record("message"), map[string]interface{}{"chunk": "c1"}}))
+	c.Assert(err, check.IsNil)
+	c.Assert(readForwardAck(c, conn), check.DeepEquals, map[string]interface{}{"ack": "c1"})
+	// Forward mode
+	_, err = conn.Write(appendMsgpack(nil, []interface{}{"docker.app", []interface{}{
+		[]interface{}{ts, record("forward 1")},
+		[]interface{}{float64(ts.Unix()) + 0.5, record("forward 2")},
+	}}))
+	c.Assert(err, check.IsNil)
+	// PackedForward mode
+	var packed []byte
+	packed = appendMsgpack(packed, []interface{}{ts, record("packed 1")})
+	packed = appendMsgpack(packed, []interface{}{ts, record("packed 2")})
+	_, err = conn.Write(appendMsgpack(nil, []interface{}{"docker.app", packed, map[string]interface{}{"size": 2}}))
+	c.Assert(err, check.IsNil)
+	// CompressedPackedForward mode
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(appendMsgpack(nil, []interface{}{ts, record("compressed")}))
+	gzipWriter.Close()
+	_, err = conn.Write(appendMsgpack(nil, []interface{}{"docker.app", compressed.Bytes(), map[string]interface{}{
+		"compressed": "gzip",
+		"chunk":      "c2",
+	}}))
+	c.Assert(err, check.IsNil)
+	c.Assert(readForwardAck(c, conn), check.DeepEquals, map[string]interface{}{"ack": "c2"})
+	messages := recorder.wait(c, 6)
+	var contents []string
+	for _, parts := range messages {
+		contents = append(contents, string(parts.content))
+	}
+	c.Assert(contents, check.DeepEquals, []string{"message", "forward 1", "forward 2", "packed 1", "packed 2", "compressed"})
+	c.Assert(messages[2].ts.Equal(ts.Add(500*time.Millisecond)), check.Equals, true)
+	c.Assert(readUDPMessages(c, udpConn), check.DeepEquals, []string{
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: compressed\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: forward 1\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: forward 2\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: message\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: packed 1\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: packed 2\n", s.idShort),
+	})
+}
+
+func (s *S) TestLogForwarderFluentdRecord(c *check.C) {
+	os.Setenv("FLUENTD_LISTEN_ADDRESS", "tcp://127.0.0.1:59324")
+	lf, recorder, udpConn := s.startRecorderForwarder(c)
+	defer udpConn.Close()
+	defer lf.stopWait()
+	conn, err := net.Dial("tcp", "127.0.0.1:59324")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	ts := time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC)
+	_, err = conn.Write(appendMsgpack(nil, []interface{}{"app", ts, map[string]interface{}{
+		"container_name": "/myContName",
+		"source":         "stderr",
+		"message":        []byte("failed\n"),
+		"level":          "warn",
+		"status":         500,
+		"tags":           []interface{}{"a", 1.5},
+	}}))
+	c.Assert(err, check.IsNil)
+	_, err = conn.Write(appendMsgpack(nil, []interface{}{"app", ts, map[string]interface{}{
+		"container_id": "unknown",
+		"log":          "ignored",
+	}}))
+	c.Assert(err, check.IsNil)
+	messages := recorder.wait(c, 1)
+	c.Assert(messages, check.HasLen, 1)
+	parts := messages[0]
+	c.Assert(string(parts.container), check.Equals, "myContName")
+	c.Assert(string(parts.content), check.Equals, "failed")
+	c.Assert(parts.stream, check.Equals, "stderr")
+	c.Assert(parts.level, check.Equals, "warning")
+	c.Assert(string(parts.priority), check.Equals, "28")
+	c.Assert(parts.fields, check.DeepEquals, []logField{
+		{key: "status", value: json.Number("500")},
+		{key: "tags", value: []interface{}{"a", json.Number("1.5")}},
+	})
+	c.Assert(readUDPMessages(c, udpConn), check.DeepEquals, []string{
+		"<28>Jun  5 13:13:47 myContName coolappname[procx]: failed\n",
+	})
+}
+
+func (s *S) TestLogForwarderFluentdInvalidMessage(c *check.C) {
+	os.Setenv("FLUENTD_LISTEN_ADDRESS", "127.0.0.1:59324")
+	lf, recorder, udpConn := s.startRecorderForwarder(c)
+	defer udpConn.Close()
+	defer lf.stopWait()
+	invalid := [][]byte{
+		appendMsgpack(nil, "not an array"),
+		appendMsgpack(nil, []interface{}{"tag", int64(1)}),
+		appendMsgpack(nil, []interface{}{"tag", []interface{}{"not a pair"}}),
+		appendMsgpack(nil, []interface{}{"tag", int64(1), "not a record"}),
+		appendMsgpack(nil, []interface{}{"tag", []byte{0xc1}}),
+		appendMsgpack(nil, []interface{}{"tag", []byte{}, map[string]interface{}{"compressed": "zstd"}}),
+	}
+	for _, data := range invalid {
+		conn, err := net.Dial("tcp", "127.0.0.1:59324")
+		c.Assert(err, check.IsNil)
+		_, err = conn.Write(data)
+		c.Assert(err, check.IsNil)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		c.Assert(err, check.NotNil)
+		conn.Close()
+	}
+	c.Assert(recorder.wait(c, 0), check.HasLen, 0)
+}
+
+func (s *S) TestLogForwarderFluentdListenError(c *check.C) {
+	os.Setenv("FLUENTD_LISTEN_ADDRESS", "127.0.0.1:xyz")
+	lf := LogForwarder{
+		DockerEndpoint: s.dockerServer.URL(),
+	}
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, "unable to listen for fluentd forward messages: .*")
+}
+
+func (s *S) TestUnpackForwardEntriesMaxSize(c *check.C) {
+	ts := time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC)
+	entry := appendMsgpack(nil, []interface{}{ts, map[string]interface{}{"log": strings.Repeat("x", 1000)}})
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	for i := 0; i < 10; i++ {
+		gzipWriter.Write(entry)
+	}
+	gzipWriter.Close()
+	option := map[string]interface{}{"compressed": "gzip"}
+	entries, err := unpackForwardEntries(compressed.Bytes(), option, 10*len(entry))
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 10)
+	_, err = unpackForwardEntries(compressed.Bytes(), option, 10*len(entry)-1)
+	c.Assert(err, check.ErrorMatches, fmt.Sprintf("decompressed forward entries larger than %d bytes", 10*len(entry)-1))
+	_, err = unpackForwardEntries(compressed.Bytes(), option, 1500)
+	c.Assert(err, check.ErrorMatches, "decompressed forward entries larger than 1500 bytes")
+}
@@ -0,0 +1,247 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/bsmetric"
+	"github.com/tsuru/bs/config"
+)
+
+const (
+	defaultFluentdTag         = "tsuru.{app}.{process}"
+	defaultFluentdBatchSize   = 1024 * 1024
+	defaultFluentdBatchEvents = 1000
+	fluentdWriteTimeout       = 10 * time.Second
+)
+
+type fluentdBackend struct {
+	network    string
+	address    string
+	tag        string
+	node       string
+	requireAck bool
+	ackTimeout time.Duration
+	batchSize  int
+	batchItems int
+	batchWait  time.Duration
+	maxRetries int
+	dropped    *bsmetric.Counter
+	queue      *messageQueue
+}
+
+type fluentdEntry struct {
+	Tag    string                 `json:"tag"`
+	Time   time.Time              `json:"time"`
+	Record map[string]interface{} `json:"record"`
+}
+
+// fluentdConn batches entries and sends them over a forward protocol
+// connection, dialed again when sending fails.
+type fluentdConn struct {
+	*batchConn
+	backend *fluentdBackend
+	conn    net.Conn
+}
+
+func (b *fluentdBackend) initialize() error {
+	address := config.StringEnvOrDefault("", "LOG_FLUENTD_ADDRESS")
+	if address == "" {
+		return errors.New("environment variable for LOG_FLUENTD_ADDRESS must be set")
+	}
+	b.network, b.address = "tcp", strings.TrimPrefix(address, "tcp://")
+	if strings.HasPrefix(address, "unix://") {
+		b.network, b.address = "unix", strings.TrimPrefix(address, "unix://")
+	}
+	b.tag = config.StringEnvOrDefault(defaultFluentdTag, "LOG_FLUENTD_TAG")
+	var err error
+	b.node = config.StringEnvOrDefault("", "LOG_FLUENTD_NODE")
+	if b.node == "" {
+		b.node, err = os.Hostname()
+		if err != nil {
+			bslog.Warnf("unable to read hostname for fluentd node field: %s", err)
+		}
+	}
+	b.requireAck, _ = strconv.ParseBool(os.Getenv("LOG_FLUENTD_REQUIRE_ACK"))
+	b.ackTimeout = config.SecondsEnvOrDefault(30, "LOG_FLUENTD_ACK_TIMEOUT")
+	b.batchSize = config.IntEnvOrDefault(defaultFluentdBatchSize, "LOG_FLUENTD_BATCH_SIZE")
+	b.batchItems = config.IntEnvOrDefault(defaultFluentdBatchEvents, "LOG_FLUENTD_BATCH_EVENTS")
+	b.batchWait = config.SecondsEnvOrDefault(1, "LOG_FLUENTD_BATCH_WAIT")
+	b.maxRetries = config.IntEnvOrDefault(3, "LOG_FLUENTD_MAX_RETRIES")
+	queueCfg := newQueueConfig("fluentd")
+	queueCfg.destination = b.network + "://" + b.address
+	b.dropped = messagesDropped.WithLabelValues(queueCfg.name, queueCfg.destination)
+	b.queue, err = processMessages(b, queueCfg)
+	return err
+}
+
+func (b *fluentdBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
+	if len(container) > containerIDTrimSize {
+		container = container[:containerIDTrimSize]
+	}
+	severity := parts.severity()
+	record := make(map[string]interface{}, len(parts.fields)+6)
+	for _, field := range parts.fields {
+		record[field.key] = field.value
+	}
+	record["app"] = appName
+	record["process"] = processName
+	record["unit"] = container
+	record["node"] = b.node
+	record["severity"] = severity
+	record["message"] = string(parts.text())
+	tag := strings.NewReplacer(
+		"{app}", appName,
+		"{process}", processName,
+		"{unit}", container,
+		"{node}", b.node,
+		"{severity}", severity,
+	).Replace(b.tag)
+	b.queue.send(&fluentdEntry{Tag: tag, Time: parts.ts, Record: record})
+}
+
+func (b *fluentdBackend) stop() {
+	b.queue.stop()
+}
+
+func (b *fluentdBackend) dial() (net.Conn, error) {
+	return net.DialTimeout(b.network, b.address, forwardConnDialTimeout)
+}
+
+func (b *fluentdBackend) connect() (net.Conn, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	c := &fluentdConn{backend: b, conn: conn}
+	c.batchConn = newBatchConn(batchConfig{
+		name:       "fluentd",
+		maxItems:   b.batchItems,
+		maxSize:    b.batchSize,
+		interval:   b.batchWait,
+		maxRetries: b.maxRetries,
+		dropped:    b.dropped,
+	}, c.send)
+	return c, nil
+}
+
+func (b *fluentdBackend) process(conn net.Conn, msg LogMessage) error {
+	entry := msg.(*fluentdEntry)
+	message, _ := entry.Record["message"].(string)
+	return conn.(*fluentdConn).add(entry, len(message))
+}
+
+func (b *fluentdBackend) close(conn net.Conn) {
+	c := conn.(*fluentdConn)
+	c.batchConn.Close()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+func (b *fluentdBackend) encodeMessage(msg LogMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (b *fluentdBackend) decodeMessage(data []byte) (LogMessage, error) {
+	var entry fluentdEntry
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(&entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// send writes items as PackedForward messages, one for each tag. Items from
+// messages not written, or not acknowledged when acks are required, are
+// returned to be retried on a new connection.
+func (c *fluentdConn) send(items []LogMessage) ([]LogMessage, error) {
+	var tags []string
+	groups := map[string][]LogMessage{}
+	for _, item := range items {
+		tag := item.(*fluentdEntry).Tag
+		if groups[tag] == nil {
+			tags = append(tags, tag)
+		}
+		groups[tag] = append(groups[tag], item)
+	}
+	for i, tag := range tags {
+		err := c.sendPacked(tag, groups[tag])
+		if err != nil {
+			if c.conn != nil {
+				c.conn.Close()
+				c.conn = nil
+			}
+			var retry []LogMessage
+			for _, tag := range tags[i:] {
+				retry = append(retry, groups[tag]...)
+			}
+			return retry, err
+		}
+	}
+	return nil, nil
+}
+
+func (c *fluentdConn) sendPacked(tag string, entries []LogMessage) error {
+	var err error
+	if c.conn == nil {
+		c.conn, err = c.backend.dial()
+		if err != nil {
+			return err
+		}
+	}
+	var packed []byte
+	for _, item := range entries {
+		entry := item.(*fluentdEntry)
+		packed = appendMsgpack(packed, []interface{}{entry.Time, entry.Record})
+	}
+	option := map[string]interface{}{"size": len(entries)}
+	var chunk string
+	if c.backend.requireAck {
+		chunk, err = newChunkID()
+		if err != nil {
+			return err
+		}
+		option["chunk"] = chunk
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(fluentdWriteTimeout))
+	_, err = c.conn.Write(appendMsgpack(nil, []interface{}{tag, packed, option}))
+	if err != nil || chunk == "" {
+		return err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.backend.ackTimeout))
+	resp, err := newMsgpackDecoder(c.conn).decode()
+	if err != nil {
+		return fmt.Errorf("unable to read fluentd ack: %s", err)
+	}
+	respMap, _ := resp.(map[string]interface{})
+	if ack, _ := respMap["ack"].(string); ack != chunk {
+		return fmt.Errorf("invalid fluentd ack %v, expected %q", resp, chunk)
+	}
+	return nil
+}
+
+func newChunkID() (string, error) {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(id[:]), nil
+}
@@ -0,0 +1,224 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type fluentdMessage struct {
+	tag     string
+	entries []interface{}
+	option  map[string]interface{}
+}
+
+// fluentdServer accepts forward protocol connections, sending each
+// PackedForward message received to ch. Acks are sent for the first noAck
+// connections only.
+type fluentdServer struct {
+	listener net.Listener
+	ch       chan fluentdMessage
+	noAck    int
+}
+
+func newFluentdServer(c *check.C, noAck int) *fluentdServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	srv := &fluentdServer{listener: listener, ch: make(chan fluentdMessage, 10), noAck: noAck}
+	go srv.serve(c)
+	return srv
+}
+
+func (s *fluentdServer) serve(c *check.C) {
+	for i := 0; ; i++ {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn, ack bool) {
+			defer conn.Close()
+			dec := newMsgpackDecoder(conn)
+			for {
+				value, err := dec.decode()
+				if err != nil {
+					return
+				}
+				msg := value.([]interface{})
+				entries, err := unpackForwardEntries(msg[1], nil, defaultFluentdMaxChunkSize)
+				c.Check(err, check.IsNil)
+				option := msg[2].(map[string]interface{})
+				s.ch <- fluentdMessage{tag: msg[0].(string), entries: entries, option: option}
+				if chunk, ok := option["chunk"]; ok && ack {
+					conn.Write(appendMsgpack(nil, map[string]interface{}{"ack": chunk}))
+				}
+			}
+		}(conn, i >= s.noAck)
+	}
+}
+
+func (s *fluentdServer) recv(c *check.C) fluentdMessage {
+	select {
+	case msg := <-s.ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for fluentd message")
+	}
+	return fluentdMessage{}
+}
+
+func (s *S) TestLogForwarderFluentd(c *check.C) {
+	srv := newFluentdServer(c, 0)
+	defer srv.listener.Close()
+	os.Setenv("LOG_FLUENTD_ADDRESS", "tcp://"+srv.listener.Addr().String())
+	os.Setenv("LOG_FLUENTD_NODE", "node1")
+	os.Setenv("LOG_FLUENTD_TAG", "bs.{app}.{severity}")
+	os.Setenv("LOG_FLUENTD_BATCH_EVENTS", "3")
+	os.Setenv("LOG_FLUENTD_BATCH_WAIT", "60")
+	os.Setenv("LOG_PARSE_FORMATS", "logfmt")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"fluentd"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, msg := range []string{
+		"<30>2015-06-05T16:13:47Z myhost docker/%s: mymsg",
+		"<27>2015-06-05T16:13:48Z myhost docker/%s: myerr",
+		"<30>2015-06-05T16:13:49Z myhost docker/%s: msg=mymsg2 status=200",
+	} {
+		_, err = conn.Write([]byte(fmt.Sprintf(msg+"\n", s.id)))
+		c.Assert(err, check.IsNil)
+	}
+	record := func(severity, message string) map[string]interface{} {
+		return map[string]interface{}{
+			"app":      "coolappname",
+			"process":  "procx",
+			"unit":     s.idShort,
+			"node":     "node1",
+			"severity": severity,
+			"message":  message,
+		}
+	}
+	eventTime := func(sec int) msgpackExt {
+		return msgpackExt{typ: eventTimeExtType, data: []byte{0x55, 0x71, 0xca, byte(0xbb + sec), 0, 0, 0, 0}}
+	}
+	infoRecord := record("info", "mymsg2")
+	infoRecord["status"] = "200"
+	msg := srv.recv(c)
+	c.Assert(msg.tag, check.Equals, "bs.coolappname.info")
+	c.Assert(msg.option, check.DeepEquals, map[string]interface{}{"size": int64(2)})
+	c.Assert(msg.entries, check.DeepEquals, []interface{}{
+		[]interface{}{eventTime(0), record("info", "mymsg")},
+		[]interface{}{eventTime(2), infoRecord},
+	})
+	msg = srv.recv(c)
+	c.Assert(msg.tag, check.Equals, "bs.coolappname.err")
+	c.Assert(msg.entries, check.DeepEquals, []interface{}{
+		[]interface{}{eventTime(1), record("err", "myerr")},
+	})
+}
+
+func (s *S) TestFluentdSendRequireAck(c *check.C) {
+	oldInterval := batchRetryInterval
+	batchRetryInterval = time.Millisecond
+	defer func() { batchRetryInterval = oldInterval }()
+	srv := newFluentdServer(c, 1)
+	defer srv.listener.Close()
+	dropped := messagesDropped.WithLabelValues("fluentd", "test-ack")
+	b := &fluentdBackend{
+		network:    "tcp",
+		address:    srv.listener.Addr().String(),
+		requireAck: true,
+		ackTimeout: 100 * time.Millisecond,
+		batchItems: 2,
+		batchSize:  1024,
+		maxRetries: 3,
+		dropped:    dropped,
+	}
+	conn, err := b.connect()
+	c.Assert(err, check.IsNil)
+	defer b.close(conn)
+	ts := time.Unix(1433520827, 0)
+	err = b.process(conn, &fluentdEntry{Tag: "a", Time: ts, Record: map[string]interface{}{"message": "m1"}})
+	c.Assert(err, check.IsNil)
+	err = b.process(conn, &fluentdEntry{Tag: "b", Time: ts, Record: map[string]interface{}{"message": "m2"}})
+	c.Assert(err, check.IsNil)
+	// The first connection doesn't send acks, so the batch is sent again on
+	// a new one.
+	var tags []string
+	chunks := map[interface{}]bool{}
+	for i := 0; i < 3; i++ {
+		msg := srv.recv(c)
+		tags = append(tags, msg.tag)
+		chunks[msg.option["chunk"]] = true
+	}
+	c.Assert(tags, check.DeepEquals, []string{"a", "a", "b"})
+	c.Assert(chunks, check.HasLen, 3)
+	c.Assert(dropped.Value(), check.Equals, uint64(0))
+}
+
+func (s *S) TestFluentdSendDropsAfterRetries(c *check.C) {
+	oldInterval := batchRetryInterval
+	batchRetryInterval = time.Millisecond
+	defer func() { batchRetryInterval = oldInterval }()
+	srv := newFluentdServer(c, 10)
+	defer srv.listener.Close()
+	dropped := messagesDropped.WithLabelValues("fluentd", "test-drop")
+	b := &fluentdBackend{
+		network:    "tcp",
+		address:    srv.listener.Addr().String(),
+		requireAck: true,
+		ackTimeout: 10 * time.Millisecond,
+		batchItems: 1,
+		batchSize:  1024,
+		maxRetries: 2,
+		dropped:    dropped,
+	}
+	conn, err := b.connect()
+	c.Assert(err, check.IsNil)
+	defer b.close(conn)
+	err = b.process(conn, &fluentdEntry{Tag: "a", Record: map[string]interface{}{"message": "m1"}})
+	c.Assert(err, check.ErrorMatches, "unable to read fluentd ack: .*timeout.*")
+	c.Assert(dropped.Value(), check.Equals, uint64(1))
+}
+
+func (s *S) TestLogForwarderFluentdRequiresAddress(c *check.C) {
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"fluentd"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "fluentd": environment variable for LOG_FLUENTD_ADDRESS must be set`)
+}
+
+func (s *S) TestFluentdCodec(c *check.C) {
+	b := &fluentdBackend{}
+	entry := &fluentdEntry{
+		Tag:  "tsuru.myapp.web",
+		Time: time.Date(2017, 3, 21, 21, 28, 22, 0, time.UTC),
+		Record: map[string]interface{}{
+			"message": "mymsg",
+			"status":  json.Number("200"),
+			"nested":  map[string]interface{}{"ok": true},
+		},
+	}
+	data, err := b.encodeMessage(entry)
+	c.Assert(err, check.IsNil)
+	msg, err := b.decodeMessage(data)
+	c.Assert(err, check.IsNil)
+	c.Assert(msg, check.DeepEquals, entry)
+}
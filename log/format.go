@@ -8,8 +8,10 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"strconv"
 	"time"
 
+	"github.com/tsuru/bs/container"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
 )
 
@@ -19,8 +21,56 @@ func (f *LenientFormat) GetParser(line []byte) format.LogParser {
 	return &LenientParser{line: line}
 }
 
+// GetSplitFunc returns a split function accepting both newline delimited
+// and octet counted (RFC 6587) framing, detected for each message.
 func (f *LenientFormat) GetSplitFunc() bufio.SplitFunc {
-	return nil
+	return splitSyslogFrames
+}
+
+// maxOctetCountDigits is the maximum length of the octet count prefix, larger
+// frames wouldn't fit in the scanner buffer anyway.
+const maxOctetCountDigits = 8
+
+// splitSyslogFrames splits frames prefixed by their length in octets and a
+// space or, otherwise, terminated by a newline. At EOF, the remaining data is
+// a single frame, so UDP datagrams are never split.
+func splitSyslogFrames(data []byte, atEOF bool) (int, []byte, error) {
+	skip := 0
+	for skip < len(data) && (data[skip] == '\n' || data[skip] == '\r') {
+		skip++
+	}
+	if skip == len(data) {
+		return skip, nil, nil
+	}
+	frame := data[skip:]
+	digits := 0
+	for digits < len(frame) && frame[digits] >= '0' && frame[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 && digits <= maxOctetCountDigits && frame[0] != '0' {
+		if digits == len(frame) && !atEOF {
+			// The length prefix may be incomplete.
+			return skip, nil, nil
+		}
+		if digits < len(frame) && frame[digits] == ' ' {
+			length, _ := strconv.Atoi(string(frame[:digits]))
+			end := digits + 1 + length
+			if len(frame) >= end {
+				return skip + end, frame[digits+1 : end], nil
+			}
+			if atEOF {
+				return len(data), frame[digits+1:], nil
+			}
+			return skip, nil, nil
+		}
+	}
+	if atEOF {
+		return len(data), bytes.TrimRight(frame, "\r\n"), nil
+	}
+	if idx := bytes.IndexByte(frame, '\n'); idx >= 0 {
+		return skip + idx + 1, bytes.TrimSuffix(frame[:idx], []byte{'\r'}), nil
+	}
+	return skip, nil, nil
 }
 
 type rawLogParts struct {
@@ -28,12 +78,34 @@ type rawLogParts struct {
 	priority  []byte
 	content   []byte
 	container []byte
+	// stream is the output stream of the container, stdout or stderr, when
+	// known.
+	stream string
+	// containerInfo is set by sources which know the app of the container,
+	// otherwise it's looked up in docker.
+	containerInfo *container.Container
+	// Set by the structured parser, message is empty if it isn't found in the
+	// content. level is then set by resolveSeverity. fields also holds RFC
+	// 5424 structured data params.
+	structured bool
+	message    []byte
+	level      string
+	fields     []logField
 }
 
 func (p *rawLogParts) String() string {
 	return fmt.Sprintf("{log entry: %v %q %q %q}", p.ts, string(p.priority), string(p.content), string(p.container))
 }
 
+// text returns the message found in structured content or the whole
+// content.
+func (p *rawLogParts) text() []byte {
+	if p.message != nil {
+		return p.message
+	}
+	return p.content
+}
+
 type LenientParser struct {
 	line  []byte
 	parts rawLogParts
@@ -49,6 +121,9 @@ func (e *parseError) Error() string {
 }
 
 func (p *LenientParser) Parse() error {
+	if isRFC5424(p.line) {
+		return parseRFC5424(p.line, &p.parts)
+	}
 	groups := parseLogLine(p.line)
 	if len(groups) != 7 {
 		return &parseError{line: p.line, msg: "invalid groups length"}
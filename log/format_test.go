@@ -5,6 +5,8 @@
 package log
 
 import (
+	"bufio"
+	"strings"
 	"testing"
 	"time"
 
@@ -20,9 +22,44 @@ func (s *S) TestLenientFormatGetParser(c *check.C) {
 }
 
 func (s *S) TestLenientFormatGetSplitFunc(c *check.C) {
+	data := "<30>first\r\n\n23 <30>1 - - - - - - octet\n13 <30>with\nline<30>last\n"
+	scanner := bufio.NewScanner(strings.NewReader(data))
 	lf := LenientFormat{}
-	splitFunc := lf.GetSplitFunc()
-	c.Assert(splitFunc, check.IsNil)
+	scanner.Split(lf.GetSplitFunc())
+	var tokens []string
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+	c.Assert(scanner.Err(), check.IsNil)
+	c.Assert(tokens, check.DeepEquals, []string{"<30>first", "<30>1 - - - - - - octet", "<30>with\nline", "<30>last"})
+}
+
+func (s *S) TestSplitSyslogFrames(c *check.C) {
+	tests := []struct {
+		data    string
+		atEOF   bool
+		advance int
+		token   string
+	}{
+		{"<30>msg\n<30>other", false, 8, "<30>msg"},
+		{"<30>msg", false, 0, ""},
+		{"<30>msg\nmore\n", true, 13, "<30>msg\nmore"},
+		{"12", false, 0, ""},
+		{"12 <30>", false, 0, ""},
+		{"12 <30>", true, 7, "<30>"},
+		{"7 <30>msg <30>", false, 9, "<30>msg"},
+		{"7 <30>msg", true, 9, "<30>msg"},
+		{"\n\n7 <30>msg", false, 11, "<30>msg"},
+		{"\r\n", false, 2, ""},
+		{"0 <30>msg\n", false, 10, "0 <30>msg"},
+		{"123456789 <30>msg\n", false, 18, "123456789 <30>msg"},
+	}
+	for i, tt := range tests {
+		advance, token, err := splitSyslogFrames([]byte(tt.data), tt.atEOF)
+		c.Check(err, check.IsNil)
+		c.Check(advance, check.Equals, tt.advance, check.Commentf("test %d", i))
+		c.Check(string(token), check.Equals, tt.token, check.Commentf("test %d", i))
+	}
 }
 
 func BenchmarkLenientParserParse(b *testing.B) {
@@ -52,6 +89,15 @@ func BenchmarkLenientParserParseUnixFormat(b *testing.B) {
 	}
 }
 
+func BenchmarkLenientParserParseRFC5424(b *testing.B) {
+	logLine := []byte(`<30>1 2015-06-05T16:13:47.123456Z vagrant-ubuntu-trusty-64 docker/00dfa98fe8e0 4843 - [meta seq="1"] hey`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lp := LenientParser{line: logLine}
+		lp.Parse()
+	}
+}
+
 func (s *S) TestLenientParserParse(c *check.C) {
 	examples := []string{
 		"<27>Jul 21 18:26:01 docker/091cafae73a9[927]: ",
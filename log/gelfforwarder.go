@@ -5,8 +5,13 @@
 package log
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"net"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -16,18 +21,31 @@ import (
 	"github.com/tsuru/bs/config"
 )
 
+const defaultGelfPort = "12201"
+
 type gelfBackend struct {
 	extra           json.RawMessage
-	host            string
 	fieldsWhitelist []string
-	msgCh           chan<- LogMessage
-	quitCh          chan<- bool
-	nextNotify      *time.Timer
+	allFields       bool
+	queues          []*messageQueue
+}
+
+// gelfForwarder sends messages to a single GELF destination, using chunked
+// UDP datagrams or null byte delimited messages over TCP.
+type gelfForwarder struct {
+	backend     *gelfBackend
+	url         *url.URL
+	compression gelf.CompressType
+}
+
+var gelfCompressionTypes = map[string]gelf.CompressType{
+	"none": gelf.CompressNone,
+	"gzip": gelf.CompressGzip,
+	"zlib": gelf.CompressZlib,
 }
 
 func (b *gelfBackend) initialize() error {
-	bufferSize := config.IntEnvOrDefault(config.DefaultBufferSize, "LOG_GELF_BUFFER_SIZE", "LOG_BUFFER_SIZE")
-	b.host = config.StringEnvOrDefault("localhost:12201", "LOG_GELF_HOST")
+	hosts := config.StringsEnvOrDefault([]string{"localhost:" + defaultGelfPort}, "LOG_GELF_HOST")
 	extra := config.StringEnvOrDefault("", "LOG_GELF_EXTRA_TAGS")
 	if extra != "" {
 		data := map[string]interface{}{}
@@ -45,49 +63,131 @@ func (b *gelfBackend) initialize() error {
 		"method",
 		"uri",
 	}, "LOG_GELF_FIELDS_WHITELIST")
-	b.nextNotify = time.NewTimer(0)
-	var err error
-	b.msgCh, b.quitCh, err = processMessages(b, bufferSize)
-	if err != nil {
-		return err
+	b.allFields, _ = strconv.ParseBool(os.Getenv("LOG_GELF_FIELDS_ALL"))
+	compressionName := config.StringEnvOrDefault("none", "LOG_GELF_COMPRESSION")
+	compression, ok := gelfCompressionTypes[compressionName]
+	if !ok {
+		return fmt.Errorf("invalid gelf compression %q, expected none, gzip or zlib", compressionName)
+	}
+	queueCfg := newQueueConfig("gelf")
+	for _, host := range hosts {
+		gelfURL, err := parseGelfURL(host)
+		if err != nil {
+			return err
+		}
+		if gelfURL.Scheme == "tcp" && compression != gelf.CompressNone {
+			bslog.Warnf("gelf compression is not supported over tcp, sending uncompressed messages to %s", host)
+		}
+		hostCfg := queueCfg
+		hostCfg.destination = gelfURL.String()
+		if hostCfg.spillDir != "" {
+			hostCfg.spillDir = filepath.Join(hostCfg.spillDir, gelfURL.Scheme+"_"+strings.Replace(gelfURL.Host, ":", "_", -1))
+		}
+		queue, err := processMessages(&gelfForwarder{
+			backend:     b,
+			url:         gelfURL,
+			compression: compression,
+		}, hostCfg)
+		if err != nil {
+			return err
+		}
+		b.queues = append(b.queues, queue)
 	}
 	return nil
 }
 
+// parseGelfURL parses a GELF destination, addresses without a scheme are
+// sent over UDP.
+func parseGelfURL(host string) (*url.URL, error) {
+	if !strings.Contains(host, "://") {
+		host = "udp://" + host
+	}
+	gelfURL, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse gelf host %q: %s", host, err)
+	}
+	if gelfURL.Scheme != "udp" && gelfURL.Scheme != "tcp" {
+		return nil, fmt.Errorf("invalid gelf host %q, expected udp or tcp scheme", host)
+	}
+	if _, _, err = net.SplitHostPort(gelfURL.Host); err != nil {
+		gelfURL.Host = net.JoinHostPort(gelfURL.Host, defaultGelfPort)
+	}
+	return gelfURL, nil
+}
+
 func (b *gelfBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
 	if len(container) > containerIDTrimSize {
 		container = container[:containerIDTrimSize]
 	}
-	level := gelf.LOG_INFO
-	if s, err := strconv.Atoi(string(parts.priority)); err == nil {
-		if int32(s)&gelf.LOG_ERR == gelf.LOG_ERR {
-			level = gelf.LOG_ERR
-		}
-	}
-	msg := &gelf.Message{
-		Version: "1.1",
-		Host:    container,
-		Short:   string(parts.content),
-		Level:   level,
-		Extra: map[string]interface{}{
+	fields := b.fields(parts)
+	for _, queue := range b.queues {
+		// Messages are changed by the forwarder, so every queue needs its
+		// own copy.
+		extra := map[string]interface{}{
 			"_app": appName,
 			"_pid": processName,
-		},
-		RawExtra: b.extra,
-	}
-	select {
-	case b.msgCh <- msg:
-	default:
-		select {
-		case <-b.nextNotify.C:
-			bslog.Errorf("Dropping log messages to gelf due to full channel buffer.")
-			b.nextNotify.Reset(time.Minute)
-		default:
 		}
+		for _, field := range fields {
+			name := gelfFieldName(field.key)
+			if _, ok := extra[name]; ok || name == "_id" {
+				continue
+			}
+			extra[name] = gelfFieldValue(field.value)
+		}
+		queue.send(&gelf.Message{
+			Version:  "1.1",
+			Host:     container,
+			Short:    string(parts.text()),
+			Level:    int32(severityValue(parts.severity())),
+			Extra:    extra,
+			RawExtra: b.extra,
+		})
 	}
 }
+
+// fields returns the additional fields of a message. Fields parsed from
+// structured messages are sent as is, otherwise key=value pairs in the
+// message are also used, limited to the whitelist unless all fields are
+// enabled.
+func (b *gelfBackend) fields(parts *rawLogParts) []logField {
+	if parts.structured {
+		return parts.fields
+	}
+	fields := parts.fields
+	for _, field := range parseLogfmtFields(parts.content) {
+		if b.allFields || containsString(b.fieldsWhitelist, field.key) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// gelfFieldName returns the additional field name for key, replacing
+// characters not allowed by GELF.
+func gelfFieldName(key string) string {
+	name := []byte("_" + key)
+	for i := 1; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-') {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// gelfFieldValue returns value as a GELF additional field value, which must
+// be a string or a number.
+func gelfFieldValue(value interface{}) interface{} {
+	if number, ok := value.(json.Number); ok {
+		return number
+	}
+	return fieldString(value)
+}
+
 func (b *gelfBackend) stop() {
-	close(b.quitCh)
+	for _, queue := range b.queues {
+		queue.stop()
+	}
 }
 
 type gelfConnWrapper struct {
@@ -103,70 +203,63 @@ func (w *gelfConnWrapper) Write(msg []byte) (int, error) {
 	return 0, nil
 }
 
-func (b *gelfBackend) connect() (net.Conn, error) {
-	writer, err := gelf.NewWriter(b.host)
+func (f *gelfForwarder) connect() (net.Conn, error) {
+	if f.url.Scheme == "tcp" {
+		conn, err := net.DialTimeout("tcp", f.url.Host, forwardConnDialTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("[log forwarder] unable to connect to %q: %s", f.url, err)
+		}
+		return newBufferedConn(conn, time.Second), nil
+	}
+	writer, err := gelf.NewWriter(f.url.Host)
 	if err != nil {
 		return nil, err
 	}
-	writer.CompressionType = gelf.CompressNone
+	writer.CompressionType = f.compression
 	return &gelfConnWrapper{Writer: writer}, nil
 }
 
-func (b *gelfBackend) parseFields(gelfMsg *gelf.Message) {
-	shortMsg := gelfMsg.Short
-	if !strings.Contains(shortMsg, "=") {
-		return
+func (f *gelfForwarder) process(conn net.Conn, msg LogMessage) error {
+	gelfMsg := msg.(*gelf.Message)
+	if wrapper, ok := conn.(*gelfConnWrapper); ok {
+		return wrapper.WriteMessage(gelfMsg)
 	}
-	for _, field := range b.fieldsWhitelist {
-		value := findFieldInMsg(shortMsg, field)
-		if value == "" {
-			continue
-		}
-		gelfMsg.Extra["_"+field] = value
+	var buf bytes.Buffer
+	err := gelfMsg.MarshalJSONBuf(&buf)
+	if err != nil {
+		return err
 	}
-
-	level := strings.ToUpper(findFieldInMsg(shortMsg, "level"))
-
-	switch level {
-	case "EMERG", "PANIC":
-		gelfMsg.Level = gelf.LOG_EMERG
-	case "ALERT":
-		gelfMsg.Level = gelf.LOG_ALERT
-	case "CRIT", "CRITICAL", "FATAL":
-		gelfMsg.Level = gelf.LOG_CRIT
-	case "ERR", "ERROR":
-		gelfMsg.Level = gelf.LOG_ERR
-	case "WARN", "WARNING":
-		gelfMsg.Level = gelf.LOG_WARNING
-	case "NOTICE":
-		gelfMsg.Level = gelf.LOG_NOTICE
-	case "INFO":
-		gelfMsg.Level = gelf.LOG_INFO
-	case "DEBUG":
-		gelfMsg.Level = gelf.LOG_DEBUG
+	// GELF TCP inputs use a null byte as message delimiter.
+	buf.WriteByte(0)
+	err = conn.SetWriteDeadline(time.Now().Add(forwardConnWriteTimeout))
+	if err != nil {
+		return err
 	}
+	_, err = conn.Write(buf.Bytes())
+	return err
 }
 
-func (b *gelfBackend) process(conn net.Conn, msg LogMessage) error {
-	gelfMsg := msg.(*gelf.Message)
-	b.parseFields(gelfMsg)
-	return conn.(*gelfConnWrapper).WriteMessage(gelfMsg)
+func (f *gelfForwarder) encodeMessage(msg LogMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	err := msg.(*gelf.Message).MarshalJSONBuf(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-func (b *gelfBackend) close(conn net.Conn) {
-	conn.Close()
+func (f *gelfForwarder) decodeMessage(data []byte) (LogMessage, error) {
+	var msg gelf.Message
+	err := msg.UnmarshalJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
 }
 
-func findFieldInMsg(msg, field string) string {
-	idx := strings.Index(msg, field+"=")
-	if idx == -1 {
-		return ""
+func (f *gelfForwarder) close(conn net.Conn) {
+	if _, ok := conn.(*gelfConnWrapper); !ok {
+		conn.SetWriteDeadline(time.Time{})
 	}
-	idx += len(field) + 1
-	end := strings.Index(msg[idx:], " ")
-	if end == -1 {
-		end = len(msg) - idx
-	}
-
-	return msg[idx : idx+end]
+	conn.Close()
 }
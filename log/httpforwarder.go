@@ -0,0 +1,205 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tsuru/bs/bsmetric"
+	"github.com/tsuru/bs/config"
+)
+
+const (
+	defaultHTTPBatchSize = 1000
+	httpMaxBatchBytes    = 5 * 1024 * 1024
+	httpRequestTimeout   = 30 * time.Second
+)
+
+type httpBackend struct {
+	url        string
+	headers    http.Header
+	gzip       bool
+	batchSize  int
+	batchWait  time.Duration
+	maxRetries int
+	client     *http.Client
+	dropped    *bsmetric.Counter
+	queue      *messageQueue
+}
+
+type httpLogEntry struct {
+	Date     time.Time `json:"date"`
+	App      string    `json:"app"`
+	Process  string    `json:"process"`
+	Unit     string    `json:"unit"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+	// Fields found in structured messages, sent as top level fields.
+	Fields []logField `json:"-"`
+}
+
+func (e *httpLogEntry) MarshalJSON() ([]byte, error) {
+	type entry httpLogEntry
+	data, err := json.Marshal((*entry)(e))
+	if err != nil {
+		return nil, err
+	}
+	return appendJSONFields(data, e.Fields)
+}
+
+func (e *httpLogEntry) UnmarshalJSON(data []byte) error {
+	type entry httpLogEntry
+	err := json.Unmarshal(data, (*entry)(e))
+	if err != nil {
+		return err
+	}
+	e.Fields, err = extractJSONFields(data, "date", "app", "process", "unit", "severity", "message")
+	return err
+}
+
+func (b *httpBackend) initialize() error {
+	b.url = config.StringEnvOrDefault("", "LOG_HTTP_URL")
+	if b.url == "" {
+		return errors.New("environment variable for LOG_HTTP_URL must be set")
+	}
+	destination, err := url.Parse(b.url)
+	if err != nil {
+		return fmt.Errorf("unable to parse http log url: %s", err)
+	}
+	b.headers = http.Header{}
+	headers := config.StringEnvOrDefault("", "LOG_HTTP_HEADERS")
+	if headers != "" {
+		data := map[string]string{}
+		err = json.Unmarshal([]byte(headers), &data)
+		if err != nil {
+			return fmt.Errorf("unable to parse LOG_HTTP_HEADERS: %s", err)
+		}
+		for k, v := range data {
+			b.headers.Set(k, v)
+		}
+	}
+	token := config.StringEnvOrDefault("", "LOG_HTTP_TOKEN")
+	if token != "" {
+		b.headers.Set("Authorization", "Bearer "+token)
+	}
+	b.gzip, _ = strconv.ParseBool(os.Getenv("LOG_HTTP_GZIP"))
+	b.batchSize = config.IntEnvOrDefault(defaultHTTPBatchSize, "LOG_HTTP_BATCH_SIZE")
+	b.batchWait = config.SecondsEnvOrDefault(1, "LOG_HTTP_BATCH_WAIT")
+	b.maxRetries = config.IntEnvOrDefault(3, "LOG_HTTP_MAX_RETRIES")
+	b.client = &http.Client{Timeout: httpRequestTimeout}
+	queueCfg := newQueueConfig("http")
+	destination.User = nil
+	queueCfg.destination = destination.String()
+	b.dropped = messagesDropped.WithLabelValues(queueCfg.name, queueCfg.destination)
+	b.queue, err = processMessages(b, queueCfg)
+	return err
+}
+
+func (b *httpBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
+	if len(container) > containerIDTrimSize {
+		container = container[:containerIDTrimSize]
+	}
+	b.queue.send(&httpLogEntry{
+		Date:     parts.ts,
+		App:      appName,
+		Process:  processName,
+		Unit:     container,
+		Severity: parts.severity(),
+		Message:  string(parts.text()),
+		Fields:   parts.fields,
+	})
+}
+
+func (b *httpBackend) stop() {
+	b.queue.stop()
+}
+
+func (b *httpBackend) connect() (net.Conn, error) {
+	return newBatchConn(batchConfig{
+		name:       "http",
+		maxItems:   b.batchSize,
+		maxSize:    httpMaxBatchBytes,
+		interval:   b.batchWait,
+		maxRetries: b.maxRetries,
+		dropped:    b.dropped,
+	}, b.send), nil
+}
+
+func (b *httpBackend) process(conn net.Conn, msg LogMessage) error {
+	entry := msg.(*httpLogEntry)
+	return conn.(*batchConn).add(entry, len(entry.Message))
+}
+
+// send posts entries as a JSON array, every failed request is retried.
+func (b *httpBackend) send(items []LogMessage) ([]LogMessage, error) {
+	var body bytes.Buffer
+	var writer io.Writer = &body
+	var gzipWriter *gzip.Writer
+	if b.gzip {
+		gzipWriter = gzip.NewWriter(&body)
+		writer = gzipWriter
+	}
+	err := json.NewEncoder(writer).Encode(items)
+	if err != nil {
+		return nil, err
+	}
+	if gzipWriter != nil {
+		err = gzipWriter.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest("POST", b.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range b.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	rsp, err := b.client.Do(req)
+	if err != nil {
+		return items, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, rsp.Body)
+		return nil, nil
+	}
+	data, _ := ioutil.ReadAll(rsp.Body)
+	return items, fmt.Errorf("http log request failed with status %d: %s", rsp.StatusCode, bytes.TrimSpace(data))
+}
+
+func (b *httpBackend) encodeMessage(msg LogMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (b *httpBackend) decodeMessage(data []byte) (LogMessage, error) {
+	var entry httpLogEntry
+	err := json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (b *httpBackend) close(conn net.Conn) {
+	conn.Close()
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type httpLogRequest struct {
+	header  http.Header
+	entries []httpLogEntry
+}
+
+func (s *S) TestLogForwarderHTTP(c *check.C) {
+	reqCh := make(chan httpLogRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := httpLogRequest{header: r.Header}
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gzipReader, err := gzip.NewReader(r.Body)
+			c.Check(err, check.IsNil)
+			body = gzipReader
+		}
+		err := json.NewDecoder(body).Decode(&req.entries)
+		c.Check(err, check.IsNil)
+		reqCh <- req
+	}))
+	defer srv.Close()
+	os.Setenv("LOG_HTTP_URL", srv.URL+"/logs")
+	os.Setenv("LOG_HTTP_HEADERS", `{"X-Collector": "bs"}`)
+	os.Setenv("LOG_HTTP_TOKEN", "mytoken")
+	os.Setenv("LOG_HTTP_GZIP", "true")
+	os.Setenv("LOG_HTTP_BATCH_SIZE", "2")
+	os.Setenv("LOG_HTTP_BATCH_WAIT", "60")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"http"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, msg := range []string{
+		"<30>2015-06-05T16:13:47Z myhost docker/%s: mymsg",
+		"<27>2015-06-05T16:13:48Z myhost docker/%s: myerr",
+	} {
+		_, err = conn.Write([]byte(fmt.Sprintf(msg+"\n", s.id)))
+		c.Assert(err, check.IsNil)
+	}
+	var req httpLogRequest
+	select {
+	case req = <-reqCh:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for request")
+	}
+	c.Assert(req.header.Get("Authorization"), check.Equals, "Bearer mytoken")
+	c.Assert(req.header.Get("X-Collector"), check.Equals, "bs")
+	c.Assert(req.header.Get("Content-Type"), check.Equals, "application/json")
+	c.Assert(req.entries, check.DeepEquals, []httpLogEntry{
+		{
+			Date:     time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+			App:      "coolappname",
+			Process:  "procx",
+			Unit:     s.idShort,
+			Severity: "info",
+			Message:  "mymsg",
+		},
+		{
+			Date:     time.Date(2015, 6, 5, 16, 13, 48, 0, time.UTC),
+			App:      "coolappname",
+			Process:  "procx",
+			Unit:     s.idShort,
+			Severity: "err",
+			Message:  "myerr",
+		},
+	})
+}
+
+func (s *S) TestLogForwarderHTTPRequiresURL(c *check.C) {
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"http"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "http": environment variable for LOG_HTTP_URL must be set`)
+}
+
+func (s *S) TestHTTPSendRetry(c *check.C) {
+	oldInterval := batchRetryInterval
+	batchRetryInterval = time.Millisecond
+	defer func() { batchRetryInterval = oldInterval }()
+	statuses := []int{http.StatusBadRequest, http.StatusServiceUnavailable, http.StatusAccepted}
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[requests])
+		requests++
+	}))
+	defer srv.Close()
+	dropped := messagesDropped.WithLabelValues("http", "test-retry")
+	b := &httpBackend{
+		url:        srv.URL,
+		batchSize:  1,
+		maxRetries: 3,
+		client:     http.DefaultClient,
+		dropped:    dropped,
+	}
+	conn, err := b.connect()
+	c.Assert(err, check.IsNil)
+	defer b.close(conn)
+	err = b.process(conn, &httpLogEntry{Message: "mymsg"})
+	c.Assert(err, check.IsNil)
+	c.Assert(requests, check.Equals, 3)
+	c.Assert(dropped.Value(), check.Equals, uint64(0))
+}
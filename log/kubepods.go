@@ -0,0 +1,264 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/config"
+	"github.com/tsuru/bs/container"
+)
+
+const (
+	defaultKubeAppLabel     = "tsuru.io/app-name"
+	defaultKubeProcessLabel = "tsuru.io/app-process"
+	defaultKubeTokenFile    = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubePodsRequestTimeout  = 10 * time.Second
+)
+
+var (
+	errPodNotFound = errors.New("pod not found")
+
+	// kubePodsRefreshInterval is the minimum interval between pod list
+	// requests made when a pod isn't found.
+	kubePodsRefreshInterval = 5 * time.Second
+)
+
+type kubePod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		UID         string            `json:"uid"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Status struct {
+		ContainerStatuses []struct {
+			Name         string `json:"name"`
+			ContainerID  string `json:"containerID"`
+			RestartCount int    `json:"restartCount"`
+			LastState    struct {
+				Terminated *struct {
+					ContainerID string `json:"containerID"`
+				} `json:"terminated"`
+			} `json:"lastState"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// kubePodsSource finds the app and process of containers from the labels or
+// annotations of their pods, listed by the kubelet /pods endpoint or read
+// from a file with the same content.
+type kubePodsSource struct {
+	url          string
+	tokenFile    string
+	client       *http.Client
+	appLabel     string
+	processLabel string
+	pods         []kubePod
+	lastRefresh  time.Time
+}
+
+// newKubePodsSource returns the pods source configured by the
+// LOG_KUBERNETES_* environment variables, nil if LOG_KUBERNETES_PODS_URL
+// isn't set.
+func newKubePodsSource() (*kubePodsSource, error) {
+	url := config.StringEnvOrDefault("", "LOG_KUBERNETES_PODS_URL")
+	if url == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	tlsConfig.InsecureSkipVerify, _ = strconv.ParseBool(os.Getenv("LOG_KUBERNETES_INSECURE_SKIP_VERIFY"))
+	caFile := config.StringEnvOrDefault("", "LOG_KUBERNETES_CA_FILE")
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read kubernetes ca file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in kubernetes ca file %q", caFile)
+		}
+	}
+	return &kubePodsSource{
+		url:       url,
+		tokenFile: config.StringEnvOrDefault(defaultKubeTokenFile, "LOG_KUBERNETES_TOKEN_FILE"),
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   kubePodsRequestTimeout,
+		},
+		appLabel:     config.StringEnvOrDefault(defaultKubeAppLabel, "LOG_KUBERNETES_APP_LABEL"),
+		processLabel: config.StringEnvOrDefault(defaultKubeProcessLabel, "LOG_KUBERNETES_PROCESS_LABEL"),
+	}, nil
+}
+
+// list returns the pods running in the node.
+func (s *kubePodsSource) list() ([]kubePod, error) {
+	var body io.ReadCloser
+	if strings.HasPrefix(s.url, "file://") {
+		f, err := os.Open(strings.TrimPrefix(s.url, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		body = f
+	} else {
+		req, err := http.NewRequest("GET", s.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		// The token is read on every request as it may be rotated.
+		if token, err := ioutil.ReadFile(s.tokenFile); err == nil {
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status code listing pods: %d", resp.StatusCode)
+		}
+		body = resp.Body
+	}
+	defer body.Close()
+	var podList struct {
+		Items []kubePod `json:"items"`
+	}
+	err := json.NewDecoder(body).Decode(&podList)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode pod list: %s", err)
+	}
+	return podList.Items, nil
+}
+
+// find returns the pod with uid or, if uid is empty, with namespace and name.
+// When containerID is set, a pod reporting a different id for the container
+// named containerName doesn't match, it may be an older pod with the same
+// name. The pods are listed again when it's not found, at most once every
+// kubePodsRefreshInterval.
+func (s *kubePodsSource) find(namespace, name, uid, containerName, containerID string) (*kubePod, error) {
+	if pod := s.lookup(namespace, name, uid, containerName, containerID); pod != nil {
+		return pod, nil
+	}
+	if time.Since(s.lastRefresh) < kubePodsRefreshInterval {
+		return nil, errPodNotFound
+	}
+	s.lastRefresh = time.Now()
+	pods, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	s.pods = pods
+	if pod := s.lookup(namespace, name, uid, containerName, containerID); pod != nil {
+		return pod, nil
+	}
+	return nil, errPodNotFound
+}
+
+func (s *kubePodsSource) lookup(namespace, name, uid, containerName, containerID string) *kubePod {
+	for i := range s.pods {
+		pod := &s.pods[i]
+		if uid != "" {
+			if pod.Metadata.UID != uid {
+				continue
+			}
+		} else if pod.Metadata.Namespace != namespace || pod.Metadata.Name != name {
+			continue
+		}
+		if containerID == "" || pod.hasContainer(containerName, containerID) {
+			return pod
+		}
+	}
+	return nil
+}
+
+// hasContainer reports whether id is the current or the last terminated
+// container named name in the pod status. Containers not reported yet are
+// assumed to be in the pod.
+func (p *kubePod) hasContainer(name, id string) bool {
+	for _, status := range p.Status.ContainerStatuses {
+		if status.Name != name || status.ContainerID == "" {
+			continue
+		}
+		if trimContainerID(status.ContainerID) == id {
+			return true
+		}
+		terminated := status.LastState.Terminated
+		return terminated != nil && trimContainerID(terminated.ContainerID) == id
+	}
+	return true
+}
+
+// trimContainerID removes the runtime prefix, as in containerd://<id>, from
+// container ids in the pod status.
+func trimContainerID(id string) string {
+	if i := strings.Index(id, "://"); i >= 0 {
+		return id[i+3:]
+	}
+	return id
+}
+
+// containerInfo returns the container of the log file entry with the app and
+// process from its pod labels or annotations. It returns
+// container.ErrTsuruVariablesNotFound if the pod isn't from a tsuru app. The
+// container id, when it's not in the entry, is taken from the pod status or
+// is the pod name. Files of the /var/log/pods layout get the id of the
+// container instance with their restart count, the current or the last
+// terminated one, or the pod name for older instances.
+func (s *kubePodsSource) containerInfo(entry logFileEntry) (*container.Container, error) {
+	pod, err := s.find(entry.namespace, entry.podName, entry.podUID, entry.containerName, entry.containerID)
+	if err != nil {
+		return nil, err
+	}
+	// Labels take precedence over annotations with the same key.
+	settings := make(map[string]string, len(pod.Metadata.Labels)+len(pod.Metadata.Annotations))
+	for k, v := range pod.Metadata.Annotations {
+		settings[k] = v
+	}
+	for k, v := range pod.Metadata.Labels {
+		settings[k] = v
+	}
+	appName := settings[s.appLabel]
+	if appName == "" {
+		return nil, container.ErrTsuruVariablesNotFound
+	}
+	id := entry.containerID
+	if id == "" {
+		id = pod.Metadata.Name
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != entry.containerName || status.ContainerID == "" {
+				continue
+			}
+			terminated := status.LastState.Terminated
+			switch {
+			case entry.restart == "" || entry.restart == strconv.Itoa(status.RestartCount):
+				id = trimContainerID(status.ContainerID)
+			case terminated != nil && entry.restart == strconv.Itoa(status.RestartCount-1):
+				id = trimContainerID(terminated.ContainerID)
+			}
+		}
+	}
+	return &container.Container{
+		Container: docker.Container{
+			ID:     id,
+			Name:   entry.containerName,
+			Config: &docker.Config{Labels: settings},
+		},
+		AppName:     appName,
+		ProcessName: settings[s.processLabel],
+	}, nil
+}
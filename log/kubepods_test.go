@@ -0,0 +1,234 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tsuru/bs/container"
+	"gopkg.in/check.v1"
+)
+
+const podList = `{"kind":"PodList","items":[
+	{
+		"metadata":{
+			"name":"myapp-web-2453793373-cbk0k",
+			"namespace":"default",
+			"uid":"6f2d9a80-0e2b-11e7-9e4a-0800270a1b2c",
+			"labels":{"tsuru.io/app-name":"myapp","tsuru.io/app-process":"web"},
+			"annotations":{"tsuru.io/app-name":"other","tsuru.io/router":"myrouter"}
+		},
+		"status":{"containerStatuses":[
+			{"name":"myapp-web","containerID":"containerd://4f8d1c2b3a"}
+		]}
+	},
+	{
+		"metadata":{
+			"name":"myapp-worker-1",
+			"namespace":"default",
+			"uid":"7a1b2c3d",
+			"annotations":{"tsuru.io/app-name":"myapp","tsuru.io/app-process":"worker"}
+		}
+	},
+	{
+		"metadata":{
+			"name":"coredns-1",
+			"namespace":"default",
+			"uid":"8b2c3d4e",
+			"labels":{"k8s-app":"kube-dns"}
+		}
+	}
+]}`
+
+func writePodList(c *check.C) (string, func()) {
+	dir, err := ioutil.TempDir("", "bs-kube-pods")
+	c.Assert(err, check.IsNil)
+	path := filepath.Join(dir, "pods.json")
+	err = ioutil.WriteFile(path, []byte(podList), 0600)
+	c.Assert(err, check.IsNil)
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func (s *S) TestNewKubePodsSource(c *check.C) {
+	source, err := newKubePodsSource()
+	c.Assert(err, check.IsNil)
+	c.Assert(source, check.IsNil)
+	os.Setenv("LOG_KUBERNETES_PODS_URL", "https://127.0.0.1:10250/pods")
+	os.Setenv("LOG_KUBERNETES_APP_LABEL", "app")
+	source, err = newKubePodsSource()
+	c.Assert(err, check.IsNil)
+	c.Assert(source.url, check.Equals, "https://127.0.0.1:10250/pods")
+	c.Assert(source.tokenFile, check.Equals, defaultKubeTokenFile)
+	c.Assert(source.appLabel, check.Equals, "app")
+	c.Assert(source.processLabel, check.Equals, defaultKubeProcessLabel)
+	os.Setenv("LOG_KUBERNETES_CA_FILE", "/some/invalid/ca.pem")
+	_, err = newKubePodsSource()
+	c.Assert(err, check.ErrorMatches, "unable to read kubernetes ca file: .*")
+}
+
+func (s *S) TestKubePodsSourceListHTTP(c *check.C) {
+	tokenFile, err := ioutil.TempFile("", "bs-kube-token")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(tokenFile.Name())
+	_, err = tokenFile.WriteString("mytoken\n")
+	c.Assert(err, check.IsNil)
+	tokenFile.Close()
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if r.URL.Path != "/pods" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(podList))
+	}))
+	defer srv.Close()
+	os.Setenv("LOG_KUBERNETES_PODS_URL", srv.URL+"/pods")
+	os.Setenv("LOG_KUBERNETES_TOKEN_FILE", tokenFile.Name())
+	source, err := newKubePodsSource()
+	c.Assert(err, check.IsNil)
+	pods, err := source.list()
+	c.Assert(err, check.IsNil)
+	c.Assert(auth, check.Equals, "Bearer mytoken")
+	c.Assert(pods, check.HasLen, 3)
+	c.Assert(pods[0].Metadata.Name, check.Equals, "myapp-web-2453793373-cbk0k")
+	c.Assert(pods[0].Status.ContainerStatuses[0].ContainerID, check.Equals, "containerd://4f8d1c2b3a")
+	source.url = srv.URL + "/invalid"
+	_, err = source.list()
+	c.Assert(err, check.ErrorMatches, "unexpected status code listing pods: 404")
+}
+
+func (s *S) TestKubePodsSourceContainerInfo(c *check.C) {
+	path, cleanup := writePodList(c)
+	defer cleanup()
+	os.Setenv("LOG_KUBERNETES_PODS_URL", "file://"+path)
+	source, err := newKubePodsSource()
+	c.Assert(err, check.IsNil)
+	info, err := source.containerInfo(logFileEntry{
+		namespace:     "default",
+		podName:       "myapp-web-2453793373-cbk0k",
+		podUID:        "6f2d9a80-0e2b-11e7-9e4a-0800270a1b2c",
+		containerName: "myapp-web",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(info.ID, check.Equals, "4f8d1c2b3a")
+	c.Assert(info.AppName, check.Equals, "myapp")
+	c.Assert(info.ProcessName, check.Equals, "web")
+	c.Assert(info.Setting("", "tsuru.io/router"), check.Equals, "myrouter")
+	info, err = source.containerInfo(logFileEntry{
+		namespace:     "default",
+		podName:       "myapp-worker-1",
+		containerName: "myapp-worker",
+		containerID:   "abcdef",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(info.ID, check.Equals, "abcdef")
+	c.Assert(info.AppName, check.Equals, "myapp")
+	c.Assert(info.ProcessName, check.Equals, "worker")
+	_, err = source.containerInfo(logFileEntry{namespace: "default", podName: "coredns-1", podUID: "8b2c3d4e"})
+	c.Assert(err, check.Equals, container.ErrTsuruVariablesNotFound)
+}
+
+func (s *S) TestKubePodsSourceContainerInfoRestarts(c *check.C) {
+	path, cleanup := writePodList(c)
+	defer cleanup()
+	err := ioutil.WriteFile(path, []byte(`{"items":[{
+		"metadata":{
+			"name":"myapp-web-1",
+			"namespace":"default",
+			"uid":"myuid",
+			"labels":{"tsuru.io/app-name":"myapp"}
+		},
+		"status":{"containerStatuses":[
+			{"name":"myapp-web","containerID":"containerd://9a8b7c","restartCount":2,"lastState":{"terminated":{"containerID":"containerd://5e6f"}}}
+		]}
+	}]}`), 0600)
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_KUBERNETES_PODS_URL", "file://"+path)
+	source, err := newKubePodsSource()
+	c.Assert(err, check.IsNil)
+	tests := []struct {
+		restart  string
+		expected string
+	}{
+		{"", "9a8b7c"},
+		{"2", "9a8b7c"},
+		{"1", "5e6f"},
+		{"0", "myapp-web-1"},
+	}
+	for _, tt := range tests {
+		info, err := source.containerInfo(logFileEntry{podUID: "myuid", containerName: "myapp-web", restart: tt.restart})
+		c.Assert(err, check.IsNil)
+		c.Check(info.ID, check.Equals, tt.expected, check.Commentf("restart %q", tt.restart))
+	}
+}
+
+func (s *S) TestKubePodsSourceRefresh(c *check.C) {
+	path, cleanup := writePodList(c)
+	defer cleanup()
+	os.Setenv("LOG_KUBERNETES_PODS_URL", "file://"+path)
+	source, err := newKubePodsSource()
+	c.Assert(err, check.IsNil)
+	_, err = source.find("default", "", "newuid", "", "")
+	c.Assert(err, check.Equals, errPodNotFound)
+	c.Assert(source.pods, check.HasLen, 3)
+	err = ioutil.WriteFile(path, []byte(`{"items":[{"metadata":{"uid":"newuid"}}]}`), 0600)
+	c.Assert(err, check.IsNil)
+	_, err = source.find("default", "", "newuid", "", "")
+	c.Assert(err, check.Equals, errPodNotFound)
+	source.lastRefresh = time.Now().Add(-kubePodsRefreshInterval)
+	pod, err := source.find("default", "", "newuid", "", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(pod.Metadata.UID, check.Equals, "newuid")
+}
+
+func (s *S) TestKubePodsSourceRecreatedPod(c *check.C) {
+	path, cleanup := writePodList(c)
+	defer cleanup()
+	os.Setenv("LOG_KUBERNETES_PODS_URL", "file://"+path)
+	source, err := newKubePodsSource()
+	c.Assert(err, check.IsNil)
+	entry := logFileEntry{
+		namespace:     "default",
+		podName:       "myapp-web-2453793373-cbk0k",
+		containerName: "myapp-web",
+		containerID:   "4f8d1c2b3a",
+	}
+	info, err := source.containerInfo(entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.ProcessName, check.Equals, "web")
+	err = ioutil.WriteFile(path, []byte(`{"items":[{
+		"metadata":{
+			"name":"myapp-web-2453793373-cbk0k",
+			"namespace":"default",
+			"uid":"newuid",
+			"labels":{"tsuru.io/app-name":"myapp","tsuru.io/app-process":"web2"}
+		},
+		"status":{"containerStatuses":[
+			{"name":"myapp-web","containerID":"containerd://9a8b7c","lastState":{"terminated":{"containerID":"containerd://5e6f"}}}
+		]}
+	}]}`), 0600)
+	c.Assert(err, check.IsNil)
+	entry.containerID = "9a8b7c"
+	_, err = source.containerInfo(entry)
+	c.Assert(err, check.Equals, errPodNotFound)
+	source.lastRefresh = time.Now().Add(-kubePodsRefreshInterval)
+	info, err = source.containerInfo(entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.ID, check.Equals, "9a8b7c")
+	c.Assert(info.ProcessName, check.Equals, "web2")
+	entry.containerID = "5e6f"
+	info, err = source.containerInfo(entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.ID, check.Equals, "5e6f")
+	entry.containerID = "4f8d1c2b3a"
+	_, err = source.containerInfo(entry)
+	c.Assert(err, check.Equals, errPodNotFound)
+}
@@ -0,0 +1,225 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/config"
+)
+
+const defaultSocketMode = 0666
+
+// listen binds the syslog server to each comma separated address in
+// bindAddress. Unix stream sockets, which aren't supported by the syslog
+// server, are served by l.streamListeners.
+func (l *LogForwarder) listen(bindAddress string) error {
+	for _, addr := range strings.Split(bindAddress, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		listenURL, err := url.Parse(addr)
+		if err != nil {
+			return err
+		}
+		switch listenURL.Scheme {
+		case "tcp":
+			err = l.server.ListenTCP(listenURL.Host)
+		case "udp":
+			err = l.server.ListenUDP(listenURL.Host)
+		case "tls":
+			var tlsConfig *tls.Config
+			tlsConfig, err = listenTLSConfig()
+			if err == nil {
+				err = l.server.ListenTCPTLS(listenURL.Host, tlsConfig)
+			}
+		case "unix":
+			path := listenURL.Host + listenURL.Path
+			var listener net.Listener
+			err = listenUnixSocket(path, func() (listenErr error) {
+				listener, listenErr = net.Listen("unix", path)
+				return listenErr
+			})
+			if err == nil {
+				l.streamListeners = append(l.streamListeners, newStreamListener(listener, l.scanSyslog))
+			}
+		case "unixgram":
+			path := listenURL.Host + listenURL.Path
+			err = listenUnixSocket(path, func() error {
+				return l.server.ListenUnixgram(path)
+			})
+			if err == nil {
+				l.socketFiles = append(l.socketFiles, path)
+			}
+		default:
+			err = fmt.Errorf("invalid protocol %q, expected tcp, udp, tls, unix or unixgram", listenURL.Scheme)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listenUnixSocket removes a stale socket file at path, calls listen and sets
+// the socket permissions from SYSLOG_LISTEN_SOCKET_MODE, so containers
+// running as any user can write to it.
+func listenUnixSocket(path string, listen func() error) error {
+	if path == "" {
+		return errors.New("missing unix socket path")
+	}
+	mode, err := strconv.ParseUint(config.StringEnvOrDefault(strconv.FormatUint(defaultSocketMode, 8), "SYSLOG_LISTEN_SOCKET_MODE"), 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid SYSLOG_LISTEN_SOCKET_MODE: %s", err)
+	}
+	if info, statErr := os.Stat(path); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	err = listen()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(path, os.FileMode(mode))
+	if err != nil {
+		bslog.Warnf("unable to set permissions of unix socket %q: %s", path, err)
+	}
+	return nil
+}
+
+// listenTLSConfig loads the certificate used by tls:// listen addresses and,
+// to require and verify client certificates, the CA used to verify them.
+func listenTLSConfig() (*tls.Config, error) {
+	certFile := config.StringEnvOrDefault("", "SYSLOG_LISTEN_TLS_CERT_FILE")
+	keyFile := config.StringEnvOrDefault("", "SYSLOG_LISTEN_TLS_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both SYSLOG_LISTEN_TLS_CERT_FILE and SYSLOG_LISTEN_TLS_KEY_FILE must be set to listen on tls")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load syslog listen tls certificate: %s", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	caFile := config.StringEnvOrDefault("", "SYSLOG_LISTEN_TLS_CLIENT_CA_FILE")
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read syslog listen tls client ca file: %s", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in syslog listen tls client ca file %q", caFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// tlsPeerName returns the common name of the client certificate, if any. The
+// default syslog server function rejects clients without certificates.
+func tlsPeerName(conn *tls.Conn) (string, bool) {
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return "", true
+	}
+	return state.PeerCertificates[0].Subject.CommonName, true
+}
+
+// streamListener calls serve for each connection accepted by listener,
+// closing them when stopped.
+type streamListener struct {
+	listener net.Listener
+	serve    func(conn net.Conn)
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+func newStreamListener(listener net.Listener, serve func(conn net.Conn)) *streamListener {
+	return &streamListener{
+		listener: listener,
+		serve:    serve,
+		conns:    map[net.Conn]struct{}{},
+	}
+}
+
+func (s *streamListener) start() {
+	stopWg.Add(1)
+	go func() {
+		defer stopWg.Done()
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				s.mu.Lock()
+				closed := s.closed
+				s.mu.Unlock()
+				if closed {
+					return
+				}
+				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+					continue
+				}
+				bslog.Errorf("[log forwarder] unable to accept connection on %s: %s", s.listener.Addr(), err)
+				return
+			}
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				conn.Close()
+				return
+			}
+			s.conns[conn] = struct{}{}
+			s.mu.Unlock()
+			stopWg.Add(1)
+			go func() {
+				defer stopWg.Done()
+				defer func() {
+					s.mu.Lock()
+					delete(s.conns, conn)
+					s.mu.Unlock()
+					conn.Close()
+				}()
+				s.serve(conn)
+			}()
+		}
+	}()
+}
+
+// scanSyslog reads messages from conn, framed and parsed as in the syslog
+// server.
+func (l *LogForwarder) scanSyslog(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	if split := l.formatter.GetSplitFunc(); split != nil {
+		scanner.Split(split)
+	}
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		parser := l.formatter.GetParser(line)
+		err := parser.Parse()
+		l.Handle(parser.Dump(), int64(len(line)), err)
+	}
+}
+
+func (s *streamListener) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
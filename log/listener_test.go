@@ -0,0 +1,178 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestLogForwarderMultipleListeners(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-listener")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	udpConn := listenUDP(c)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	streamPath := filepath.Join(dir, "stream.sock")
+	dgramPath := filepath.Join(dir, "dgram.sock")
+	// Stale socket files are replaced.
+	stale, err := net.ListenPacket("unixgram", streamPath)
+	c.Assert(err, check.IsNil)
+	stale.Close()
+	lf := LogForwarder{
+		BindAddress:     fmt.Sprintf("udp://127.0.0.1:59317, unix://%s,unixgram://%s", streamPath, dgramPath),
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	for _, path := range []string{streamPath, dgramPath} {
+		info, statErr := os.Stat(path)
+		c.Assert(statErr, check.IsNil)
+		c.Assert(info.Mode()&os.ModePerm, check.Equals, os.FileMode(0666))
+	}
+	for _, addr := range [][2]string{{"udp", "127.0.0.1:59317"}, {"unix", streamPath}, {"unixgram", dgramPath}} {
+		conn, dialErr := net.Dial(addr[0], addr[1])
+		c.Assert(dialErr, check.IsNil)
+		_, err = conn.Write([]byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: from %s\n", s.id, addr[0])))
+		c.Assert(err, check.IsNil)
+		conn.Close()
+	}
+	c.Assert(readUDPMessages(c, udpConn), check.DeepEquals, []string{
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: from udp\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: from unix\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: from unixgram\n", s.idShort),
+	})
+	lf.stopWait()
+	for _, path := range []string{streamPath, dgramPath} {
+		_, err = os.Stat(path)
+		c.Assert(os.IsNotExist(err), check.Equals, true)
+	}
+}
+
+func (s *S) TestLogForwarderTLSListener(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-listener")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(c, dir)
+	udpConn := listenUDP(c)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	os.Setenv("SYSLOG_LISTEN_TLS_CERT_FILE", certFile)
+	os.Setenv("SYSLOG_LISTEN_TLS_KEY_FILE", keyFile)
+	os.Setenv("SYSLOG_LISTEN_TLS_CLIENT_CA_FILE", certFile)
+	lf := LogForwarder{
+		BindAddress:     "tls://127.0.0.1:59318",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	data, err := ioutil.ReadFile(certFile)
+	c.Assert(err, check.IsNil)
+	roots := x509.NewCertPool()
+	c.Assert(roots.AppendCertsFromPEM(data), check.Equals, true)
+	noCertConn, err := tls.Dial("tcp", "127.0.0.1:59318", &tls.Config{RootCAs: roots})
+	if err == nil {
+		// The handshake error may only be seen when reading.
+		noCertConn.Write([]byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: without cert\n", s.id)))
+		noCertConn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = noCertConn.Read(make([]byte, 1))
+		noCertConn.Close()
+	}
+	c.Assert(err, check.NotNil)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	c.Assert(err, check.IsNil)
+	conn, err := tls.Dial("tcp", "127.0.0.1:59318", &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: with cert\n", s.id)))
+	c.Assert(err, check.IsNil)
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: with cert\n", s.idShort))
+}
+
+func (s *S) TestLogForwarderTLSListenerWithoutClientCA(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-listener")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(c, dir)
+	udpConn := listenUDP(c)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	os.Setenv("SYSLOG_LISTEN_TLS_CERT_FILE", certFile)
+	os.Setenv("SYSLOG_LISTEN_TLS_KEY_FILE", keyFile)
+	lf := LogForwarder{
+		BindAddress:     "tls://127.0.0.1:59318",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := tls.Dial("tcp", "127.0.0.1:59318", &tls.Config{InsecureSkipVerify: true})
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: no client cert\n", s.id)))
+	c.Assert(err, check.IsNil)
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: no client cert\n", s.idShort))
+}
+
+func (s *S) TestLogForwarderListenInvalidConfig(c *check.C) {
+	tests := []struct {
+		bindAddress string
+		envs        map[string]string
+		expectedErr string
+	}{
+		{
+			bindAddress: "tls://127.0.0.1:59318",
+			expectedErr: "both SYSLOG_LISTEN_TLS_CERT_FILE and SYSLOG_LISTEN_TLS_KEY_FILE must be set to listen on tls",
+		},
+		{
+			bindAddress: "unix://",
+			expectedErr: "missing unix socket path",
+		},
+		{
+			bindAddress: "unix:///tmp/bs-invalid-mode.sock",
+			envs:        map[string]string{"SYSLOG_LISTEN_SOCKET_MODE": "999"},
+			expectedErr: "invalid SYSLOG_LISTEN_SOCKET_MODE: .*",
+		},
+		{
+			bindAddress: "udp://127.0.0.1:59317,ftp://127.0.0.1:59318",
+			expectedErr: `invalid protocol "ftp", expected tcp, udp, tls, unix or unixgram`,
+		},
+	}
+	for _, tt := range tests {
+		for k, v := range tt.envs {
+			os.Setenv(k, v)
+		}
+		lf := LogForwarder{
+			BindAddress:    tt.bindAddress,
+			DockerEndpoint: s.dockerServer.URL(),
+		}
+		err := lf.Start()
+		c.Check(err, check.ErrorMatches, tt.expectedErr)
+		for k := range tt.envs {
+			os.Unsetenv(k)
+		}
+	}
+}
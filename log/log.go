@@ -7,11 +7,13 @@ package log
 import (
 	"fmt"
 	"net"
-	"net/url"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/bsmetric"
 	"github.com/tsuru/bs/config"
 	"github.com/tsuru/bs/container"
 	"gopkg.in/mcuadros/go-syslog.v2"
@@ -23,14 +25,20 @@ const (
 	forwardConnWriteTimeout = time.Second
 	noneBackend             = "none"
 	containerIDTrimSize     = 12
+
+	defaultPluginReadLogsLines = 1000
 )
 
 var (
 	stopWg      sync.WaitGroup
 	logBackends = map[string]func() logBackend{
-		"syslog": func() logBackend { return &syslogBackend{} },
-		"tsuru":  func() logBackend { return &tsuruBackend{} },
-		"gelf":   func() logBackend { return &gelfBackend{} },
+		"syslog":        func() logBackend { return &syslogBackend{} },
+		"tsuru":         func() logBackend { return &tsuruBackend{} },
+		"gelf":          func() logBackend { return &gelfBackend{} },
+		"loki":          func() logBackend { return &lokiBackend{} },
+		"http":          func() logBackend { return &httpBackend{} },
+		"elasticsearch": func() logBackend { return &elasticsearchBackend{} },
+		"fluentd":       func() logBackend { return &fluentdBackend{} },
 	}
 )
 
@@ -45,6 +53,14 @@ type LogForwarder struct {
 	backends        []logBackend
 	formatter       *LenientFormat
 	kubeStreamer    *kubernetesLogStreamer
+	multiline       *multilineAssembler
+	limiter         *rateLimiter
+	redactor        *redactor
+	parser          *structuredParser
+	streamListeners []*streamListener
+	socketFiles     []string
+	plugin          *dockerLogPlugin
+	fluentdMaxChunk int
 }
 
 type forwarderBackend interface {
@@ -59,21 +75,167 @@ type logBackend interface {
 	stop()
 }
 
-func processMessages(forwarder forwarderBackend, bufferSize int) (chan<- LogMessage, chan<- bool, error) {
-	ch := make(chan LogMessage, bufferSize)
-	quit := make(chan bool)
+type queueConfig struct {
+	name             string
+	destination      string
+	bufferSize       int
+	spillDir         string
+	spillMaxSize     int
+	spillSegmentSize int
+	// lazyConnect makes the first connection in the queue goroutine, so
+	// starting the queue never blocks on an unreachable destination.
+	lazyConnect bool
+}
+
+// newQueueConfig loads the queue settings for the backend named name from
+// the LOG_<NAME>_* environment variables.
+func newQueueConfig(name string) queueConfig {
+	prefix := "LOG_" + strings.ToUpper(name)
+	cfg := queueConfig{
+		name:       name,
+		bufferSize: config.IntEnvOrDefault(config.DefaultBufferSize, prefix+"_BUFFER_SIZE", "LOG_BUFFER_SIZE"),
+		spillDir:   config.StringEnvOrDefault("", prefix+"_SPILL_DIR"),
+	}
+	if cfg.spillDir != "" {
+		cfg.spillMaxSize = config.IntEnvOrDefault(defaultSpillMaxSize, prefix+"_SPILL_MAX_SIZE")
+		cfg.spillSegmentSize = config.IntEnvOrDefault(defaultSpillSegmentSize, prefix+"_SPILL_SEGMENT_SIZE")
+	}
+	return cfg
+}
+
+type messageQueue struct {
+	name       string
+	labels     []string
+	ch         chan LogMessage
+	quit       chan bool
+	done       chan struct{}
+	spill      *diskQueue
+	codec      spillCodec
+	nextNotify *time.Timer
+	dropped    *bsmetric.Counter
+	spilled    *bsmetric.Counter
+}
+
+func (q *messageQueue) send(msg LogMessage) {
+	if q.spill != nil && q.spill.pending() > 0 {
+		// Messages already on disk must reach the forwarder first.
+		q.spillMessage(msg)
+		return
+	}
+	select {
+	case q.ch <- msg:
+		return
+	default:
+	}
+	if q.spill != nil {
+		q.spillMessage(msg)
+		return
+	}
+	q.notifyDrop("full channel buffer")
+}
+
+func (q *messageQueue) notifyDrop(reason string) {
+	q.dropped.Inc()
+	select {
+	case <-q.nextNotify.C:
+		bslog.Errorf("Dropping log messages to %s due to %s.", q.name, reason)
+		q.nextNotify.Reset(time.Minute)
+	default:
+	}
+}
+
+func (q *messageQueue) stop() {
+	close(q.quit)
+	queueLength.Delete(q.labels...)
+	queueCapacity.Delete(q.labels...)
+	spillPending.Delete(q.labels...)
+	if q.spill == nil {
+		return
+	}
+	stopWg.Add(1)
+	go func() {
+		defer stopWg.Done()
+		<-q.done
+		q.flushSpill()
+	}()
+}
+
+// drained reports whether every message sent to the queue was handed to the
+// forwarder.
+func (q *messageQueue) drained() bool {
+	return len(q.ch) == 0 && (q.spill == nil || q.spill.pending() == 0)
+}
+
+// stopPending stops the queue, messages still in it are kept in the spill
+// queue, when it's enabled, or counted as dropped.
+func (q *messageQueue) stopPending() {
+	q.stop()
+	if q.spill != nil {
+		return
+	}
+	stopWg.Add(1)
+	go func() {
+		defer stopWg.Done()
+		<-q.done
+		for {
+			select {
+			case msg := <-q.ch:
+				if msg != nil {
+					q.notifyDrop("stopped queue")
+				}
+			default:
+				return
+			}
+		}
+	}()
+}
+
+func processMessages(forwarder forwarderBackend, cfg queueConfig) (*messageQueue, error) {
+	labels := []string{cfg.name, cfg.destination}
+	q := &messageQueue{
+		name:       cfg.name,
+		labels:     labels,
+		ch:         make(chan LogMessage, cfg.bufferSize),
+		quit:       make(chan bool),
+		done:       make(chan struct{}),
+		nextNotify: time.NewTimer(0),
+		dropped:    messagesDropped.WithLabelValues(labels...),
+		spilled:    messagesSpilled.WithLabelValues(labels...),
+	}
+	ch, quit := q.ch, q.quit
+	reconnects := forwarderReconnects.WithLabelValues(labels...)
+	connErrors := forwarderErrors.WithLabelValues(labels...)
 	if initializable, ok := forwarder.(interface {
 		initialize(<-chan bool)
 	}); ok {
 		initializable.initialize(quit)
 	}
-	conn, err := forwarder.connect()
-	if err != nil {
-		return nil, nil, err
+	var conn net.Conn
+	var err error
+	if !cfg.lazyConnect {
+		conn, err = forwarder.connect()
+		if err != nil {
+			connErrors.Inc()
+			return nil, err
+		}
 	}
+	if cfg.spillDir != "" {
+		err = q.startSpill(forwarder, cfg)
+		if err != nil {
+			if conn != nil {
+				forwarder.close(conn)
+			}
+			return nil, err
+		}
+		spillPending.SetFunc(func() float64 { return float64(q.spill.pending()) }, labels...)
+	}
+	queueLength.SetFunc(func() float64 { return float64(len(q.ch)) }, labels...)
+	queueCapacity.WithLabelValues(labels...).Set(float64(cap(q.ch)))
 	stopWg.Add(1)
 	go func() {
 		defer stopWg.Done()
+		defer close(q.done)
+		connected := conn != nil
 		var err error
 		for {
 			select {
@@ -84,10 +246,15 @@ func processMessages(forwarder forwarderBackend, bufferSize int) (chan<- LogMess
 			if conn == nil {
 				conn, err = forwarder.connect()
 				if err != nil {
+					connErrors.Inc()
 					conn = nil
 					time.Sleep(100 * time.Millisecond)
 					continue
 				}
+				if connected {
+					reconnects.Inc()
+				}
+				connected = true
 			}
 		loop:
 			for {
@@ -111,12 +278,13 @@ func processMessages(forwarder forwarderBackend, bufferSize int) (chan<- LogMess
 			case errConnMaxAgeExceeded:
 				bslog.Warnf("[log forwarder] connection max age exceeded, forcing reconnection")
 			default:
+				connErrors.Inc()
 				bslog.Errorf("[log forwarder] error writing to %#v: %s", forwarder, err)
 			}
 			conn = nil
 		}
 	}()
-	return ch, quit, nil
+	return q, nil
 }
 
 func (l *LogForwarder) Start() (err error) {
@@ -148,33 +316,70 @@ func (l *LogForwarder) Start() (err error) {
 		err = fmt.Errorf("unable to initialize docker client %s: %s", l.DockerEndpoint, err)
 		return
 	}
+	l.multiline, err = newMultilineAssembler(l.sendMessage)
+	if err != nil {
+		return
+	}
+	l.limiter, err = newRateLimiter(l.dispatch)
+	if err != nil {
+		return
+	}
+	l.redactor, err = newRedactor()
+	if err != nil {
+		return
+	}
+	l.parser, err = newStructuredParser()
+	if err != nil {
+		return
+	}
 	l.formatter = &LenientFormat{}
 	l.server = syslog.NewServer()
 	l.server.SetHandler(l)
 	l.server.SetFormat(l.formatter)
-	url, err := url.Parse(l.BindAddress)
+	l.server.SetTlsPeerNameFunc(tlsPeerName)
+	err = l.listen(l.BindAddress)
 	if err != nil {
 		return
 	}
-	if url.Scheme == "tcp" {
-		err = l.server.ListenTCP(url.Host)
-	} else if url.Scheme == "udp" {
-		err = l.server.ListenUDP(url.Host)
-	} else {
-		err = fmt.Errorf("invalid protocol %q, expected tcp or udp", url.Scheme)
-	}
-	if err != nil {
-		return
+	fluentdAddress := config.StringEnvOrDefault("", "FLUENTD_LISTEN_ADDRESS")
+	if fluentdAddress != "" {
+		l.fluentdMaxChunk = config.IntEnvOrDefault(defaultFluentdMaxChunkSize, "FLUENTD_MAX_CHUNK_SIZE")
+		err = l.listenFluentd(fluentdAddress)
+		if err != nil {
+			return fmt.Errorf("unable to listen for fluentd forward messages: %s", err)
+		}
 	}
 	kubeLogDir := config.StringEnvOrDefault("/var/log/containers", "LOG_KUBERNETES_LOG_DIR")
 	kubeLogPosDir := config.StringEnvOrDefault("/var/log/bs", "LOG_KUBERNETES_LOG_POS_DIR")
 	l.kubeStreamer, err = newKubeLogStreamer(l, l.infoClient, kubeLogDir, kubeLogPosDir)
 	if err == nil {
+		l.kubeStreamer.pods, err = newKubePodsSource()
+		if err != nil {
+			return fmt.Errorf("unable to configure kubernetes pods source: %s", err)
+		}
+		if l.kubeStreamer.pods == nil && l.kubeStreamer.hasPodDirs() {
+			bslog.Warnf("log files in pod directories in %q are ignored, LOG_KUBERNETES_PODS_URL must be set to read them", kubeLogDir)
+		}
 		go l.kubeStreamer.watch()
 	} else if err != errNoLogDirectory {
 		return err
 	}
-	return l.server.Boot()
+	err = l.server.Boot()
+	if err != nil {
+		return
+	}
+	for _, listener := range l.streamListeners {
+		listener.start()
+	}
+	pluginSocket := config.StringEnvOrDefault("", "LOG_PLUGIN_SOCKET")
+	if pluginSocket != "" {
+		readLogsLines := config.IntEnvOrDefault(defaultPluginReadLogsLines, "LOG_PLUGIN_READ_LOGS_LINES")
+		l.plugin, err = newDockerLogPlugin(l, pluginSocket, readLogsLines)
+		if err != nil {
+			return fmt.Errorf("unable to start log driver plugin: %s", err)
+		}
+	}
+	return nil
 }
 
 func (l *LogForwarder) Wait() {
@@ -188,6 +393,21 @@ func (l *LogForwarder) Stop() {
 	if l.server != nil {
 		l.server.Kill()
 	}
+	for _, listener := range l.streamListeners {
+		listener.stop()
+	}
+	if l.plugin != nil {
+		l.plugin.stop()
+	}
+	for _, path := range l.socketFiles {
+		os.Remove(path)
+	}
+	if l.limiter != nil {
+		l.limiter.stop()
+	}
+	if l.multiline != nil {
+		l.multiline.stop()
+	}
 	for _, backend := range l.backends {
 		backend.stop()
 	}
@@ -202,6 +422,7 @@ func (l *LogForwarder) stopWait() {
 }
 
 func (l *LogForwarder) Handle(logParts format.LogParts, _ int64, err error) {
+	messagesReceived.Inc()
 	parts := logParts["parts"].(*rawLogParts)
 	if err != nil {
 		bslog.Debugf("[log forwarder] ignored msg %v error processing: %s", parts, err)
@@ -217,12 +438,45 @@ func (l *LogForwarder) Handle(logParts format.LogParts, _ int64, err error) {
 		return
 	}
 	contStr := string(parts.container)
-	contData, err := l.infoClient.GetAppContainer(contStr, true)
-	if err != nil {
-		bslog.Debugf("[log forwarder] ignored msg %v error to get appname: %s", parts, err)
+	contData := parts.containerInfo
+	if contData == nil {
+		contData, err = l.infoClient.GetAppContainer(contStr, true)
+		if err != nil {
+			bslog.Debugf("[log forwarder] ignored msg %v error to get appname: %s", parts, err)
+			return
+		}
+	}
+	if l.limiter != nil && !l.limiter.allow(parts, contData) {
+		return
+	}
+	// The content, message and severity are changed on a copy, the parts
+	// passed in may be handled again by the caller.
+	partsCopy := *parts
+	parts = &partsCopy
+	parts.containerInfo = contData
+	if l.redactor != nil {
+		parts.content = l.redactor.redact(parts.content, contData.AppName)
+		parts.fields = l.redactor.redactFields(parts.fields, contData.AppName)
+	}
+	if l.parser != nil {
+		l.parser.parse(parts)
+	}
+	resolveSeverity(parts)
+	l.dispatch(parts, contData.AppName, contData.ProcessName, contStr)
+}
+
+// dispatch sends parts to the backends, joining multiline messages first if
+// enabled.
+func (l *LogForwarder) dispatch(parts *rawLogParts, appName, processName, container string) {
+	if l.multiline != nil {
+		l.multiline.add(parts, appName, processName, container)
 		return
 	}
+	l.sendMessage(parts, appName, processName, container)
+}
+
+func (l *LogForwarder) sendMessage(parts *rawLogParts, appName, processName, container string) {
 	for _, backend := range l.backends {
-		backend.sendMessage(parts, contData.AppName, contData.ProcessName, contStr)
+		backend.sendMessage(parts, appName, processName, container)
 	}
 }
@@ -30,6 +30,7 @@ import (
 	"github.com/fsouza/go-dockerclient"
 	dTesting "github.com/fsouza/go-dockerclient/testing"
 	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/container"
 	"github.com/tsuru/tsuru/app"
 	"golang.org/x/net/websocket"
 	"gopkg.in/check.v1"
@@ -86,7 +87,7 @@ func (s *S) SetUpTest(c *check.C) {
 	s.idShort = s.id[:12]
 	c.Assert(err, check.IsNil)
 	for _, env := range os.Environ() {
-		if strings.HasPrefix(env, "LOG_") || strings.HasPrefix(env, "TSURU_") {
+		if strings.HasPrefix(env, "LOG_") || strings.HasPrefix(env, "TSURU_") || strings.HasPrefix(env, "SYSLOG_") || strings.HasPrefix(env, "FLUENTD_") {
 			os.Unsetenv(strings.SplitN(env, "=", 2)[0])
 		}
 	}
@@ -123,6 +124,73 @@ func (s *S) TestLogForwarderStart(c *check.C) {
 	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: mymsg\n", s.idShort))
 }
 
+func (s *S) TestLogForwarderHandleKeepsParts(c *check.C) {
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn, err := net.ListenUDP("udp", addr)
+	c.Assert(err, check.IsNil)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	parts := &rawLogParts{
+		ts:        time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+		priority:  []byte("30"),
+		content:   []byte("ERROR something failed"),
+		container: []byte(s.id),
+	}
+	lf.Handle(format.LogParts{"parts": parts}, 0, nil)
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf("<27>Jun  5 13:13:47 %s coolappname[procx]: ERROR something failed\n", s.idShort))
+	c.Assert(parts, check.DeepEquals, &rawLogParts{
+		ts:        time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+		priority:  []byte("30"),
+		content:   []byte("ERROR something failed"),
+		container: []byte(s.id),
+	})
+}
+
+func (s *S) TestLogForwarderHandleContainerInfo(c *check.C) {
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn, err := net.ListenUDP("udp", addr)
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	lf.Handle(format.LogParts{"parts": &rawLogParts{
+		ts:        time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+		priority:  []byte("30"),
+		content:   []byte("mymsg"),
+		container: []byte("notindocker1"),
+		containerInfo: &container.Container{
+			Container:   docker.Container{ID: "notindocker1", Config: &docker.Config{}},
+			AppName:     "podapp",
+			ProcessName: "web",
+		},
+	}}, 0, nil)
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, "<30>Jun  5 13:13:47 notindocker1 podapp[web]: mymsg\n")
+}
+
 func (s *S) TestLogForwarderStartNoneBackend(c *check.C) {
 	lf := LogForwarder{
 		BindAddress:     "udp://127.0.0.1:59317",
@@ -168,6 +236,67 @@ func (s *S) TestLogForwarderStartWithTimezone(c *check.C) {
 	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf("<30>Jun  5 12:13:47 %s coolappname[procx]: mymsg\n", s.idShort))
 }
 
+func (s *S) TestLogForwarderStartRFC5424(c *check.C) {
+	os.Setenv("LOG_SYSLOG_FORMAT", "rfc5424")
+	os.Setenv("LOG_SYSLOG_HOSTNAME", "node 1")
+	os.Setenv("LOG_SYSLOG_MESSAGE_EXTRA_START", "#val1")
+	defer os.Unsetenv("LOG_SYSLOG_MESSAGE_EXTRA_START")
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn, err := net.ListenUDP("udp", addr)
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	nodeAddr := lf.backends[0].(*syslogBackend).nodeAddr
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	msg := []byte(fmt.Sprintf("<30>2015-06-05T16:13:47.123456789Z myhost docker/%s: mymsg\n", s.id))
+	_, err = conn.Write(msg)
+	c.Assert(err, check.IsNil)
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	expected := fmt.Sprintf(`<30>1 2015-06-05T13:13:47.123456-03:00 node_1 coolappname procx - [tsuru@32473 unit="%s" app="coolappname" process="procx" node="%s"] #val1 mymsg`+"\n", s.idShort, nodeAddr)
+	c.Assert(string(buffer[:n]), check.Equals, expected)
+	parser := (&format.RFC5424{}).GetParser(buffer[:n-1])
+	err = parser.Parse()
+	c.Assert(err, check.IsNil)
+	parsed := parser.Dump()
+	c.Assert(parsed["hostname"], check.Equals, "node_1")
+	c.Assert(parsed["app_name"], check.Equals, "coolappname")
+	c.Assert(parsed["proc_id"], check.Equals, "procx")
+	c.Assert(parsed["message"], check.Equals, "#val1 mymsg")
+	c.Assert(parsed["timestamp"].(time.Time).Equal(time.Date(2015, 6, 5, 16, 13, 47, 123456000, time.UTC)), check.Equals, true)
+}
+
+func (s *S) TestLogForwarderStartInvalidSyslogFormat(c *check.C) {
+	os.Setenv("LOG_SYSLOG_FORMAT", "rfc9999")
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://127.0.0.1:1234")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.ErrorMatches, `unable to initialize log backend "syslog": invalid syslog format "rfc9999", expected rfc3164 or rfc5424`)
+}
+
+func (s *S) TestAppendRFC5424Fields(c *check.C) {
+	c.Assert(string(appendHeaderField(nil, "", 10)), check.Equals, "-")
+	c.Assert(string(appendHeaderField(nil, "my app\x01", 10)), check.Equals, "my_app_")
+	c.Assert(string(appendHeaderField(nil, "abcdefghijkl", 10)), check.Equals, "abcdefghij")
+	c.Assert(string(appendParamValue(nil, `a"b\c]d`)), check.Equals, `a\"b\\c\]d`)
+}
+
 func (s *S) TestLogForwarderWSForwarderHTTP(c *check.C) {
 	testLogForwarderWSForwarder(s, c, httptest.NewServer)
 }
@@ -267,7 +396,7 @@ func (s *S) TestLogForwarderStartBindError(c *check.C) {
 		DockerEndpoint: s.dockerServer.URL(),
 	}
 	err := lf.Start()
-	c.Assert(err, check.ErrorMatches, `invalid protocol "xudp", expected tcp or udp`)
+	c.Assert(err, check.ErrorMatches, `invalid protocol "xudp", expected tcp, udp, tls, unix or unixgram`)
 }
 
 func (s *S) TestLogForwarderStartAlreadyBound(c *check.C) {
@@ -346,6 +475,8 @@ func (s *S) TestLogForwarderOverflow(c *check.C) {
 	wg.Wait()
 	lf.stopWait()
 	c.Assert(logBuf.String(), check.Matches, `(?s).*\[ERROR\] Dropping log messages to tsuru due to full channel buffer.*`)
+	wsURL := strings.Replace(srv.URL, "http://", "ws://", 1) + "/logs"
+	c.Assert(messagesDropped.WithLabelValues("tsuru", wsURL).Value() > 0, check.Equals, true)
 }
 
 func (s *S) TestLogForwarderHandleIgnoredInvalid(c *check.C) {
@@ -746,7 +877,7 @@ func BenchmarkMessagesWaitOneSyslogAddress(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		lf.Handle(parts, 1, nil)
 	}
-	close(lf.backends[0].(*syslogBackend).msgChans[0])
+	close(lf.backends[0].(*syslogBackend).queues[0].ch)
 	<-done[0]
 	b.StopTimer()
 	lf.server.Kill()
@@ -784,8 +915,8 @@ func BenchmarkMessagesWaitTwoSyslogAddresses(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		lf.Handle(parts, 1, nil)
 	}
-	close(lf.backends[0].(*syslogBackend).msgChans[0])
-	close(lf.backends[0].(*syslogBackend).msgChans[1])
+	close(lf.backends[0].(*syslogBackend).queues[0].ch)
+	close(lf.backends[0].(*syslogBackend).queues[1].ch)
 	<-done[0]
 	<-done[1]
 	b.StopTimer()
@@ -892,7 +1023,7 @@ func BenchmarkMessagesBroadcastWaitTsuru(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		lf.Handle(parts, 1, nil)
 	}
-	close(lf.backends[0].(*tsuruBackend).msgCh)
+	close(lf.backends[0].(*tsuruBackend).queue.ch)
 	<-done
 	b.StopTimer()
 }
@@ -1068,6 +1199,117 @@ func (s *S) TestGelfForwarderStdErr(c *check.C) {
 	c.Assert(gelfMsg.Extra["_pid"], check.Equals, "procx")
 }
 
+func startGelfTCPReceiver(c *check.C) (net.Listener, chan *gelf.Message) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	msgCh := make(chan *gelf.Message, 10)
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			data, readErr := reader.ReadBytes(0)
+			if readErr != nil {
+				return
+			}
+			var msg gelf.Message
+			c.Check(msg.UnmarshalJSON(data[:len(data)-1]), check.IsNil)
+			msgCh <- &msg
+		}
+	}()
+	return listener, msgCh
+}
+
+func (s *S) TestGelfForwarderMultipleDestinations(c *check.C) {
+	listener, tcpMsgs := startGelfTCPReceiver(c)
+	defer listener.Close()
+	reader, err := gelf.NewReader("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_GELF_HOST", "tcp://"+listener.Addr().String()+",udp://"+reader.Addr())
+	os.Setenv("LOG_GELF_COMPRESSION", "gzip")
+	os.Setenv("LOG_GELF_FIELDS_WHITELIST", "status")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	c.Assert(lf.backends[0].(*gelfBackend).queues, check.HasLen, 2)
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	msg := []byte(fmt.Sprintf("<27>2015-06-05T16:13:47Z myhost docker/%s: myerr status=500\n", s.id))
+	_, err = conn.Write(msg)
+	c.Assert(err, check.IsNil)
+	var tcpMsg *gelf.Message
+	select {
+	case tcpMsg = <-tcpMsgs:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for gelf tcp message")
+	}
+	udpMsg, err := reader.ReadMessage()
+	c.Assert(err, check.IsNil)
+	for _, gelfMsg := range []*gelf.Message{tcpMsg, udpMsg} {
+		c.Assert(gelfMsg.Host, check.Equals, s.idShort)
+		c.Assert(gelfMsg.Short, check.Equals, "myerr status=500")
+		c.Assert(gelfMsg.Level, check.Equals, gelf.LOG_ERR)
+		c.Assert(gelfMsg.Extra, check.DeepEquals, map[string]interface{}{
+			"_app":    "coolappname",
+			"_pid":    "procx",
+			"_status": "500",
+		})
+	}
+}
+
+func (s *S) TestGelfForwarderInvalidConfig(c *check.C) {
+	tests := []struct {
+		envs        map[string]string
+		expectedErr string
+	}{
+		{
+			envs:        map[string]string{"LOG_GELF_HOST": "http://localhost:12201"},
+			expectedErr: `invalid gelf host "http://localhost:12201", expected udp or tcp scheme`,
+		},
+		{
+			envs:        map[string]string{"LOG_GELF_COMPRESSION": "lz4"},
+			expectedErr: `invalid gelf compression "lz4", expected none, gzip or zlib`,
+		},
+	}
+	for _, tt := range tests {
+		for k, v := range tt.envs {
+			os.Setenv(k, v)
+		}
+		backend := &gelfBackend{}
+		err := backend.initialize()
+		c.Assert(err, check.ErrorMatches, tt.expectedErr)
+		for k := range tt.envs {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func (s *S) TestParseGelfURL(c *check.C) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"localhost:1234", "udp://localhost:1234"},
+		{"localhost", "udp://localhost:12201"},
+		{"tcp://graylog", "tcp://graylog:12201"},
+		{"tcp://10.0.0.1:1234", "tcp://10.0.0.1:1234"},
+	}
+	for _, tt := range tests {
+		gelfURL, err := parseGelfURL(tt.host)
+		c.Assert(err, check.IsNil)
+		c.Assert(gelfURL.String(), check.Equals, tt.expected)
+	}
+}
+
 func BenchmarkMessagesGelfBackendProcess(b *testing.B) {
 	b.StopTimer()
 	disableLog()
@@ -1088,17 +1330,18 @@ func BenchmarkMessagesGelfBackendProcess(b *testing.B) {
 	conn := startReceiver()
 	os.Setenv("LOG_GELF_HOST", conn.LocalAddr().String())
 	be := gelfBackend{}
-	err := be.initialize()
+	gelfURL, err := parseGelfURL(conn.LocalAddr().String())
 	if err != nil {
 		b.Fatal(err)
 	}
-	gelfConn, err := be.connect()
+	fwd := &gelfForwarder{backend: &be, url: gelfURL, compression: gelf.CompressNone}
+	gelfConn, err := fwd.connect()
 	if err != nil {
 		b.Fatal(err)
 	}
 	b.StartTimer()
 	for i := 0; i < b.N; i++ {
-		err = be.process(gelfConn, &gelf.Message{
+		err = fwd.process(gelfConn, &gelf.Message{
 			Version: "1.1",
 			Host:    "mycont",
 			Short:   "mymsg",
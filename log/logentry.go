@@ -0,0 +1,220 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxLogEntrySize is the largest encoded entry accepted in a log driver
+// stream, the same limit used by docker.
+const maxLogEntrySize = 1e6
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncatedLogEntry = errors.New("truncated log entry")
+
+// pluginLogEntry is the LogEntry protobuf message exchanged with docker by
+// log driver plugins.
+type pluginLogEntry struct {
+	source      string
+	timeNano    int64
+	line        []byte
+	partial     bool
+	partialMeta *partialLogMetadata
+}
+
+type partialLogMetadata struct {
+	last    bool
+	id      string
+	ordinal int32
+}
+
+// complete reports whether the entry is the last chunk of a message. Docker
+// versions without partial metadata only mark chunks before the last one as
+// partial.
+func (e *pluginLogEntry) complete() bool {
+	if e.partialMeta != nil {
+		return e.partialMeta.last
+	}
+	return !e.partial
+}
+
+// partialID returns the id of the message the entry is a chunk of, empty
+// for docker versions without partial metadata.
+func (e *pluginLogEntry) partialID() string {
+	if e.partialMeta != nil {
+		return e.partialMeta.id
+	}
+	return ""
+}
+
+// readPluginLogEntry reads an entry prefixed by its big endian uint32 size,
+// reusing buf when it's large enough. The returned line references buf.
+func readPluginLogEntry(r io.Reader, buf []byte) (pluginLogEntry, []byte, error) {
+	var size [4]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return pluginLogEntry{}, buf, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxLogEntrySize {
+		return pluginLogEntry{}, buf, fmt.Errorf("log entry too large: %d bytes", n)
+	}
+	if cap(buf) < int(n) {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return pluginLogEntry{}, buf, err
+	}
+	entry, err := decodePluginLogEntry(buf)
+	return entry, buf, err
+}
+
+// writePluginLogEntry writes entry prefixed by its big endian uint32 size.
+func writePluginLogEntry(w io.Writer, entry *pluginLogEntry) error {
+	data := entry.encode(make([]byte, 4, 64+len(entry.line)))
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	_, err := w.Write(data)
+	return err
+}
+
+func decodePluginLogEntry(data []byte) (pluginLogEntry, error) {
+	var entry pluginLogEntry
+	err := decodeProtoFields(data, func(field, wireType int, value uint64, raw []byte) error {
+		switch {
+		case field == 1 && wireType == wireBytes:
+			entry.source = string(raw)
+		case field == 2 && wireType == wireVarint:
+			entry.timeNano = int64(value)
+		case field == 3 && wireType == wireBytes:
+			entry.line = raw
+		case field == 4 && wireType == wireVarint:
+			entry.partial = value != 0
+		case field == 5 && wireType == wireBytes:
+			entry.partialMeta = &partialLogMetadata{}
+			return decodeProtoFields(raw, func(field, wireType int, value uint64, raw []byte) error {
+				switch {
+				case field == 1 && wireType == wireVarint:
+					entry.partialMeta.last = value != 0
+				case field == 2 && wireType == wireBytes:
+					entry.partialMeta.id = string(raw)
+				case field == 3 && wireType == wireVarint:
+					entry.partialMeta.ordinal = int32(value)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return entry, err
+}
+
+func (e *pluginLogEntry) encode(data []byte) []byte {
+	if e.source != "" {
+		data = appendProtoBytes(data, 1, []byte(e.source))
+	}
+	if e.timeNano != 0 {
+		data = appendProtoVarint(data, 2, uint64(e.timeNano))
+	}
+	if len(e.line) > 0 {
+		data = appendProtoBytes(data, 3, e.line)
+	}
+	if e.partial {
+		data = appendProtoVarint(data, 4, 1)
+	}
+	if e.partialMeta != nil {
+		var meta []byte
+		if e.partialMeta.last {
+			meta = appendProtoVarint(meta, 1, 1)
+		}
+		if e.partialMeta.id != "" {
+			meta = appendProtoBytes(meta, 2, []byte(e.partialMeta.id))
+		}
+		if e.partialMeta.ordinal != 0 {
+			meta = appendProtoVarint(meta, 3, uint64(e.partialMeta.ordinal))
+		}
+		data = appendProtoBytes(data, 5, meta)
+	}
+	return data
+}
+
+// decodeProtoFields calls fn for each field in the protobuf message in data.
+// Varint values are passed in value and length delimited ones in raw, fixed
+// size values are skipped.
+func decodeProtoFields(data []byte, fn func(field, wireType int, value uint64, raw []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncatedLogEntry
+		}
+		data = data[n:]
+		field, wireType := int(key>>3), int(key&0x7)
+		var value uint64
+		var raw []byte
+		switch wireType {
+		case wireVarint:
+			value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncatedLogEntry
+			}
+			data = data[n:]
+		case wireBytes:
+			value, n = binary.Uvarint(data)
+			if n <= 0 || value > uint64(len(data)-n) {
+				return errTruncatedLogEntry
+			}
+			raw = data[n : n+int(value)]
+			data = data[n+int(value):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wireType == wireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return errTruncatedLogEntry
+			}
+			data = data[size:]
+			continue
+		default:
+			return fmt.Errorf("invalid protobuf wire type %d", wireType)
+		}
+		err := fn(field, wireType, value, raw)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendProtoVarint(data []byte, field int, value uint64) []byte {
+	data = appendUvarint(data, uint64(field)<<3|wireVarint)
+	return appendUvarint(data, value)
+}
+
+func appendProtoBytes(data []byte, field int, value []byte) []byte {
+	data = appendUvarint(data, uint64(field)<<3|wireBytes)
+	data = appendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+func appendUvarint(data []byte, value uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], value)
+	return append(data, buf[:n]...)
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"io"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestPluginLogEntryRoundTrip(c *check.C) {
+	entries := []pluginLogEntry{
+		{source: "stdout", timeNano: 1433520827000000000, line: []byte("hello")},
+		{source: "stderr", timeNano: 1, line: []byte("part"), partial: true},
+		{source: "stdout", timeNano: 2, line: []byte("chunk"), partial: true, partialMeta: &partialLogMetadata{
+			last: true, id: "abc", ordinal: 3,
+		}},
+		{},
+	}
+	var buf bytes.Buffer
+	for i := range entries {
+		err := writePluginLogEntry(&buf, &entries[i])
+		c.Assert(err, check.IsNil)
+	}
+	var data []byte
+	for _, expected := range entries {
+		var entry pluginLogEntry
+		var err error
+		entry, data, err = readPluginLogEntry(&buf, data)
+		c.Assert(err, check.IsNil)
+		c.Assert(entry, check.DeepEquals, expected)
+	}
+	_, _, err := readPluginLogEntry(&buf, data)
+	c.Assert(err, check.Equals, io.EOF)
+}
+
+func (s *S) TestDecodePluginLogEntrySkipsUnknownFields(c *check.C) {
+	var data []byte
+	data = appendProtoVarint(data, 9, 42)
+	data = append(data, 10<<3|wireFixed64, 1, 2, 3, 4, 5, 6, 7, 8)
+	data = append(data, 11<<3|wireFixed32, 1, 2, 3, 4)
+	data = appendProtoBytes(data, 3, []byte("hello"))
+	data = appendProtoBytes(data, 12, []byte("ignored"))
+	entry, err := decodePluginLogEntry(data)
+	c.Assert(err, check.IsNil)
+	c.Assert(entry, check.DeepEquals, pluginLogEntry{line: []byte("hello")})
+}
+
+func (s *S) TestDecodePluginLogEntryInvalid(c *check.C) {
+	tests := []struct {
+		data []byte
+		err  string
+	}{
+		{[]byte{3<<3 | wireBytes, 10, 'a'}, "truncated log entry"},
+		{[]byte{2 << 3, 0x80}, "truncated log entry"},
+		{[]byte{0x80}, "truncated log entry"},
+		{[]byte{10<<3 | wireFixed32, 1}, "truncated log entry"},
+		{[]byte{1<<3 | 3}, "invalid protobuf wire type 3"},
+		{appendProtoBytes(nil, 5, []byte{1<<3 | 7}), "invalid protobuf wire type 7"},
+	}
+	for i, tt := range tests {
+		_, err := decodePluginLogEntry(tt.data)
+		c.Check(err, check.ErrorMatches, tt.err, check.Commentf("test %d", i))
+	}
+}
+
+func (s *S) TestReadPluginLogEntryInvalidSize(c *check.C) {
+	_, _, err := readPluginLogEntry(bytes.NewReader([]byte{0xff, 0, 0, 0}), nil)
+	c.Assert(err, check.ErrorMatches, "log entry too large: 4278190080 bytes")
+	_, _, err = readPluginLogEntry(bytes.NewReader([]byte{0, 0, 0, 4, 1}), nil)
+	c.Assert(err, check.Equals, io.ErrUnexpectedEOF)
+	_, _, err = readPluginLogEntry(bytes.NewReader([]byte{0, 0, 0, 4}), nil)
+	c.Assert(err, check.Equals, io.ErrUnexpectedEOF)
+}
+
+func (s *S) TestPluginLogEntryComplete(c *check.C) {
+	c.Assert((&pluginLogEntry{}).complete(), check.Equals, true)
+	c.Assert((&pluginLogEntry{partial: true}).complete(), check.Equals, false)
+	c.Assert((&pluginLogEntry{partial: true, partialMeta: &partialLogMetadata{}}).complete(), check.Equals, false)
+	c.Assert((&pluginLogEntry{partial: true, partialMeta: &partialLogMetadata{last: true}}).complete(), check.Equals, true)
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// parseLogfmtFields returns the key=value pairs found in content, in order.
+// Values may be double quoted, using backslash to escape quotes, backslashes
+// and control characters. Words which are not pairs, including quoted ones,
+// are skipped, so fields can be extracted from messages mixing free text and
+// pairs. It returns nil if content has no pairs.
+func parseLogfmtFields(content []byte) []logField {
+	if bytes.IndexByte(content, '=') == -1 {
+		return nil
+	}
+	var fields []logField
+	i := 0
+	for i < len(content) {
+		if isLogfmtSpace(content[i]) {
+			i++
+			continue
+		}
+		if content[i] == '"' {
+			_, i = scanLogfmtQuoted(content, i)
+			continue
+		}
+		start := i
+		for i < len(content) && !isLogfmtSpace(content[i]) && content[i] != '=' && content[i] != '"' {
+			i++
+		}
+		key := content[start:i]
+		if i >= len(content) || content[i] != '=' || len(key) == 0 {
+			// Not a pair, skip the rest of the word.
+			for i < len(content) && !isLogfmtSpace(content[i]) {
+				i++
+			}
+			continue
+		}
+		i++
+		var value string
+		if i < len(content) && content[i] == '"' {
+			value, i = scanLogfmtQuoted(content, i)
+		} else {
+			start = i
+			for i < len(content) && !isLogfmtSpace(content[i]) {
+				i++
+			}
+			value = string(content[start:i])
+		}
+		fields = append(fields, logField{key: string(key), value: value})
+	}
+	return fields
+}
+
+// scanLogfmtQuoted returns the unescaped value of the quoted string starting
+// at content[start] and the index after its closing quote. Unterminated
+// strings end with content.
+func scanLogfmtQuoted(content []byte, start int) (string, int) {
+	var buf []byte
+	i := start + 1
+	for i < len(content) {
+		c := content[i]
+		switch {
+		case c == '"':
+			return string(buf), i + 1
+		case c == '\\' && i+1 < len(content):
+			i++
+			switch content[i] {
+			case 'n':
+				buf = append(buf, '\n')
+			case 't':
+				buf = append(buf, '\t')
+			case 'r':
+				buf = append(buf, '\r')
+			case '"', '\\':
+				buf = append(buf, content[i])
+			default:
+				buf = append(buf, '\\', content[i])
+			}
+		default:
+			buf = append(buf, c)
+		}
+		i++
+	}
+	return string(buf), i
+}
+
+func isLogfmtSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// appendLogfmt appends fields to buf as space separated key=value pairs,
+// quoting values when needed.
+func appendLogfmt(buf []byte, fields []logField) []byte {
+	for i, field := range fields {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		buf = append(buf, field.key...)
+		buf = append(buf, '=')
+		value := fieldString(field.value)
+		if value == "" || strings.ContainsAny(value, " =\"\\\t\n") {
+			buf = strconv.AppendQuote(buf, value)
+		} else {
+			buf = append(buf, value...)
+		}
+	}
+	return buf
+}
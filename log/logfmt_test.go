@@ -0,0 +1,121 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Graylog2/go-gelf/gelf"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestParseLogfmtFields(c *check.C) {
+	tests := []struct {
+		content  string
+		expected []logField
+	}{
+		{"no pairs here", nil},
+		{"a=1 b=two", []logField{{key: "a", value: "1"}, {key: "b", value: "two"}}},
+		{"mymsg http_status=500 status=200", []logField{{key: "http_status", value: "500"}, {key: "status", value: "200"}}},
+		{`msg="a b" path=/x`, []logField{{key: "msg", value: "a b"}, {key: "path", value: "/x"}}},
+		{`msg="say \"hi\"\\n" next=1`, []logField{{key: "msg", value: `say "hi"\n`}, {key: "next", value: "1"}}},
+		{`msg="line\none\ttab"`, []logField{{key: "msg", value: "line\none\ttab"}}},
+		{`said "x=1 y=2" z=3`, []logField{{key: "z", value: "3"}}},
+		{`empty= other=""`, []logField{{key: "empty", value: ""}, {key: "other", value: ""}}},
+		{`=nokey a=b=c`, []logField{{key: "a", value: "b=c"}}},
+		{`open="unterminated value`, []logField{{key: "open", value: "unterminated value"}}},
+		{`path=C:\dir\ x="a\qb"`, []logField{{key: "path", value: `C:\dir\`}, {key: "x", value: `a\qb`}}},
+	}
+	for _, tt := range tests {
+		c.Check(parseLogfmtFields([]byte(tt.content)), check.DeepEquals, tt.expected, check.Commentf("content: %s", tt.content))
+	}
+}
+
+func (s *S) TestAppendLogfmt(c *check.C) {
+	buf := appendLogfmt([]byte("msg "), []logField{
+		{key: "a", value: "b"},
+		{key: "n", value: json.Number("1.5")},
+		{key: "q", value: `x "y"`},
+		{key: "e", value: ""},
+		{key: "o", value: map[string]interface{}{"k": "v"}},
+	})
+	c.Assert(string(buf), check.Equals, `msg a=b n=1.5 q="x \"y\"" e="" o="{\"k\":\"v\"}"`)
+}
+
+func (s *S) TestLogfmtRoundTrip(c *check.C) {
+	fields := []logField{
+		{key: "msg", value: `quoted "value" with \ backslash`},
+		{key: "empty", value: ""},
+		{key: "plain", value: "x"},
+		{key: "multi", value: "a\nb"},
+	}
+	c.Assert(parseLogfmtFields(appendLogfmt(nil, fields)), check.DeepEquals, fields)
+}
+
+func (s *S) TestStructuredParserLogfmt(c *check.C) {
+	os.Setenv("LOG_PARSE_FORMATS", "json,logfmt")
+	p, err := newStructuredParser()
+	c.Assert(err, check.IsNil)
+	parts := &rawLogParts{content: []byte(`level=warn msg="disk almost full" usage=91%`)}
+	p.parse(parts)
+	c.Assert(string(parts.message), check.Equals, "disk almost full")
+	c.Assert(parts.level, check.Equals, "warning")
+	c.Assert(parts.fields, check.DeepEquals, []logField{{key: "usage", value: "91%"}})
+	parts = &rawLogParts{content: []byte(`{"msg":"json first","a":"b=c"}`)}
+	p.parse(parts)
+	c.Assert(string(parts.message), check.Equals, "json first")
+	c.Assert(parts.fields, check.DeepEquals, []logField{{key: "a", value: "b=c"}})
+	parts = &rawLogParts{content: []byte("plain message")}
+	p.parse(parts)
+	c.Assert(parts.fields, check.IsNil)
+}
+
+func (s *S) TestGelfBackendFields(c *check.C) {
+	b := &gelfBackend{fieldsWhitelist: []string{"status", "msg"}}
+	parts := &rawLogParts{content: []byte(`level=error msg="request failed" http_status=500 status=502 user=x`)}
+	c.Assert(b.fields(parts), check.DeepEquals, []logField{{key: "msg", value: "request failed"}, {key: "status", value: "502"}})
+	b.allFields = true
+	c.Assert(b.fields(parts), check.DeepEquals, []logField{
+		{key: "level", value: "error"},
+		{key: "msg", value: "request failed"},
+		{key: "http_status", value: "500"},
+		{key: "status", value: "502"},
+		{key: "user", value: "x"},
+	})
+	parsed := &rawLogParts{content: parts.content, structured: true, fields: []logField{{key: "a", value: "b"}}}
+	c.Assert(b.fields(parsed), check.DeepEquals, parsed.fields)
+}
+
+func (s *S) TestGelfForwarderAllFields(c *check.C) {
+	reader, err := gelf.NewReader("127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	os.Setenv("LOG_GELF_HOST", reader.Addr())
+	os.Setenv("LOG_GELF_FIELDS_ALL", "true")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"gelf"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte(fmt.Sprintf(`<30>2015-06-05T16:13:47Z myhost docker/%s: done path="/a b" http_status=404`+"\n", s.id)))
+	c.Assert(err, check.IsNil)
+	gelfMsg, err := reader.ReadMessage()
+	c.Assert(err, check.IsNil)
+	c.Assert(gelfMsg.Short, check.Equals, `done path="/a b" http_status=404`)
+	c.Assert(gelfMsg.Extra, check.DeepEquals, map[string]interface{}{
+		"_app":         "coolappname",
+		"_pid":         "procx",
+		"_path":        "/a b",
+		"_http_status": "404",
+	})
+}
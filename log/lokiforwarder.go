@@ -0,0 +1,205 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/bsmetric"
+	"github.com/tsuru/bs/config"
+)
+
+const (
+	lokiPushPath            = "/loki/api/v1/push"
+	defaultLokiBatchSize    = 1024 * 1024
+	defaultLokiBatchEntries = 1000
+	lokiRequestTimeout      = 30 * time.Second
+)
+
+type lokiBackend struct {
+	pushURL    string
+	tenantID   string
+	node       string
+	batchSize  int
+	batchItems int
+	batchWait  time.Duration
+	maxRetries int
+	client     *http.Client
+	dropped    *bsmetric.Counter
+	queue      *messageQueue
+}
+
+type lokiLabels struct {
+	App      string `json:"app"`
+	Process  string `json:"process"`
+	Node     string `json:"node"`
+	Severity string `json:"severity"`
+}
+
+type lokiEntry struct {
+	Labels    lokiLabels `json:"labels"`
+	Timestamp time.Time  `json:"timestamp"`
+	Line      string     `json:"line"`
+}
+
+type lokiStream struct {
+	Stream lokiLabels  `json:"stream"`
+	Values [][2]string `json:"values"`
+}
+
+type lokiEntriesByTime []*lokiEntry
+
+func (e lokiEntriesByTime) Len() int           { return len(e) }
+func (e lokiEntriesByTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e lokiEntriesByTime) Less(i, j int) bool { return e[i].Timestamp.Before(e[j].Timestamp) }
+
+type lokiPushRequest struct {
+	Streams []*lokiStream `json:"streams"`
+}
+
+func (b *lokiBackend) initialize() error {
+	lokiURL, err := url.Parse(config.StringEnvOrDefault("http://localhost:3100", "LOG_LOKI_URL"))
+	if err != nil {
+		return fmt.Errorf("unable to parse loki url: %s", err)
+	}
+	lokiURL.Path = strings.TrimSuffix(lokiURL.Path, "/") + lokiPushPath
+	b.pushURL = lokiURL.String()
+	b.tenantID = config.StringEnvOrDefault("", "LOG_LOKI_TENANT_ID")
+	b.node = config.StringEnvOrDefault("", "LOG_LOKI_NODE")
+	if b.node == "" {
+		b.node, err = os.Hostname()
+		if err != nil {
+			bslog.Warnf("unable to read hostname for loki node label: %s", err)
+		}
+	}
+	b.batchSize = config.IntEnvOrDefault(defaultLokiBatchSize, "LOG_LOKI_BATCH_SIZE")
+	b.batchItems = config.IntEnvOrDefault(defaultLokiBatchEntries, "LOG_LOKI_BATCH_ENTRIES")
+	b.batchWait = config.SecondsEnvOrDefault(1, "LOG_LOKI_BATCH_WAIT")
+	b.maxRetries = config.IntEnvOrDefault(3, "LOG_LOKI_MAX_RETRIES")
+	b.client = &http.Client{Timeout: lokiRequestTimeout}
+	queueCfg := newQueueConfig("loki")
+	lokiURL.User = nil
+	queueCfg.destination = lokiURL.String()
+	b.dropped = messagesDropped.WithLabelValues(queueCfg.name, queueCfg.destination)
+	b.queue, err = processMessages(b, queueCfg)
+	return err
+}
+
+func (b *lokiBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
+	b.queue.send(&lokiEntry{
+		Labels: lokiLabels{
+			App:      appName,
+			Process:  processName,
+			Node:     b.node,
+			Severity: parts.severity(),
+		},
+		Timestamp: parts.ts,
+		Line:      string(parts.text()),
+	})
+}
+
+func (b *lokiBackend) stop() {
+	b.queue.stop()
+}
+
+func (b *lokiBackend) connect() (net.Conn, error) {
+	return newBatchConn(batchConfig{
+		name:       "loki",
+		maxItems:   b.batchItems,
+		maxSize:    b.batchSize,
+		interval:   b.batchWait,
+		maxRetries: b.maxRetries,
+		dropped:    b.dropped,
+	}, b.send), nil
+}
+
+func (b *lokiBackend) process(conn net.Conn, msg LogMessage) error {
+	entry := msg.(*lokiEntry)
+	return conn.(*batchConn).add(entry, len(entry.Line))
+}
+
+// send pushes entries to loki, grouping them in one stream for each set of
+// labels.
+func (b *lokiBackend) send(items []LogMessage) ([]LogMessage, error) {
+	var pushReq lokiPushRequest
+	streams := map[lokiLabels]*lokiStream{}
+	entries := make([]*lokiEntry, len(items))
+	for i, item := range items {
+		entries[i] = item.(*lokiEntry)
+	}
+	// Loki rejects entries older than the previous one in the same stream,
+	// joined multiline messages and timestamps sent by clients may be out of
+	// order.
+	sort.Stable(lokiEntriesByTime(entries))
+	for _, entry := range entries {
+		stream := streams[entry.Labels]
+		if stream == nil {
+			stream = &lokiStream{Stream: entry.Labels}
+			streams[entry.Labels] = stream
+			pushReq.Streams = append(pushReq.Streams, stream)
+		}
+		stream.Values = append(stream.Values, [2]string{
+			strconv.FormatInt(entry.Timestamp.UnixNano(), 10),
+			entry.Line,
+		})
+	}
+	body, err := json.Marshal(pushReq)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", b.pushURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.tenantID != "" {
+		req.Header.Set("X-Scope-OrgID", b.tenantID)
+	}
+	rsp, err := b.client.Do(req)
+	if err != nil {
+		return items, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, rsp.Body)
+		return nil, nil
+	}
+	data, _ := ioutil.ReadAll(rsp.Body)
+	err = fmt.Errorf("loki push request failed with status %d: %s", rsp.StatusCode, bytes.TrimSpace(data))
+	if rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode >= 500 {
+		return items, err
+	}
+	return nil, err
+}
+
+func (b *lokiBackend) encodeMessage(msg LogMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (b *lokiBackend) decodeMessage(data []byte) (LogMessage, error) {
+	var entry lokiEntry
+	err := json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (b *lokiBackend) close(conn net.Conn) {
+	conn.Close()
+}
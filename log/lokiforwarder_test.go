@@ -0,0 +1,155 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type lokiRequest struct {
+	tenantID    string
+	contentType string
+	body        lokiPushRequest
+}
+
+func (s *S) TestLogForwarderLoki(c *check.C) {
+	reqCh := make(chan lokiRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/loki/api/v1/push")
+		req := lokiRequest{
+			tenantID:    r.Header.Get("X-Scope-OrgID"),
+			contentType: r.Header.Get("Content-Type"),
+		}
+		err := json.NewDecoder(r.Body).Decode(&req.body)
+		c.Check(err, check.IsNil)
+		reqCh <- req
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	os.Setenv("LOG_LOKI_URL", srv.URL)
+	os.Setenv("LOG_LOKI_TENANT_ID", "tenant1")
+	os.Setenv("LOG_LOKI_NODE", "node1")
+	os.Setenv("LOG_LOKI_BATCH_ENTRIES", "3")
+	os.Setenv("LOG_LOKI_BATCH_WAIT", "60")
+	os.Setenv("LOG_PARSE_FORMATS", "json")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"loki"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, msg := range []string{
+		"<30>2015-06-05T16:13:47Z myhost docker/%s: mymsg",
+		"<27>2015-06-05T16:13:48Z myhost docker/%s: myerr",
+		`<30>2015-06-05T16:13:46Z myhost docker/%s: {"msg":"mymsg0","status":200}`,
+	} {
+		_, err = conn.Write([]byte(fmt.Sprintf(msg+"\n", s.id)))
+		c.Assert(err, check.IsNil)
+	}
+	var req lokiRequest
+	select {
+	case req = <-reqCh:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for push request")
+	}
+	c.Assert(req.tenantID, check.Equals, "tenant1")
+	c.Assert(req.contentType, check.Equals, "application/json")
+	c.Assert(req.body.Streams, check.DeepEquals, []*lokiStream{
+		{
+			Stream: lokiLabels{App: "coolappname", Process: "procx", Node: "node1", Severity: "info"},
+			Values: [][2]string{
+				{"1433520826000000000", "mymsg0"},
+				{"1433520827000000000", "mymsg"},
+			},
+		},
+		{
+			Stream: lokiLabels{App: "coolappname", Process: "procx", Node: "node1", Severity: "err"},
+			Values: [][2]string{
+				{"1433520828000000000", "myerr"},
+			},
+		},
+	})
+}
+
+func (s *S) TestLokiSendRetry(c *check.C) {
+	oldInterval := batchRetryInterval
+	batchRetryInterval = time.Millisecond
+	defer func() { batchRetryInterval = oldInterval }()
+	statuses := []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusNoContent}
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[requests])
+		requests++
+	}))
+	defer srv.Close()
+	dropped := messagesDropped.WithLabelValues("loki", "test-retry")
+	b := &lokiBackend{
+		pushURL:    srv.URL + lokiPushPath,
+		batchItems: 1,
+		batchSize:  1024,
+		maxRetries: 3,
+		client:     http.DefaultClient,
+		dropped:    dropped,
+	}
+	conn, err := b.connect()
+	c.Assert(err, check.IsNil)
+	defer b.close(conn)
+	err = b.process(conn, &lokiEntry{Line: "mymsg"})
+	c.Assert(err, check.IsNil)
+	c.Assert(requests, check.Equals, 3)
+	c.Assert(dropped.Value(), check.Equals, uint64(0))
+}
+
+func (s *S) TestLokiSendRejected(c *check.C) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "entry out of order", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	dropped := messagesDropped.WithLabelValues("loki", "test-rejected")
+	b := &lokiBackend{
+		pushURL:    srv.URL + lokiPushPath,
+		batchItems: 1,
+		batchSize:  1024,
+		maxRetries: 3,
+		client:     http.DefaultClient,
+		dropped:    dropped,
+	}
+	conn, err := b.connect()
+	c.Assert(err, check.IsNil)
+	defer b.close(conn)
+	err = b.process(conn, &lokiEntry{Line: "mymsg"})
+	c.Assert(err, check.ErrorMatches, "loki push request failed with status 400: entry out of order")
+	c.Assert(requests, check.Equals, 1)
+	c.Assert(dropped.Value(), check.Equals, uint64(1))
+}
+
+func (s *S) TestLokiCodec(c *check.C) {
+	b := &lokiBackend{}
+	entry := &lokiEntry{
+		Labels:    lokiLabels{App: "myapp", Process: "web", Node: "node1", Severity: "info"},
+		Timestamp: time.Date(2017, 3, 21, 21, 28, 22, 0, time.UTC),
+		Line:      "mymsg",
+	}
+	data, err := b.encodeMessage(entry)
+	c.Assert(err, check.IsNil)
+	msg, err := b.decodeMessage(data)
+	c.Assert(err, check.IsNil)
+	c.Assert(msg, check.DeepEquals, entry)
+}
@@ -0,0 +1,30 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import "github.com/tsuru/bs/bsmetric"
+
+var (
+	messagesReceived = bsmetric.NewCounter("bs_log_messages_received_total",
+		"Number of log messages received by the log forwarder.")
+	messagesSuppressed = bsmetric.NewCounterVec("bs_log_messages_suppressed_total",
+		"Number of log messages discarded by the log rate limit.", "app")
+	messagesRedacted = bsmetric.NewCounterVec("bs_log_redactions_total",
+		"Number of sensitive values redacted from log messages.", "app", "rule")
+	messagesDropped = bsmetric.NewCounterVec("bs_log_messages_dropped_total",
+		"Number of log messages dropped by a log backend queue.", "backend", "destination")
+	messagesSpilled = bsmetric.NewCounterVec("bs_log_messages_spilled_total",
+		"Number of log messages written to a backend spill queue on disk.", "backend", "destination")
+	queueLength = bsmetric.NewGaugeVec("bs_log_queue_length",
+		"Number of log messages waiting in a backend queue.", "backend", "destination")
+	queueCapacity = bsmetric.NewGaugeVec("bs_log_queue_capacity",
+		"Maximum number of log messages in a backend queue.", "backend", "destination")
+	spillPending = bsmetric.NewGaugeVec("bs_log_spill_pending_messages",
+		"Number of log messages waiting in a backend spill queue on disk.", "backend", "destination")
+	forwarderReconnects = bsmetric.NewCounterVec("bs_log_forwarder_reconnects_total",
+		"Number of times a log forwarder connection was reestablished.", "backend", "destination")
+	forwarderErrors = bsmetric.NewCounterVec("bs_log_forwarder_errors_total",
+		"Number of errors connecting or writing to a log forwarder destination.", "backend", "destination")
+)
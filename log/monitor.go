@@ -12,14 +12,13 @@ import (
 	"io/ioutil"
 	stdSyslog "log/syslog"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/howeyc/fsnotify"
 	"github.com/tsuru/bs/bslog"
 	"github.com/tsuru/bs/container"
 	"gopkg.in/mcuadros/go-syslog.v2"
@@ -32,27 +31,46 @@ const (
 
 	podContainerName    = "POD"
 	kubeSystemNamespace = "kube-system"
+
+	kubeLogWatchFlags = fsnotify.FSN_CREATE | fsnotify.FSN_DELETE | fsnotify.FSN_RENAME
 )
 
 var (
 	errNoLogDirectory = errors.New("monitor directory not found")
+	errInvalidCRILine = errors.New("invalid CRI log line")
 
-	updatePosInterval = 5 * time.Second
+	updatePosInterval     = 5 * time.Second
+	kubeLogResyncInterval = time.Minute
+	kubeLogRemoveDelay    = 10 * time.Second
 )
 
 type fileMonitor struct {
 	handler        syslog.Handler
 	mu             sync.RWMutex
-	cmd            *exec.Cmd
+	tailer         *fileTailer
 	path           string
 	finished       bool
-	reader         io.ReadCloser
 	container      []byte
 	streamDone     chan struct{}
 	posUpdateDone  chan struct{}
+	loadedPos      filePosition
 	loadedLastTime int64
-	lastTime       int64
+	posMu          sync.Mutex
+	pos            filePosition
 	posFile        string
+	formatDetected bool
+	criFormat      bool
+	partials       map[string]*logLine
+	info           *container.Container
+}
+
+// filePosition is the checkpoint of a log file stored in its position file.
+// Reading is resumed from the offset while the file has the same inode,
+// otherwise lines up to the timestamp are skipped.
+type filePosition struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+	Time   int64  `json:"time"`
 }
 
 type logLine struct {
@@ -69,20 +87,15 @@ func (b *rawByte) UnmarshalText(val []byte) error {
 }
 
 func newFileMonitor(handler syslog.Handler, path, containerID string) (*fileMonitor, error) {
-	m := &fileMonitor{
-		cmd:           exec.Command("tail", "-n", "+0", "-F", path),
+	return &fileMonitor{
+		tailer:        newFileTailer(path),
 		handler:       handler,
 		container:     []byte(containerID),
 		streamDone:    make(chan struct{}),
 		posUpdateDone: make(chan struct{}),
 		path:          path,
-	}
-	var err error
-	m.reader, err = m.cmd.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
-	return m, nil
+		partials:      make(map[string]*logLine),
+	}, nil
 }
 
 func (m *fileMonitor) loadLastPos() error {
@@ -90,66 +103,233 @@ func (m *fileMonitor) loadLastPos() error {
 		return nil
 	}
 	data, err := ioutil.ReadFile(m.posFile)
-	if err == nil {
-		m.loadedLastTime, _ = strconv.ParseInt(string(data), 10, 64)
-	} else if !os.IsNotExist(err) {
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
+	err = json.Unmarshal(data, &m.loadedPos)
+	if err != nil {
+		// Position files written by older versions have only the timestamp.
+		m.loadedPos = filePosition{}
+		m.loadedPos.Time, _ = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
 	return nil
 }
 
+func (m *fileMonitor) position() filePosition {
+	m.posMu.Lock()
+	defer m.posMu.Unlock()
+	return m.pos
+}
+
+func (m *fileMonitor) setPosition(pos filePosition) {
+	m.posMu.Lock()
+	m.pos = pos
+	m.posMu.Unlock()
+}
+
 func (m *fileMonitor) updatePos() {
 	if m.posFile == "" {
 		return
 	}
 	go func() {
 		defer close(m.posUpdateDone)
+		written := m.loadedPos
 		for {
+			var done bool
 			select {
 			case <-time.After(updatePosInterval):
 			case <-m.streamDone:
-				return
+				done = true
 			}
-			t := atomic.LoadInt64(&m.lastTime)
-			data := strconv.FormatInt(t, 10)
-			err := ioutil.WriteFile(m.posFile, []byte(data), 0600)
-			if err != nil {
-				bslog.Errorf("error storing last timestamp in %q: %v", m.posFile, err)
+			pos := m.position()
+			if pos != written {
+				err := writePosFile(m.posFile, pos)
+				if err != nil {
+					bslog.Errorf("error storing log file position in %q: %v", m.posFile, err)
+				} else {
+					written = pos
+				}
+			}
+			if done {
+				return
 			}
 		}
 	}()
 }
 
+// writePosFile atomically replaces the position file, writing it to a
+// temporary file which is synced and renamed.
+func writePosFile(path string, pos filePosition) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	// The directory is synced so the rename isn't lost in a crash.
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 func (m *fileMonitor) streamOutput() {
 	defer close(m.streamDone)
-	dec := json.NewDecoder(m.reader)
-	var lineData logLine
+	pos := m.position()
 	for {
-		err := dec.Decode(&lineData)
+		line, err := m.tailer.readLine()
 		if err != nil {
 			if err != io.EOF {
-				bslog.Errorf("error decoding log file line: %v", err)
+				bslog.Errorf("error reading log file %q: %v", m.path, err)
 			}
 			return
 		}
-		timeNano := lineData.Time.UnixNano()
-		if timeNano <= m.loadedLastTime {
-			continue
+		if timeNano := m.handleLine(line); timeNano != 0 {
+			pos.Time = timeNano
+		}
+		// The offset isn't stored while there are partial messages, so
+		// they are read again after a restart.
+		if len(m.partials) == 0 {
+			pos.Inode, pos.Offset = m.tailer.position()
+		}
+		m.setPosition(pos)
+	}
+}
+
+// handleLine sends the message in line to the handler, returning its
+// timestamp or 0 if it's skipped. Lines are in the docker json-file format
+// or in the CRI format used by containerd and CRI-O, detected from the first
+// line of the file.
+func (m *fileMonitor) handleLine(line []byte) int64 {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return 0
+	}
+	if !m.formatDetected {
+		m.formatDetected = true
+		m.criFormat = line[0] != '{'
+	}
+	var lineData logLine
+	if m.criFormat {
+		var partial bool
+		var err error
+		lineData, partial, err = parseCRILine(line)
+		if err != nil {
+			bslog.Errorf("error decoding log file line: %v", err)
+			return 0
+		}
+		var complete bool
+		lineData, complete = m.joinPartial(lineData, partial)
+		if !complete {
+			return 0
+		}
+	} else {
+		err := json.Unmarshal(line, &lineData)
+		if err != nil {
+			bslog.Errorf("error decoding log file line: %v", err)
+			return 0
 		}
-		facility := stdSyslog.LOG_DAEMON
-		severity := stdSyslog.LOG_INFO
-		if lineData.Stream != "stdout" {
-			severity = stdSyslog.LOG_ERR
+	}
+	timeNano := lineData.Time.UnixNano()
+	if timeNano <= m.loadedLastTime {
+		return 0
+	}
+	m.handler.Handle(format.LogParts{"parts": &rawLogParts{
+		content:       bytes.TrimSpace(lineData.Log),
+		ts:            lineData.Time,
+		priority:      streamPriority(lineData.Stream),
+		container:     m.container,
+		stream:        lineData.Stream,
+		containerInfo: m.info,
+	}}, 0, nil)
+	return timeNano
+}
+
+// joinPartial joins the chunks of partial messages in the same stream,
+// returning the message and true once its last chunk is read.
+func (m *fileMonitor) joinPartial(lineData logLine, partial bool) (logLine, bool) {
+	joined := m.partials[lineData.Stream]
+	if joined == nil {
+		if !partial {
+			return lineData, true
 		}
-		pr := int((facility & facilityMask) | (severity & severityMask))
-		atomic.StoreInt64(&m.lastTime, timeNano)
-		m.handler.Handle(format.LogParts{"parts": &rawLogParts{
-			content:   bytes.TrimSpace(lineData.Log),
-			ts:        lineData.Time,
-			priority:  []byte(strconv.Itoa(pr)),
-			container: m.container,
-		}}, 0, nil)
+		joined = &logLine{Stream: lineData.Stream, Time: lineData.Time}
+		m.partials[lineData.Stream] = joined
+	}
+	joined.Log = append(joined.Log, lineData.Log...)
+	if !partial || len(joined.Log) >= maxPartialMessageSize {
+		delete(m.partials, lineData.Stream)
+		return *joined, true
 	}
+	return logLine{}, false
+}
+
+// parseCRILine parses a line in the CRI log format, "<time> <stream> <tags>
+// <message>", where the tags are P for partial messages or F for the last
+// chunk of a message, optionally followed by other tags separated by ":".
+func parseCRILine(line []byte) (logLine, bool, error) {
+	fields := bytes.SplitN(line, []byte(" "), 4)
+	if len(fields) < 3 {
+		return logLine{}, false, errInvalidCRILine
+	}
+	ts, err := time.Parse(time.RFC3339Nano, string(fields[0]))
+	if err != nil {
+		return logLine{}, false, err
+	}
+	tags := fields[2]
+	if i := bytes.IndexByte(tags, ':'); i >= 0 {
+		tags = tags[:i]
+	}
+	var partial bool
+	switch string(tags) {
+	case "P":
+		partial = true
+	case "F":
+	default:
+		return logLine{}, false, errInvalidCRILine
+	}
+	lineData := logLine{Stream: string(fields[1]), Time: ts}
+	if len(fields) == 4 {
+		lineData.Log = fields[3]
+	}
+	return lineData, partial, nil
+}
+
+// streamPriority returns the syslog priority of messages written by
+// containers to stream, err for anything but stdout.
+func streamPriority(stream string) []byte {
+	facility := stdSyslog.LOG_DAEMON
+	severity := stdSyslog.LOG_INFO
+	if stream != streamStdout {
+		severity = stdSyslog.LOG_ERR
+	}
+	pr := int((facility & facilityMask) | (severity & severityMask))
+	return []byte(strconv.Itoa(pr))
 }
 
 func (m *fileMonitor) alive() bool {
@@ -159,12 +339,10 @@ func (m *fileMonitor) alive() bool {
 }
 
 func (m *fileMonitor) stop() {
-	if m.cmd.Process != nil {
-		m.cmd.Process.Kill()
-	}
+	m.tailer.close()
 }
 
-func (m *fileMonitor) wait() error {
+func (m *fileMonitor) wait() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.finished = true
@@ -172,7 +350,6 @@ func (m *fileMonitor) wait() error {
 	if m.posFile != "" {
 		<-m.posUpdateDone
 	}
-	return m.cmd.Wait()
 }
 
 func (m *fileMonitor) start() error {
@@ -180,7 +357,17 @@ func (m *fileMonitor) start() error {
 	if err != nil {
 		return err
 	}
-	return m.cmd.Start()
+	resumed, err := m.tailer.open(m.loadedPos.Inode, m.loadedPos.Offset)
+	if err != nil {
+		return err
+	}
+	if !resumed {
+		m.loadedLastTime = m.loadedPos.Time
+	}
+	pos := m.loadedPos
+	pos.Inode, pos.Offset = m.tailer.position()
+	m.setPosition(pos)
+	return nil
 }
 
 func (m *fileMonitor) run() {
@@ -194,8 +381,41 @@ func (m *fileMonitor) run() {
 type logFileEntry struct {
 	podName       string
 	namespace     string
+	podUID        string
 	containerID   string
 	containerName string
+	// restart is the restart count of the container in a /var/log/pods
+	// layout file name.
+	restart string
+}
+
+// logEntryFromPath returns the entry of a log file in dir, either a
+// <pod>_<namespace>_<container>-<id>.log file, as in /var/log/containers, or a
+// <namespace>_<pod>_<uid>/<container>/<n>.log file, as in /var/log/pods.
+func logEntryFromPath(dir, path string) logFileEntry {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return logEntryFromName(filepath.Base(path))
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 3 {
+		return logEntryFromName(filepath.Base(path))
+	}
+	entry := logFileEntry{
+		containerName: parts[1],
+		restart:       strings.TrimSuffix(parts[2], ".log"),
+	}
+	podParts := strings.SplitN(parts[0], "_", 3)
+	if len(podParts) > 0 {
+		entry.namespace = podParts[0]
+	}
+	if len(podParts) > 1 {
+		entry.podName = podParts[1]
+	}
+	if len(podParts) > 2 {
+		entry.podUID = podParts[2]
+	}
+	return entry
 }
 
 func logEntryFromName(fileName string) logFileEntry {
@@ -218,12 +438,31 @@ func logEntryFromName(fileName string) logFileEntry {
 }
 
 type kubernetesLogStreamer struct {
-	dir      string
-	posDir   string
-	quit     chan struct{}
-	monitors map[string]*fileMonitor
-	handler  syslog.Handler
-	client   *container.InfoClient
+	dir        string
+	posDir     string
+	quit       chan struct{}
+	monitors   map[string]*fileMonitor
+	handler    syslog.Handler
+	client     *container.InfoClient
+	pods       *kubePodsSource
+	watcher    *fsnotify.Watcher
+	targets    map[string]string
+	targetDirs map[string]int
+	podDirs    map[string]bool
+	missing    map[string]time.Time
+	pending    map[string]time.Time
+}
+
+// hasPodDirs reports whether there are pod directories in the log directory,
+// as in the /var/log/pods layout.
+func (s *kubernetesLogStreamer) hasPodDirs() bool {
+	dirs, _ := filepath.Glob(filepath.Join(s.dir, "*", "*"))
+	for _, dir := range dirs {
+		if info, err := os.Lstat(dir); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
 }
 
 func newKubeLogStreamer(handler syslog.Handler, client *container.InfoClient, dir, posDir string) (*kubernetesLogStreamer, error) {
@@ -241,12 +480,17 @@ func newKubeLogStreamer(handler syslog.Handler, client *container.InfoClient, di
 		}
 	}
 	return &kubernetesLogStreamer{
-		dir:      dir,
-		posDir:   posDir,
-		handler:  handler,
-		quit:     make(chan struct{}),
-		monitors: make(map[string]*fileMonitor),
-		client:   client,
+		dir:        filepath.Clean(dir),
+		posDir:     posDir,
+		handler:    handler,
+		quit:       make(chan struct{}),
+		monitors:   make(map[string]*fileMonitor),
+		client:     client,
+		targets:    make(map[string]string),
+		targetDirs: make(map[string]int),
+		podDirs:    make(map[string]bool),
+		missing:    make(map[string]time.Time),
+		pending:    make(map[string]time.Time),
 	}, nil
 }
 
@@ -254,62 +498,320 @@ func (s *kubernetesLogStreamer) stop() {
 	s.quit <- struct{}{}
 }
 
-func (s *kubernetesLogStreamer) watchOnce() {
-	for id, m := range s.monitors {
-		_, err := os.Stat(m.path)
-		if err != nil && os.IsNotExist(err) {
-			m.stop()
-			delete(s.monitors, id)
-		}
+// startWatcher watches the log directory for created and removed files.
+func (s *kubernetesLogStreamer) startWatcher() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
 	}
+	err = watcher.WatchFlags(s.dir, kubeLogWatchFlags)
+	if err != nil {
+		s.closeWatcher(watcher)
+		return err
+	}
+	s.watcher = watcher
+	return nil
+}
+
+func (s *kubernetesLogStreamer) closeWatcher(watcher *fsnotify.Watcher) {
+	watcher.Close()
+	// Pending events are discarded so the watcher goroutines can finish.
+	go func() {
+		for range watcher.Event {
+		}
+	}()
+	go func() {
+		for range watcher.Error {
+		}
+	}()
+}
+
+// watchOnce syncs the monitors with the files in the log directory.
+func (s *kubernetesLogStreamer) watchOnce() {
+	s.removeMissing()
+	s.watchPodDirs()
 	files, err := filepath.Glob(filepath.Join(s.dir, "*.log"))
 	if err != nil {
 		bslog.Errorf("unable to list files in directory: %s", err)
 	}
+	if s.pods != nil {
+		podFiles, err := filepath.Glob(filepath.Join(s.dir, "*", "*", "*.log"))
+		if err != nil {
+			bslog.Errorf("unable to list files in directory: %s", err)
+		}
+		files = append(files, podFiles...)
+	}
+	existing := make(map[string]bool, len(files))
 	for _, f := range files {
-		fileName := filepath.Base(f)
-		entry := logEntryFromName(fileName)
-		if entry.containerName == podContainerName ||
-			entry.namespace == kubeSystemNamespace {
+		existing[f] = true
+	}
+	for f := range s.targets {
+		if !existing[f] {
+			s.unwatchTarget(f)
+		}
+	}
+	for f := range s.pending {
+		if !existing[f] {
+			delete(s.pending, f)
+		}
+	}
+	for _, f := range files {
+		s.addFile(f)
+	}
+}
+
+// removeMissing removes the monitors of files that no longer exist. Files are
+// missing for a moment while they're rotated, so a monitor is only removed
+// after its tailer read everything that was left and the file is still
+// missing kubeLogRemoveDelay after it was first noticed.
+func (s *kubernetesLogStreamer) removeMissing() {
+	now := time.Now()
+	for path, m := range s.monitors {
+		_, err := os.Stat(m.path)
+		if err == nil || !os.IsNotExist(err) {
+			delete(s.missing, path)
 			continue
 		}
-		_, err = s.client.GetAppContainer(entry.containerID, true)
+		since, ok := s.missing[path]
+		if !ok {
+			s.missing[path] = now
+			continue
+		}
+		if !m.alive() || (m.tailer.fileGone() && now.Sub(since) >= kubeLogRemoveDelay) {
+			s.removeMonitor(path)
+		}
+	}
+}
+
+// watchPodDirs watches the pod and container directories in the log
+// directory, used in the /var/log/pods layout.
+func (s *kubernetesLogStreamer) watchPodDirs() {
+	if s.watcher == nil || s.pods == nil {
+		return
+	}
+	dirs, _ := filepath.Glob(filepath.Join(s.dir, "*"))
+	containerDirs, _ := filepath.Glob(filepath.Join(s.dir, "*", "*"))
+	existing := make(map[string]bool)
+	for _, dir := range append(dirs, containerDirs...) {
+		info, err := os.Lstat(dir)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		existing[dir] = true
+		if s.podDirs[dir] {
+			continue
+		}
+		err = s.watcher.WatchFlags(dir, kubeLogWatchFlags)
 		if err != nil {
-			if err != container.ErrTsuruVariablesNotFound {
-				bslog.Errorf("unable to get container info for %q: %s", f, err)
-			}
+			bslog.Errorf("unable to watch directory %q: %s", dir, err)
 			continue
 		}
-		m := s.monitors[entry.containerID]
-		if m != nil && !m.alive() {
-			m = nil
+		s.podDirs[dir] = true
+	}
+	for dir := range s.podDirs {
+		if !existing[dir] {
+			delete(s.podDirs, dir)
+			s.watcher.RemoveWatch(dir)
 		}
-		if m == nil {
-			m, err = newFileMonitor(s.handler, f, entry.containerID)
-			if err != nil {
-				bslog.Errorf("unable to create file monitor for %q: %s", f, err)
-				continue
-			}
-			if s.posDir != "" {
-				m.posFile = filepath.Join(s.posDir, fileName+".tsurubs.pos")
+	}
+}
+
+// handleEvent starts monitoring files created in the log directory and marks
+// removed ones as missing, their monitors are removed by a later sync. Other
+// changes, to pod directories or to directories of symlink targets, trigger
+// a sync.
+func (s *kubernetesLogStreamer) handleEvent(ev *fsnotify.FileEvent) {
+	if filepath.Dir(ev.Name) == s.dir {
+		if match, _ := filepath.Match("*.log", filepath.Base(ev.Name)); match {
+			if ev.IsCreate() {
+				s.addFile(ev.Name)
+				return
 			}
-			err = m.start()
-			if err != nil {
-				bslog.Errorf("unable to run file monitor for %q: %s", f, err)
-				continue
+			s.unwatchTarget(ev.Name)
+			if _, ok := s.missing[ev.Name]; !ok && s.monitors[ev.Name] != nil {
+				s.missing[ev.Name] = time.Now()
 			}
-			s.monitors[entry.containerID] = m
-			m.run()
+			return
+		}
+		if info, err := os.Lstat(ev.Name); err != nil || !info.IsDir() {
+			return
+		}
+	}
+	s.watchOnce()
+}
+
+// addFile starts monitoring f, unless it's already monitored or it's not the
+// log file of a tsuru container. Containers are found in the pods source,
+// when it's set, or in docker.
+func (s *kubernetesLogStreamer) addFile(f string) {
+	entry := logEntryFromPath(s.dir, f)
+	if entry.containerName == podContainerName ||
+		entry.namespace == kubeSystemNamespace {
+		return
+	}
+	m := s.monitors[f]
+	if m != nil && m.alive() {
+		return
+	}
+	s.watchTarget(f)
+	var info *container.Container
+	var err error
+	if s.pods != nil {
+		info, err = s.pods.containerInfo(entry)
+	} else {
+		_, err = s.client.GetAppContainer(entry.containerID, true)
+	}
+	if err == errPodNotFound {
+		// The pod may not be listed yet, the file is tried again by
+		// retryPending.
+		if _, ok := s.pending[f]; !ok {
+			s.pending[f] = time.Now()
+		}
+		return
+	}
+	delete(s.pending, f)
+	if err != nil {
+		if err != container.ErrTsuruVariablesNotFound {
+			bslog.Errorf("unable to get container info for %q: %s", f, err)
 		}
+		return
+	}
+	containerID := entry.containerID
+	if info != nil {
+		containerID = info.ID
 	}
+	m, err = newFileMonitor(s.handler, f, containerID)
+	if err != nil {
+		bslog.Errorf("unable to create file monitor for %q: %s", f, err)
+		return
+	}
+	m.info = info
+	if s.posDir != "" {
+		rel, err := filepath.Rel(s.dir, f)
+		if err != nil {
+			rel = filepath.Base(f)
+		}
+		posName := strings.Replace(filepath.ToSlash(rel), "/", "_", -1)
+		m.posFile = filepath.Join(s.posDir, posName+".tsurubs.pos")
+	}
+	err = m.start()
+	if err != nil {
+		bslog.Errorf("unable to run file monitor for %q: %s", f, err)
+		return
+	}
+	s.monitors[f] = m
+	m.run()
 }
 
+// retryPending adds the files whose pods weren't found, it's called once the
+// pods can be listed again. Files are retried for kubeLogResyncInterval, after
+// that they're only tried again by the periodic sync.
+func (s *kubernetesLogStreamer) retryPending() {
+	for f, since := range s.pending {
+		if time.Since(since) < kubeLogResyncInterval {
+			s.addFile(f)
+		}
+	}
+}
+
+func (s *kubernetesLogStreamer) hasPending() bool {
+	for _, since := range s.pending {
+		if time.Since(since) < kubeLogResyncInterval {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *kubernetesLogStreamer) removeMonitor(path string) {
+	s.monitors[path].stop()
+	delete(s.monitors, path)
+	delete(s.missing, path)
+}
+
+// watchTarget watches the directory of the file f links to, if it's a
+// symlink, so the creation of its target is noticed.
+func (s *kubernetesLogStreamer) watchTarget(f string) {
+	if s.watcher == nil {
+		return
+	}
+	if _, ok := s.targets[f]; ok {
+		return
+	}
+	target, err := os.Readlink(f)
+	if err != nil {
+		return
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(s.dir, target)
+	}
+	dir := filepath.Dir(target)
+	if s.targetDirs[dir] == 0 {
+		err = s.watcher.WatchFlags(dir, kubeLogWatchFlags)
+		if err != nil {
+			bslog.Errorf("unable to watch directory %q of log file %q: %s", dir, f, err)
+			return
+		}
+	}
+	s.targets[f] = dir
+	s.targetDirs[dir]++
+}
+
+func (s *kubernetesLogStreamer) unwatchTarget(f string) {
+	dir, ok := s.targets[f]
+	if !ok {
+		return
+	}
+	delete(s.targets, f)
+	s.targetDirs[dir]--
+	if s.targetDirs[dir] == 0 {
+		delete(s.targetDirs, dir)
+		s.watcher.RemoveWatch(dir)
+	}
+}
+
+// watch monitors the log files, syncing them when files are created or
+// removed in the log directory and every kubeLogResyncInterval. The
+// directory is polled every second if it can't be watched. Files whose pods
+// weren't found are tried again every kubePodsRefreshInterval.
 func (s *kubernetesLogStreamer) watch() {
+	resyncInterval := kubeLogResyncInterval
+	var events <-chan *fsnotify.FileEvent
+	var errs <-chan error
+	err := s.startWatcher()
+	if err == nil {
+		events, errs = s.watcher.Event, s.watcher.Error
+	} else {
+		bslog.Errorf("unable to watch directory %q, polling it instead: %s", s.dir, err)
+		resyncInterval = time.Second
+	}
+	s.watchOnce()
+	resync := time.After(resyncInterval)
+	var retry <-chan time.Time
 	for {
-		s.watchOnce()
+		if retry == nil && s.hasPending() {
+			retry = time.After(kubePodsRefreshInterval)
+		}
 		select {
-		case <-time.After(time.Second):
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			s.handleEvent(ev)
+		case err := <-errs:
+			bslog.Errorf("error watching directory %q: %s", s.dir, err)
+		case <-resync:
+			s.watchOnce()
+			resync = time.After(resyncInterval)
+		case <-retry:
+			retry = nil
+			s.retryPending()
 		case <-s.quit:
+			if s.watcher != nil {
+				s.closeWatcher(s.watcher)
+				s.watcher = nil
+			}
 			for _, m := range s.monitors {
 				m.stop()
 				m.wait()
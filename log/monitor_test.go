@@ -5,10 +5,14 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
@@ -83,9 +87,9 @@ func (s *S) TestFileMonitorRun(c *check.C) {
 	defer stopWaitTimeout(c, m)
 	ts0, _ := time.Parse(time.RFC3339, "2017-03-21T21:28:22Z")
 	expectedMessages := []rawLogParts{
-		{content: []byte("msg1"), ts: ts0, container: []byte("cont1"), priority: []byte("27")},
-		{content: []byte("msg2"), ts: ts0.Add(10 * time.Second), container: []byte("cont1"), priority: []byte("30")},
-		{content: []byte("msg3"), ts: ts0.Add(20 * time.Second), container: []byte("cont1"), priority: []byte("27")},
+		{content: []byte("msg1"), ts: ts0, container: []byte("cont1"), priority: []byte("27"), stream: "stderr"},
+		{content: []byte("msg2"), ts: ts0.Add(10 * time.Second), container: []byte("cont1"), priority: []byte("30"), stream: "stdout"},
+		{content: []byte("msg3"), ts: ts0.Add(20 * time.Second), container: []byte("cont1"), priority: []byte("27"), stream: "stderr"},
 	}
 	for _, expected := range expectedMessages {
 		parts := partsTimeout(c, th.parts)
@@ -106,9 +110,9 @@ func (s *S) TestFileMonitorRunOnTruncate(c *check.C) {
 	defer stopWaitTimeout(c, m)
 	ts0, _ := time.Parse(time.RFC3339, "2017-03-21T21:28:22Z")
 	expectedMessages := []rawLogParts{
-		{content: []byte("msg1"), ts: ts0, container: []byte("cont1"), priority: []byte("27")},
-		{content: []byte("msg2"), ts: ts0.Add(10 * time.Second), container: []byte("cont1"), priority: []byte("30")},
-		{content: []byte("msg3"), ts: ts0.Add(20 * time.Second), container: []byte("cont1"), priority: []byte("27")},
+		{content: []byte("msg1"), ts: ts0, container: []byte("cont1"), priority: []byte("27"), stream: "stderr"},
+		{content: []byte("msg2"), ts: ts0.Add(10 * time.Second), container: []byte("cont1"), priority: []byte("30"), stream: "stdout"},
+		{content: []byte("msg3"), ts: ts0.Add(20 * time.Second), container: []byte("cont1"), priority: []byte("27"), stream: "stderr"},
 	}
 	for _, expected := range expectedMessages {
 		parts := partsTimeout(c, th.parts)
@@ -119,7 +123,7 @@ func (s *S) TestFileMonitorRunOnTruncate(c *check.C) {
 		c.Assert(err, check.IsNil)
 	}
 	expectedMessages = []rawLogParts{
-		{content: []byte("msg-single"), ts: ts0.Add(30 * time.Second), container: []byte("cont1"), priority: []byte("27")},
+		{content: []byte("msg-single"), ts: ts0.Add(30 * time.Second), container: []byte("cont1"), priority: []byte("27"), stream: "stderr"},
 	}
 	for _, expected := range expectedMessages {
 		parts := partsTimeout(c, th.parts)
@@ -145,9 +149,9 @@ func (s *S) TestFileMonitorRunRestartShouldNotRepeatLines(c *check.C) {
 	}()
 	ts0, _ := time.Parse(time.RFC3339, "2017-03-21T21:28:22Z")
 	expectedMessages := []rawLogParts{
-		{content: []byte("msg1"), ts: ts0, container: []byte("cont1"), priority: []byte("27")},
-		{content: []byte("msg2"), ts: ts0.Add(10 * time.Second), container: []byte("cont1"), priority: []byte("30")},
-		{content: []byte("msg3"), ts: ts0.Add(20 * time.Second), container: []byte("cont1"), priority: []byte("27")},
+		{content: []byte("msg1"), ts: ts0, container: []byte("cont1"), priority: []byte("27"), stream: "stderr"},
+		{content: []byte("msg2"), ts: ts0.Add(10 * time.Second), container: []byte("cont1"), priority: []byte("30"), stream: "stdout"},
+		{content: []byte("msg3"), ts: ts0.Add(20 * time.Second), container: []byte("cont1"), priority: []byte("27"), stream: "stderr"},
 	}
 	for _, expected := range expectedMessages {
 		parts := partsTimeout(c, th.parts)
@@ -182,9 +186,146 @@ func (s *S) TestFileMonitorRunRestartShouldNotRepeatLines(c *check.C) {
 		ts:        ts0.Add(30 * time.Second),
 		container: []byte("cont1"),
 		priority:  []byte("27"),
+		stream:    "stderr",
 	})
 }
 
+func (s *S) TestFileMonitorResumeFromPosition(c *check.C) {
+	fName := withTempFile(c)
+	defer os.Remove(fName)
+	info, err := os.Stat(fName)
+	c.Assert(err, check.IsNil)
+	ts0, _ := time.Parse(time.RFC3339, "2017-03-21T21:28:22Z")
+	expectedMsg2 := &rawLogParts{content: []byte("msg2"), ts: ts0.Add(10 * time.Second), container: []byte("cont1"), priority: []byte("30"), stream: "stdout"}
+	expectedMsg3 := &rawLogParts{content: []byte("msg3"), ts: ts0.Add(20 * time.Second), container: []byte("cont1"), priority: []byte("27"), stream: "stderr"}
+	tests := []struct {
+		pos      string
+		expected []*rawLogParts
+	}{
+		{
+			// Lines after the offset are read even if they have an older
+			// timestamp.
+			pos: fmt.Sprintf(`{"inode":%d,"offset":%d,"time":%d}`,
+				fileInode(info), strings.Index(logEntries, `{"log":"msg2`), ts0.Add(20*time.Second).UnixNano()),
+			expected: []*rawLogParts{expectedMsg2, expectedMsg3},
+		},
+		{
+			pos: fmt.Sprintf(`{"inode":%d,"offset":%d,"time":%d}`,
+				fileInode(info)+1, len(logEntries), ts0.Add(10*time.Second).UnixNano()),
+			expected: []*rawLogParts{expectedMsg3},
+		},
+		{
+			pos:      strconv.FormatInt(ts0.Add(10*time.Second).UnixNano(), 10),
+			expected: []*rawLogParts{expectedMsg3},
+		},
+	}
+	for i, tt := range tests {
+		err = ioutil.WriteFile(fName+".pos", []byte(tt.pos), 0600)
+		c.Assert(err, check.IsNil)
+		th := &testHandler{parts: make(chan format.LogParts, 10)}
+		m, err := newFileMonitor(th, fName, "cont1")
+		c.Assert(err, check.IsNil)
+		m.posFile = fName + ".pos"
+		err = m.start()
+		c.Assert(err, check.IsNil)
+		m.run()
+		for _, expected := range tt.expected {
+			parts := partsTimeout(c, th.parts)
+			c.Check(parts["parts"], check.DeepEquals, expected, check.Commentf("test %d", i))
+		}
+		stopWaitTimeout(c, m)
+		c.Check(th.parts, check.HasLen, 0, check.Commentf("test %d", i))
+		data, err := ioutil.ReadFile(fName + ".pos")
+		c.Assert(err, check.IsNil)
+		c.Check(string(data), check.Equals, fmt.Sprintf(`{"inode":%d,"offset":%d,"time":%d}`,
+			fileInode(info), len(logEntries), expectedMsg3.ts.UnixNano()), check.Commentf("test %d", i))
+	}
+	os.Remove(fName + ".pos")
+}
+
+func (s *S) TestWritePosFile(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-pos")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log.tsurubs.pos")
+	err = writePosFile(path, filePosition{Inode: 1, Offset: 2, Time: 3})
+	c.Assert(err, check.IsNil)
+	err = writePosFile(path, filePosition{Inode: 4, Offset: 5, Time: 6})
+	c.Assert(err, check.IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, `{"inode":4,"offset":5,"time":6}`)
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.HasLen, 1)
+}
+
+func (s *S) TestFileMonitorRunCRIFormat(c *check.C) {
+	fName := withTempFile(c)
+	defer os.Remove(fName)
+	err := ioutil.WriteFile(fName, []byte(`2017-03-21T21:28:22.5Z stderr F msg1
+2017-03-21T21:28:32Z stdout P part1 
+2017-03-21T21:28:33Z stderr F msg2
+invalid line
+2017-03-21T21:28:34Z stdout P part2
+2017-03-21T21:28:35Z stdout F:x  part3
+2017-03-21T21:28:36Z stdout F
+2017-03-21T21:28:37Z stdout P pending
+`), 0600)
+	c.Assert(err, check.IsNil)
+	th := &testHandler{parts: make(chan format.LogParts, 10)}
+	m, err := newFileMonitor(th, fName, "cont1")
+	c.Assert(err, check.IsNil)
+	err = m.start()
+	c.Assert(err, check.IsNil)
+	m.run()
+	ts0, _ := time.Parse(time.RFC3339, "2017-03-21T21:28:22Z")
+	expectedMessages := []rawLogParts{
+		{content: []byte("msg1"), ts: ts0.Add(500 * time.Millisecond), container: []byte("cont1"), priority: []byte("27"), stream: "stderr"},
+		{content: []byte("msg2"), ts: ts0.Add(11 * time.Second), container: []byte("cont1"), priority: []byte("27"), stream: "stderr"},
+		{content: []byte("part1 part2 part3"), ts: ts0.Add(10 * time.Second), container: []byte("cont1"), priority: []byte("30"), stream: "stdout"},
+		{ts: ts0.Add(14 * time.Second), container: []byte("cont1"), priority: []byte("30"), stream: "stdout"},
+	}
+	for _, expected := range expectedMessages {
+		parts := partsTimeout(c, th.parts)
+		c.Check(parts["parts"], check.DeepEquals, &expected)
+	}
+	stopWaitTimeout(c, m)
+	c.Assert(th.parts, check.HasLen, 0)
+	data, err := ioutil.ReadFile(fName)
+	c.Assert(err, check.IsNil)
+	_, offset := m.tailer.position()
+	c.Assert(m.position().Offset, check.Equals, int64(bytes.Index(data, []byte("2017-03-21T21:28:37Z"))))
+	c.Assert(offset, check.Equals, int64(len(data)))
+}
+
+func (s *S) TestParseCRILine(c *check.C) {
+	ts, _ := time.Parse(time.RFC3339Nano, "2016-10-06T00:17:09.669794202Z")
+	tests := []struct {
+		line     string
+		expected logLine
+		partial  bool
+		err      string
+	}{
+		{line: "2016-10-06T00:17:09.669794202Z stdout F log content", expected: logLine{Log: rawByte("log content"), Stream: "stdout", Time: ts}},
+		{line: "2016-10-06T00:17:09.669794202Z stderr P log", expected: logLine{Log: rawByte("log"), Stream: "stderr", Time: ts}, partial: true},
+		{line: "2016-10-06T00:17:09.669794202Z stdout F", expected: logLine{Stream: "stdout", Time: ts}},
+		{line: "2016-10-06T00:17:09.669794202Z stdout X log", err: "invalid CRI log line"},
+		{line: "2016-10-06T00:17:09.669794202Z stdout", err: "invalid CRI log line"},
+		{line: "2016-10-06 stdout F log", err: `parsing time .*`},
+	}
+	for i, tt := range tests {
+		lineData, partial, err := parseCRILine([]byte(tt.line))
+		if tt.err != "" {
+			c.Check(err, check.ErrorMatches, tt.err, check.Commentf("test %d", i))
+			continue
+		}
+		c.Check(err, check.IsNil, check.Commentf("test %d", i))
+		c.Check(lineData, check.DeepEquals, tt.expected, check.Commentf("test %d", i))
+		c.Check(partial, check.Equals, tt.partial, check.Commentf("test %d", i))
+	}
+}
+
 func (s *S) TestFileMonitorAlive(c *check.C) {
 	fName := withTempFile(c)
 	defer os.Remove(fName)
@@ -195,7 +336,7 @@ func (s *S) TestFileMonitorAlive(c *check.C) {
 	c.Assert(err, check.IsNil)
 	m.run()
 	defer stopWaitTimeout(c, m)
-	m.cmd.Process.Kill()
+	m.stop()
 	for {
 		if !m.alive() {
 			break
@@ -274,6 +415,46 @@ func (s *S) TestLogEntryFromName(c *check.C) {
 	}
 }
 
+func (s *S) TestLogEntryFromPath(c *check.C) {
+	tests := []struct {
+		in  string
+		out logFileEntry
+	}{
+		{
+			in: "/var/log/pods/default_myapp-web-2453793373-cbk0k_6f2d9a80-0e2b-11e7-9e4a-0800270a1b2c/myapp-web/0.log",
+			out: logFileEntry{
+				podName:       "myapp-web-2453793373-cbk0k",
+				namespace:     "default",
+				podUID:        "6f2d9a80-0e2b-11e7-9e4a-0800270a1b2c",
+				containerName: "myapp-web",
+				restart:       "0",
+			},
+		},
+		{
+			in: "/var/log/pods/kube-system_coredns-1_8b2c3d4e/coredns/12.log",
+			out: logFileEntry{
+				podName:       "coredns-1",
+				namespace:     "kube-system",
+				podUID:        "8b2c3d4e",
+				containerName: "coredns",
+				restart:       "12",
+			},
+		},
+		{
+			in: "/var/log/pods/myapp-web-2453793373-cbk0k_default_myapp-web-e50ac4567691092729a360a3a8fdc9741e81030dd3f8e90633c71cba88e32f6b.log",
+			out: logFileEntry{
+				podName:       "myapp-web-2453793373-cbk0k",
+				namespace:     "default",
+				containerName: "myapp-web",
+				containerID:   "e50ac4567691092729a360a3a8fdc9741e81030dd3f8e90633c71cba88e32f6b",
+			},
+		},
+	}
+	for i, tt := range tests {
+		c.Assert(logEntryFromPath("/var/log/pods", tt.in), check.DeepEquals, tt.out, check.Commentf("test %d", i))
+	}
+}
+
 func serverWithClient(c *check.C) (*dTesting.DockerServer, *container.InfoClient) {
 	dockerServer, err := dTesting.NewServer("127.0.0.1:0", nil, nil)
 	c.Assert(err, check.IsNil)
@@ -319,6 +500,7 @@ func (s *S) TestKubernetesLogStreamerWatch(c *check.C) {
 		ts:        ts0,
 		container: []byte("e50ac4567691092729a360a3a8fdc9741e81030dd3f8e90633c71cba88e32f6b"),
 		priority:  []byte("27"),
+		stream:    "stderr",
 	})
 }
 
@@ -344,6 +526,7 @@ func (s *S) TestKubernetesLogStreamerWatchCreatesPosDir(c *check.C) {
 		ts:        ts0,
 		container: []byte("e50ac4567691092729a360a3a8fdc9741e81030dd3f8e90633c71cba88e32f6b"),
 		priority:  []byte("27"),
+		stream:    "stderr",
 	})
 	var data []byte
 	for {
@@ -357,7 +540,16 @@ func (s *S) TestKubernetesLogStreamerWatchCreatesPosDir(c *check.C) {
 			c.Fatal("timeout waiting for pos file")
 		}
 	}
-	c.Assert(string(data), check.Equals, strconv.FormatInt(ts0.UnixNano(), 10))
+	var pos filePosition
+	err = json.Unmarshal(data, &pos)
+	c.Assert(err, check.IsNil)
+	info, err := os.Stat(name)
+	c.Assert(err, check.IsNil)
+	c.Assert(pos, check.DeepEquals, filePosition{
+		Inode:  fileInode(info),
+		Offset: int64(len(singleEntry)),
+		Time:   ts0.UnixNano(),
+	})
 }
 
 func (s *S) TestKubernetesLogStreamerWatchNotTsuruContainer(c *check.C) {
@@ -426,10 +618,13 @@ func (s *S) TestKubernetesLogStreamerWatchIgnoredFiles(c *check.C) {
 		ts:        ts0,
 		container: []byte("contID3"),
 		priority:  []byte("27"),
+		stream:    "stderr",
 	})
 }
 
 func (s *S) TestKubernetesLogStreamerWatchKilledWatcher(c *check.C) {
+	kubeLogResyncInterval = 100 * time.Millisecond
+	defer func() { kubeLogResyncInterval = time.Minute }()
 	dirName, err := ioutil.TempDir("", "bs-kube-log")
 	c.Assert(err, check.IsNil)
 	defer os.RemoveAll(dirName)
@@ -450,16 +645,17 @@ func (s *S) TestKubernetesLogStreamerWatchKilledWatcher(c *check.C) {
 		ts:        ts0,
 		container: []byte("e50ac4567691092729a360a3a8fdc9741e81030dd3f8e90633c71cba88e32f6b"),
 		priority:  []byte("27"),
+		stream:    "stderr",
 	})
-	streamer.monitors["e50ac4567691092729a360a3a8fdc9741e81030dd3f8e90633c71cba88e32f6b"].stop()
-	err = ioutil.WriteFile(name, []byte(singleEntry), 0600)
-	c.Assert(err, check.IsNil)
+	streamer.monitors[name].stop()
+	appendFile(c, name, `{"log":"msg-restarted\n","stream":"stdout","time":"2017-03-21T21:29:02.0Z"}`+"\n")
 	parts = partsTimeout(c, th.parts)
 	c.Check(parts["parts"], check.DeepEquals, &rawLogParts{
-		content:   []byte("msg-single"),
-		ts:        ts0,
+		content:   []byte("msg-restarted"),
+		ts:        ts0.Add(10 * time.Second),
 		container: []byte("e50ac4567691092729a360a3a8fdc9741e81030dd3f8e90633c71cba88e32f6b"),
-		priority:  []byte("27"),
+		priority:  []byte("30"),
+		stream:    "stdout",
 	})
 }
 
@@ -483,11 +679,140 @@ func (s *S) TestKubernetesLogStreamerWatchRemoveOld(c *check.C) {
 		ts:        ts0,
 		container: []byte("e50ac4567691092729a360a3a8fdc9741e81030dd3f8e90633c71cba88e32f6b"),
 		priority:  []byte("27"),
+		stream:    "stderr",
 	})
+	kubeLogRemoveDelay = 0
+	defer func() { kubeLogRemoveDelay = 10 * time.Second }()
 	err = os.Remove(name)
 	c.Assert(err, check.IsNil)
 	streamer.watchOnce()
-	c.Assert(streamer.monitors, check.HasLen, 0)
+	c.Assert(streamer.monitors, check.HasLen, 1)
+	timeout := time.After(5 * time.Second)
+	for len(streamer.monitors) > 0 {
+		select {
+		case <-time.After(10 * time.Millisecond):
+			streamer.watchOnce()
+		case <-timeout:
+			c.Fatal("timeout waiting for monitor to be removed")
+		}
+	}
+}
+
+func (s *S) TestKubernetesLogStreamerWatchSymlinkTarget(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-kube-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	targetDir, err := ioutil.TempDir("", "bs-kube-log-target")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(targetDir)
+	srv, cli := serverWithClient(c)
+	defer srv.Stop()
+	name := filepath.Join(dirName, "myapp-web-2453793373-cbk0k_default_myapp-web-e50ac4567691092729a360a3a8fdc9741e81030dd3f8e90633c71cba88e32f6b.log")
+	target := filepath.Join(targetDir, "0.log")
+	err = os.Symlink(target, name)
+	c.Assert(err, check.IsNil)
+	th := &testHandler{parts: make(chan format.LogParts)}
+	streamer, err := newKubeLogStreamer(th, cli, dirName, "")
+	c.Assert(err, check.IsNil)
+	go streamer.watch()
+	defer streamer.stop()
+	time.Sleep(100 * time.Millisecond)
+	err = ioutil.WriteFile(target, []byte(singleEntry), 0600)
+	c.Assert(err, check.IsNil)
+	parts := partsTimeout(c, th.parts)
+	ts0, _ := time.Parse(time.RFC3339, "2017-03-21T21:28:52Z")
+	c.Check(parts["parts"], check.DeepEquals, &rawLogParts{
+		content:   []byte("msg-single"),
+		ts:        ts0,
+		container: []byte("e50ac4567691092729a360a3a8fdc9741e81030dd3f8e90633c71cba88e32f6b"),
+		priority:  []byte("27"),
+		stream:    "stderr",
+	})
+}
+
+func (s *S) TestKubernetesLogStreamerHandleEvents(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-kube-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	targetDir, err := ioutil.TempDir("", "bs-kube-log-target")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(targetDir)
+	srv, cli := serverWithClient(c)
+	defer srv.Stop()
+	th := &testHandler{parts: make(chan format.LogParts, 10)}
+	streamer, err := newKubeLogStreamer(th, cli, dirName, "")
+	c.Assert(err, check.IsNil)
+	err = streamer.startWatcher()
+	c.Assert(err, check.IsNil)
+	defer streamer.closeWatcher(streamer.watcher)
+	handleEvents := func(done func() bool) {
+		timeout := time.After(5 * time.Second)
+		for !done() {
+			select {
+			case ev := <-streamer.watcher.Event:
+				streamer.handleEvent(ev)
+			case <-timeout:
+				c.Fatal("timeout waiting for events")
+			}
+		}
+	}
+	target := filepath.Join(targetDir, "0.log")
+	err = ioutil.WriteFile(target, []byte(singleEntry), 0600)
+	c.Assert(err, check.IsNil)
+	name := filepath.Join(dirName, "pod3_default_contName2-contID3.log")
+	err = os.Symlink(target, name)
+	c.Assert(err, check.IsNil)
+	handleEvents(func() bool { return len(streamer.monitors) == 1 })
+	partsTimeout(c, th.parts)
+	c.Assert(streamer.targets, check.DeepEquals, map[string]string{name: targetDir})
+	c.Assert(streamer.targetDirs, check.DeepEquals, map[string]int{targetDir: 1})
+	kubeLogRemoveDelay = 0
+	defer func() { kubeLogRemoveDelay = 10 * time.Second }()
+	err = os.Remove(name)
+	c.Assert(err, check.IsNil)
+	handleEvents(func() bool { return !streamer.missing[name].IsZero() })
+	c.Assert(streamer.monitors, check.HasLen, 1)
+	c.Assert(streamer.targets, check.HasLen, 0)
+	c.Assert(streamer.targetDirs, check.HasLen, 0)
+	timeout := time.After(5 * time.Second)
+	for len(streamer.monitors) > 0 {
+		select {
+		case <-time.After(10 * time.Millisecond):
+			streamer.watchOnce()
+		case <-timeout:
+			c.Fatal("timeout waiting for monitor to be removed")
+		}
+	}
+	c.Assert(streamer.missing, check.HasLen, 0)
+}
+
+func (s *S) TestKubernetesLogStreamerWatchRenamed(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-kube-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	srv, cli := serverWithClient(c)
+	defer srv.Stop()
+	th := &testHandler{parts: make(chan format.LogParts)}
+	streamer, err := newKubeLogStreamer(th, cli, dirName, dirName+"/posdir")
+	c.Assert(err, check.IsNil)
+	name := filepath.Join(dirName, "myapp-web-2453793373-cbk0k_default_myapp-web-e50ac4567691092729a360a3a8fdc9741e81030dd3f8e90633c71cba88e32f6b.log")
+	err = ioutil.WriteFile(name, []byte(`{"log":"msg-1\n","stream":"stdout","time":"2017-03-21T21:28:52Z"}`+"\n"), 0600)
+	c.Assert(err, check.IsNil)
+	go streamer.watch()
+	defer streamer.stop()
+	parts := partsTimeout(c, th.parts)
+	c.Check(string(parts["parts"].(*rawLogParts).content), check.Equals, "msg-1")
+	err = os.Rename(name, name+".1")
+	c.Assert(err, check.IsNil)
+	time.Sleep(100 * time.Millisecond)
+	appendFile(c, name+".1", `{"log":"msg-2\n","stream":"stdout","time":"2017-03-21T21:28:53Z"}`+"\n")
+	time.Sleep(100 * time.Millisecond)
+	err = ioutil.WriteFile(name, []byte(`{"log":"msg-3\n","stream":"stdout","time":"2017-03-21T21:28:54Z"}`+"\n"), 0600)
+	c.Assert(err, check.IsNil)
+	parts = partsTimeout(c, th.parts)
+	c.Check(string(parts["parts"].(*rawLogParts).content), check.Equals, "msg-2")
+	parts = partsTimeout(c, th.parts)
+	c.Check(string(parts["parts"].(*rawLogParts).content), check.Equals, "msg-3")
 }
 
 func (s *S) TestKubernetesLogStreamerDirNotFound(c *check.C) {
@@ -497,3 +822,109 @@ func (s *S) TestKubernetesLogStreamerDirNotFound(c *check.C) {
 	_, err := newKubeLogStreamer(th, cli, "/some/invalid/path", "")
 	c.Assert(err, check.Equals, errNoLogDirectory)
 }
+
+func (s *S) TestKubernetesLogStreamerWatchPodsLayout(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-kube-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	podsFile, cleanup := writePodList(c)
+	defer cleanup()
+	os.Setenv("LOG_KUBERNETES_PODS_URL", "file://"+podsFile)
+	pods, err := newKubePodsSource()
+	c.Assert(err, check.IsNil)
+	th := &testHandler{parts: make(chan format.LogParts)}
+	streamer, err := newKubeLogStreamer(th, nil, dirName, dirName+"/posdir")
+	c.Assert(err, check.IsNil)
+	streamer.pods = pods
+	go streamer.watch()
+	defer streamer.stop()
+	time.Sleep(100 * time.Millisecond)
+	otherDir := filepath.Join(dirName, "default_coredns-1_8b2c3d4e", "coredns")
+	err = os.MkdirAll(otherDir, 0700)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(otherDir, "0.log"), []byte("2017-03-21T21:28:52Z stdout F msg-dns\n"), 0600)
+	c.Assert(err, check.IsNil)
+	containerDir := filepath.Join(dirName, "default_myapp-web-2453793373-cbk0k_6f2d9a80-0e2b-11e7-9e4a-0800270a1b2c", "myapp-web")
+	err = os.MkdirAll(containerDir, 0700)
+	c.Assert(err, check.IsNil)
+	time.Sleep(100 * time.Millisecond)
+	name := filepath.Join(containerDir, "0.log")
+	err = ioutil.WriteFile(name, []byte("2017-03-21T21:28:52Z stderr F msg-single\n"), 0600)
+	c.Assert(err, check.IsNil)
+	parts := partsTimeout(c, th.parts)
+	ts0, _ := time.Parse(time.RFC3339, "2017-03-21T21:28:52Z")
+	rawParts := parts["parts"].(*rawLogParts)
+	c.Assert(rawParts.containerInfo, check.NotNil)
+	c.Assert(rawParts.containerInfo.AppName, check.Equals, "myapp")
+	c.Assert(rawParts.containerInfo.ProcessName, check.Equals, "web")
+	c.Assert(rawParts.containerInfo.ID, check.Equals, "4f8d1c2b3a")
+	rawParts.containerInfo = nil
+	c.Check(rawParts, check.DeepEquals, &rawLogParts{
+		content:   []byte("msg-single"),
+		ts:        ts0,
+		container: []byte("4f8d1c2b3a"),
+		priority:  []byte("27"),
+		stream:    "stderr",
+	})
+}
+
+func (s *S) TestKubernetesLogStreamerPodsLayoutWithoutPodsSource(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-kube-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	th := &testHandler{parts: make(chan format.LogParts, 1)}
+	streamer, err := newKubeLogStreamer(th, nil, dirName, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(streamer.hasPodDirs(), check.Equals, false)
+	containerDir := filepath.Join(dirName, "default_myapp-web-2453793373-cbk0k_6f2d9a80-0e2b-11e7-9e4a-0800270a1b2c", "myapp-web")
+	err = os.MkdirAll(containerDir, 0700)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(filepath.Join(containerDir, "0.log"), []byte("2017-03-21T21:28:52Z stdout F msg\n"), 0600)
+	c.Assert(err, check.IsNil)
+	c.Assert(streamer.hasPodDirs(), check.Equals, true)
+	streamer.watchOnce()
+	c.Assert(streamer.monitors, check.HasLen, 0)
+	c.Assert(streamer.pending, check.HasLen, 0)
+}
+
+func (s *S) TestKubernetesLogStreamerRetryPodNotFound(c *check.C) {
+	dirName, err := ioutil.TempDir("", "bs-kube-log")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dirName)
+	podsFile, cleanup := writePodList(c)
+	defer cleanup()
+	os.Setenv("LOG_KUBERNETES_PODS_URL", "file://"+podsFile)
+	pods, err := newKubePodsSource()
+	c.Assert(err, check.IsNil)
+	th := &testHandler{parts: make(chan format.LogParts)}
+	streamer, err := newKubeLogStreamer(th, nil, dirName, "")
+	c.Assert(err, check.IsNil)
+	streamer.pods = pods
+	containerDir := filepath.Join(dirName, "default_myapp-web-1_9c3d4e5f", "myapp-web")
+	err = os.MkdirAll(containerDir, 0700)
+	c.Assert(err, check.IsNil)
+	name := filepath.Join(containerDir, "0.log")
+	err = ioutil.WriteFile(name, []byte("2017-03-21T21:28:52Z stderr F msg-single\n"), 0600)
+	c.Assert(err, check.IsNil)
+	streamer.watchOnce()
+	c.Assert(streamer.monitors, check.HasLen, 0)
+	c.Assert(streamer.pending, check.HasLen, 1)
+	c.Assert(streamer.hasPending(), check.Equals, true)
+	err = ioutil.WriteFile(podsFile, []byte(`{"items":[{"metadata":{
+		"name":"myapp-web-1",
+		"namespace":"default",
+		"uid":"9c3d4e5f",
+		"labels":{"tsuru.io/app-name":"myapp","tsuru.io/app-process":"web"}
+	}}]}`), 0600)
+	c.Assert(err, check.IsNil)
+	streamer.retryPending()
+	c.Assert(streamer.monitors, check.HasLen, 0)
+	pods.lastRefresh = time.Now().Add(-kubePodsRefreshInterval)
+	streamer.retryPending()
+	c.Assert(streamer.monitors, check.HasLen, 1)
+	c.Assert(streamer.pending, check.HasLen, 0)
+	parts := partsTimeout(c, th.parts)
+	c.Assert(string(parts["parts"].(*rawLogParts).content), check.Equals, "msg-single")
+	streamer.monitors[name].stop()
+	streamer.monitors[name].wait()
+}
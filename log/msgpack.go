@@ -0,0 +1,404 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxMsgpackLength is the largest string, binary, array or map length
+// accepted when decoding.
+const maxMsgpackLength = 64 << 20
+
+// msgpackReadChunkSize is the most memory allocated for a string, binary or
+// extension value before its bytes are read.
+const msgpackReadChunkSize = 64 << 10
+
+// maxMsgpackDepth is the deepest nesting of arrays and maps accepted when
+// decoding.
+const maxMsgpackDepth = 100
+
+// eventTimeExtType is the msgpack extension type used by fluentd for
+// timestamps with nanosecond precision.
+const eventTimeExtType = 0
+
+// msgpackExt is an extension value read by msgpackDecoder.
+type msgpackExt struct {
+	typ  int8
+	data []byte
+}
+
+// msgpackDecoder reads msgpack values as nil, bool, int64, uint64 (only for
+// values larger than the int64 range), float64, string, []byte,
+// []interface{}, map[string]interface{} and msgpackExt.
+type msgpackDecoder struct {
+	r     *bufio.Reader
+	depth int
+}
+
+func newMsgpackDecoder(r io.Reader) *msgpackDecoder {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &msgpackDecoder{r: br}
+	}
+	return &msgpackDecoder{r: bufio.NewReader(r)}
+}
+
+// decode reads the next value, returning io.EOF only if no bytes were read.
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	value, err := d.decodeValue(b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return value, err
+}
+
+func (d *msgpackDecoder) decodeValue(b byte) (interface{}, error) {
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return d.decodeMap(int(b & 0x0f))
+	case b&0xf0 == 0x90:
+		return d.decodeArray(int(b & 0x0f))
+	case b&0xe0 == 0xa0:
+		return d.decodeString(int(b & 0x1f))
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readLength(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.readBytes(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.readLength(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(n)
+	case 0xca:
+		v, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.readUint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.readUint(1 << (b - 0xcc))
+		if v > math.MaxInt64 {
+			return v, err
+		}
+		return int64(v), err
+	case 0xd0:
+		v, err := d.readUint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := d.readUint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := d.readUint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := d.readUint(8)
+		return int64(v), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readLength(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(n)
+	case 0xdc, 0xdd:
+		n, err := d.readLength(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n)
+	case 0xde, 0xdf:
+		n, err := d.readLength(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n)
+	}
+	return nil, fmt.Errorf("invalid msgpack type 0x%x", b)
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	var buf [8]byte
+	_, err := io.ReadFull(d.r, buf[8-size:])
+	return binary.BigEndian.Uint64(buf[:]), err
+}
+
+func (d *msgpackDecoder) readLength(size int) (int, error) {
+	n, err := d.readUint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > maxMsgpackLength {
+		return 0, fmt.Errorf("msgpack length too large: %d", n)
+	}
+	return int(n), nil
+}
+
+// readBytes reads n bytes. Large values are read in chunks, so the memory
+// used grows with the bytes received instead of the declared length.
+func (d *msgpackDecoder) readBytes(n int) ([]byte, error) {
+	if n <= msgpackReadChunkSize {
+		data := make([]byte, n)
+		_, err := io.ReadFull(d.r, data)
+		return data, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(msgpackReadChunkSize)
+	_, err := io.CopyN(&buf, d.r, int64(n))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	data, err := d.readBytes(n)
+	return string(data), err
+}
+
+func (d *msgpackDecoder) decodeExt(n int) (interface{}, error) {
+	typ, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.readBytes(n)
+	return msgpackExt{typ: int8(typ), data: data}, err
+}
+
+// nest is called before reading the values of an array or map, the returned
+// function must be called after them.
+func (d *msgpackDecoder) nest() (func(), error) {
+	if d.depth >= maxMsgpackDepth {
+		return nil, fmt.Errorf("msgpack nesting deeper than %d", maxMsgpackDepth)
+	}
+	d.depth++
+	return func() { d.depth-- }, nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	done, err := d.nest()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	values := []interface{}{}
+	for i := 0; i < n; i++ {
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// decodeMap reads a map, keys which aren't strings are formatted as text.
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	done, err := d.nest()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	values := map[string]interface{}{}
+	for i := 0; i < n; i++ {
+		key, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case string:
+			values[k] = value
+		case []byte:
+			values[string(k)] = value
+		default:
+			values[fmt.Sprint(k)] = value
+		}
+	}
+	return values, nil
+}
+
+// appendMsgpack appends the msgpack encoding of value to data. Maps are
+// encoded with sorted keys, time.Time as fluentd event times and
+// json.Number as integers when possible. Unknown types are encoded as
+// strings.
+func appendMsgpack(data []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(data, 0xc0)
+	case bool:
+		if v {
+			return append(data, 0xc3)
+		}
+		return append(data, 0xc2)
+	case int:
+		return appendMsgpackInt(data, int64(v))
+	case int64:
+		return appendMsgpackInt(data, v)
+	case uint64:
+		if v > math.MaxInt64 {
+			return appendMsgpackUint(append(data, 0xcf), v, 8)
+		}
+		return appendMsgpackInt(data, int64(v))
+	case float64:
+		return appendMsgpackUint(append(data, 0xcb), math.Float64bits(v), 8)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(data, i)
+		}
+		if f, err := v.Float64(); err == nil {
+			return appendMsgpack(data, f)
+		}
+		return appendMsgpackString(data, v.String())
+	case string:
+		return appendMsgpackString(data, v)
+	case []byte:
+		data = appendMsgpackHeader(data, len(v), 0, 0xc4, 0xc5, 0xc6)
+		return append(data, v...)
+	case time.Time:
+		data = append(data, 0xd7, eventTimeExtType)
+		data = appendMsgpackUint(data, uint64(v.Unix()), 4)
+		return appendMsgpackUint(data, uint64(v.Nanosecond()), 4)
+	case []interface{}:
+		data = appendMsgpackHeader(data, len(v), 0x90, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			data = appendMsgpack(data, item)
+		}
+		return data
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		data = appendMsgpackHeader(data, len(v), 0x80, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			data = appendMsgpackString(data, key)
+			data = appendMsgpack(data, v[key])
+		}
+		return data
+	}
+	return appendMsgpackString(data, fmt.Sprint(value))
+}
+
+func appendMsgpackInt(data []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v <= 0x7f, v < 0 && v >= -32:
+		return append(data, byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return appendMsgpackUint(append(data, 0xd0), uint64(v), 1)
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return appendMsgpackUint(append(data, 0xd1), uint64(v), 2)
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return appendMsgpackUint(append(data, 0xd2), uint64(v), 4)
+	}
+	return appendMsgpackUint(append(data, 0xd3), uint64(v), 8)
+}
+
+func appendMsgpackString(data []byte, v string) []byte {
+	data = appendMsgpackHeader(data, len(v), 0xa0, 0xd9, 0xda, 0xdb)
+	return append(data, v...)
+}
+
+// appendMsgpackHeader appends the type and length of a value, using fix, if
+// not zero, or the 8, 16 and 32 bits length variants.
+func appendMsgpackHeader(data []byte, n int, fix, var8, var16, var32 byte) []byte {
+	fixMax := 15
+	if fix == 0xa0 {
+		fixMax = 31
+	}
+	switch {
+	case fix != 0 && n <= fixMax:
+		return append(data, fix|byte(n))
+	case var8 != 0 && n <= math.MaxUint8:
+		return appendMsgpackUint(append(data, var8), uint64(n), 1)
+	case n <= math.MaxUint16:
+		return appendMsgpackUint(append(data, var16), uint64(n), 2)
+	}
+	return appendMsgpackUint(append(data, var32), uint64(n), 4)
+}
+
+func appendMsgpackUint(data []byte, v uint64, size int) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(data, buf[8-size:]...)
+}
+
+// msgpackFieldValue converts a decoded msgpack value to a logField value,
+// numbers as json.Number and binary data as strings.
+func msgpackFieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10))
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10))
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64))
+	case []byte:
+		return string(v)
+	case msgpackExt:
+		if t, ok := eventTime(v); ok {
+			return t.Format(time.RFC3339Nano)
+		}
+		return nil
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i := range v {
+			values[i] = msgpackFieldValue(v[i])
+		}
+		return values
+	case map[string]interface{}:
+		values := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			values[key] = msgpackFieldValue(item)
+		}
+		return values
+	}
+	return value
+}
+
+// eventTime returns the time in a fluentd EventTime extension value.
+func eventTime(ext msgpackExt) (time.Time, bool) {
+	if ext.typ != eventTimeExtType || len(ext.data) != 8 {
+		return time.Time{}, false
+	}
+	sec := binary.BigEndian.Uint32(ext.data)
+	nsec := binary.BigEndian.Uint32(ext.data[4:])
+	return time.Unix(int64(sec), int64(nsec)), true
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"runtime"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestMsgpackRoundTrip(c *check.C) {
+	values := []interface{}{
+		nil, true, false,
+		int64(0), int64(127), int64(128), int64(-1), int64(-32), int64(-33), int64(-200),
+		int64(300), int64(-40000), int64(70000), int64(-3000000000), int64(math.MaxInt64), int64(math.MinInt64),
+		uint64(math.MaxUint64),
+		1.5, -0.25,
+		"", "hello", strings.Repeat("a", 31), strings.Repeat("b", 32), strings.Repeat("c", 300), strings.Repeat("d", 70000),
+		[]byte{}, []byte("bin"), bytes.Repeat([]byte("e"), 300),
+		[]interface{}{}, []interface{}{int64(1), "two", []interface{}{nil}},
+		make([]interface{}, 20),
+		map[string]interface{}{}, map[string]interface{}{"a": int64(1), "b": map[string]interface{}{"c": "d"}},
+	}
+	for _, value := range values {
+		data := appendMsgpack(nil, value)
+		decoded, err := newMsgpackDecoder(bytes.NewReader(data)).decode()
+		c.Check(err, check.IsNil, check.Commentf("value: %#v", value))
+		c.Check(decoded, check.DeepEquals, value, check.Commentf("value: %#v", value))
+	}
+}
+
+func (s *S) TestMsgpackEncode(c *check.C) {
+	tests := []struct {
+		value    interface{}
+		expected []byte
+	}{
+		{map[string]interface{}{"b": 1, "a": true}, []byte{0x82, 0xa1, 'a', 0xc3, 0xa1, 'b', 0x01}},
+		{json.Number("12"), []byte{0x0c}},
+		{json.Number("1e400"), []byte{0xa5, '1', 'e', '4', '0', '0'}},
+		{time.Unix(1433520827, 5), []byte{0xd7, 0x00, 0x55, 0x71, 0xca, 0xbb, 0x00, 0x00, 0x00, 0x05}},
+		{struct{}{}, []byte{0xa2, '{', '}'}},
+	}
+	for _, tt := range tests {
+		c.Check(appendMsgpack(nil, tt.value), check.DeepEquals, tt.expected, check.Commentf("value: %#v", tt.value))
+	}
+}
+
+func (s *S) TestMsgpackDecode(c *check.C) {
+	tests := []struct {
+		data     []byte
+		expected interface{}
+	}{
+		{[]byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, 1.5},
+		{[]byte{0xcc, 0xff}, int64(255)},
+		{[]byte{0xd0, 0xff}, int64(-1)},
+		{[]byte{0xd9, 0x02, 'h', 'i'}, "hi"},
+		{[]byte{0xd4, 0x05, 0x01}, msgpackExt{typ: 5, data: []byte{1}}},
+		{[]byte{0xc7, 0x02, 0x06, 0x01, 0x02}, msgpackExt{typ: 6, data: []byte{1, 2}}},
+		{[]byte{0x81, 0x01, 0xa1, 'x'}, map[string]interface{}{"1": "x"}},
+		{[]byte{0x81, 0xc4, 0x01, 'k', 0xc0}, map[string]interface{}{"k": nil}},
+	}
+	for _, tt := range tests {
+		value, err := newMsgpackDecoder(bytes.NewReader(tt.data)).decode()
+		c.Check(err, check.IsNil)
+		c.Check(value, check.DeepEquals, tt.expected, check.Commentf("data: %x", tt.data))
+	}
+}
+
+func (s *S) TestMsgpackDecodeInvalid(c *check.C) {
+	tests := []struct {
+		data []byte
+		err  string
+	}{
+		{[]byte{0xc1}, "invalid msgpack type 0xc1"},
+		{[]byte{0xa3, 'a'}, "unexpected EOF"},
+		{[]byte{0x92, 0x01}, "unexpected EOF"},
+		{[]byte{0xcd, 0x01}, "unexpected EOF"},
+		{[]byte{0xdb, 0xff, 0xff, 0xff, 0xff}, "msgpack length too large: 4294967295"},
+		{bytes.Repeat([]byte{0x91}, 4<<20), "msgpack nesting deeper than 100"},
+		{append(bytes.Repeat([]byte{0x81, 0xa1, 'k'}, maxMsgpackDepth), 0x90), "msgpack nesting deeper than 100"},
+	}
+	for _, tt := range tests {
+		_, err := newMsgpackDecoder(bytes.NewReader(tt.data)).decode()
+		c.Check(err, check.ErrorMatches, tt.err, check.Commentf("data: %x", tt.data))
+	}
+	_, err := newMsgpackDecoder(bytes.NewReader(nil)).decode()
+	c.Assert(err, check.Equals, io.EOF)
+	nested := append(bytes.Repeat([]byte{0x91}, maxMsgpackDepth-1), 0x90)
+	_, err = newMsgpackDecoder(bytes.NewReader(nested)).decode()
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestMsgpackDecodeLargeLength(c *check.C) {
+	value := strings.Repeat("x", 3*msgpackReadChunkSize+1)
+	decoded, err := newMsgpackDecoder(bytes.NewReader(appendMsgpack(nil, value))).decode()
+	c.Assert(err, check.IsNil)
+	c.Assert(decoded, check.Equals, value)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = newMsgpackDecoder(bytes.NewReader([]byte{0xdb, 0x03, 0xff, 0xff, 0xff, 'a'})).decode()
+	runtime.ReadMemStats(&after)
+	c.Assert(err, check.ErrorMatches, "unexpected EOF")
+	c.Assert(after.TotalAlloc-before.TotalAlloc < 16<<20, check.Equals, true)
+}
+
+func (s *S) TestMsgpackFieldValue(c *check.C) {
+	ext := msgpackExt{typ: eventTimeExtType, data: []byte{0x55, 0x71, 0xca, 0xbb, 0x00, 0x00, 0x00, 0x05}}
+	c.Assert(msgpackFieldValue(int64(-3)), check.Equals, json.Number("-3"))
+	c.Assert(msgpackFieldValue(uint64(math.MaxUint64)), check.Equals, json.Number("18446744073709551615"))
+	c.Assert(msgpackFieldValue(1.5), check.Equals, json.Number("1.5"))
+	c.Assert(msgpackFieldValue(math.Inf(1)), check.Equals, "+Inf")
+	c.Assert(msgpackFieldValue([]byte("x")), check.Equals, "x")
+	c.Assert(msgpackFieldValue(ext), check.Equals, time.Unix(1433520827, 5).Format(time.RFC3339Nano))
+	c.Assert(msgpackFieldValue(msgpackExt{typ: 1}), check.IsNil)
+	c.Assert(msgpackFieldValue([]interface{}{int64(1), map[string]interface{}{"a": []byte("b")}}), check.DeepEquals, []interface{}{
+		json.Number("1"), map[string]interface{}{"a": "b"},
+	})
+}
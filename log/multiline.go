@@ -0,0 +1,218 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/tsuru/bs/config"
+)
+
+const defaultMultilineMaxSize = 64 * 1024
+
+// multilineRule decides whether a line continues the message started by
+// previous lines. Lines matching start always begin a new message, lines
+// matching continuation are appended to the previous one, as well as any line
+// following one that matches after. When only start is set, every line not
+// matching it is a continuation.
+type multilineRule struct {
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+	after        *regexp.Regexp
+}
+
+func (r *multilineRule) continues(last, line []byte) bool {
+	if r.start != nil && r.start.Match(line) {
+		return false
+	}
+	if r.after != nil && r.after.Match(last) {
+		return true
+	}
+	if r.continuation != nil {
+		return r.continuation.Match(line)
+	}
+	return r.start != nil
+}
+
+// Syslog messages have their leading spaces removed, so presets can't rely on
+// indentation alone.
+var multilinePresets = map[string]multilineRule{
+	"java": {
+		continuation: regexp.MustCompile(`^\s*(at\s+[\w$.<>/]+\(|\.\.\.\s\d+\s(more|common frames omitted)|Suppressed:\s|Caused by:\s)`),
+	},
+	"python": {
+		continuation: regexp.MustCompile(`^(\s|Traceback \(most recent call last\):|File ".*", line \d+|During handling of the above exception|The above exception was the direct cause|[\w.]+(Error|Exception|Exit|Interrupt|Warning)(:\s|$))`),
+		after:        regexp.MustCompile(`^\s*File ".*", line \d+, in `),
+	},
+	"go": {
+		start:        regexp.MustCompile(`^(panic|fatal error): `),
+		continuation: regexp.MustCompile(`^\s*(goroutine \d+ \[|\[signal |created by |exit status \d+$|\S+\.go:\d+( \+0x[0-9a-f]+)?$|[\w./-]+\.[\w.(*)\[\]-]+\(.*\)$)`),
+	},
+}
+
+type multilineEntry struct {
+	parts       rawLogParts
+	appName     string
+	processName string
+	updated     time.Time
+}
+
+// multilineAssembler joins lines belonging to the same message, like stack
+// traces, before they reach the backends. Lines are grouped by container and
+// a message is sent when a line that doesn't continue it arrives, when no new
+// lines arrive for flushTimeout or when it would grow beyond maxSize.
+type multilineAssembler struct {
+	rules        []multilineRule
+	flushTimeout time.Duration
+	maxSize      int
+	send         func(parts *rawLogParts, appName, processName, container string)
+	mu           sync.Mutex
+	pending      map[string]*multilineEntry
+	quit         chan struct{}
+	done         chan struct{}
+}
+
+// newMultilineAssembler loads the multiline settings from LOG_MULTILINE_*
+// environment variables. It returns nil if no preset or pattern is set.
+func newMultilineAssembler(send func(*rawLogParts, string, string, string)) (*multilineAssembler, error) {
+	var rules []multilineRule
+	for _, name := range config.StringsEnvOrDefault(nil, "LOG_MULTILINE_PRESET") {
+		rule, ok := multilinePresets[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid multiline preset %q, expected java, python or go", name)
+		}
+		rules = append(rules, rule)
+	}
+	var custom multilineRule
+	var err error
+	if pattern := config.StringEnvOrDefault("", "LOG_MULTILINE_START_PATTERN"); pattern != "" {
+		custom.start, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LOG_MULTILINE_START_PATTERN: %s", err)
+		}
+	}
+	if pattern := config.StringEnvOrDefault("", "LOG_MULTILINE_CONTINUATION_PATTERN"); pattern != "" {
+		custom.continuation, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LOG_MULTILINE_CONTINUATION_PATTERN: %s", err)
+		}
+	}
+	if custom.start != nil || custom.continuation != nil {
+		rules = append(rules, custom)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	a := &multilineAssembler{
+		rules:        rules,
+		flushTimeout: config.SecondsEnvOrDefault(1, "LOG_MULTILINE_FLUSH_TIMEOUT"),
+		maxSize:      config.IntEnvOrDefault(defaultMultilineMaxSize, "LOG_MULTILINE_MAX_SIZE"),
+		send:         send,
+		pending:      map[string]*multilineEntry{},
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go a.flushLoop()
+	return a, nil
+}
+
+func (a *multilineAssembler) continues(content, line []byte) bool {
+	last := content
+	if i := bytes.LastIndexByte(content, '\n'); i >= 0 {
+		last = content[i+1:]
+	}
+	for i := range a.rules {
+		if a.rules[i].continues(last, line) {
+			return true
+		}
+	}
+	return false
+}
+
+// add appends parts to the pending message of its container or starts a new
+// one. parts is copied as its buffers are reused by the syslog server. The
+// message and fields of a joined message are the ones found in its first
+// line, with the text of the other lines appended to the message.
+func (a *multilineAssembler) add(parts *rawLogParts, appName, processName, container string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry := a.pending[container]
+	if entry != nil {
+		if len(entry.parts.content)+len(parts.content)+1 <= a.maxSize && a.continues(entry.parts.content, parts.content) {
+			entry.parts.content = append(append(entry.parts.content, '\n'), parts.content...)
+			if entry.parts.message != nil {
+				entry.parts.message = append(append(entry.parts.message, '\n'), parts.text()...)
+			}
+			entry.updated = time.Now()
+			return
+		}
+		a.flush(container, entry)
+	}
+	var message []byte
+	if parts.message != nil {
+		message = append([]byte{}, parts.message...)
+	}
+	a.pending[container] = &multilineEntry{
+		parts: rawLogParts{
+			ts:            parts.ts,
+			priority:      append([]byte(nil), parts.priority...),
+			content:       append([]byte(nil), parts.content...),
+			container:     append([]byte(nil), parts.container...),
+			stream:        parts.stream,
+			structured:    parts.structured,
+			message:       message,
+			level:         parts.level,
+			fields:        parts.fields,
+			containerInfo: parts.containerInfo,
+		},
+		appName:     appName,
+		processName: processName,
+		updated:     time.Now(),
+	}
+}
+
+func (a *multilineAssembler) flush(container string, entry *multilineEntry) {
+	delete(a.pending, container)
+	a.send(&entry.parts, entry.appName, entry.processName, container)
+}
+
+func (a *multilineAssembler) flushLoop() {
+	defer close(a.done)
+	interval := a.flushTimeout / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.quit:
+			return
+		case now := <-t.C:
+			a.mu.Lock()
+			for container, entry := range a.pending {
+				if now.Sub(entry.updated) >= a.flushTimeout {
+					a.flush(container, entry)
+				}
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+// stop sends every pending message.
+func (a *multilineAssembler) stop() {
+	close(a.quit)
+	<-a.done
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for container, entry := range a.pending {
+		a.flush(container, entry)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsuru/bs/container"
+	"gopkg.in/check.v1"
+)
+
+type multilineRecorder struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *multilineRecorder) send(parts *rawLogParts, appName, processName, container string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, fmt.Sprintf("%s|%s", container, parts.content))
+}
+
+func (r *multilineRecorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.messages...)
+}
+
+func (s *S) TestMultilinePresets(c *check.C) {
+	tests := []struct {
+		preset string
+		lines  []string
+	}{
+		{"java", []string{
+			`Exception in thread "main" java.lang.IllegalStateException: boom`,
+			"\tat com.example.App.run(App.java:10)",
+			"\tat com.example.App.main(App.java:5)",
+			"Caused by: java.lang.NullPointerException",
+			"\tat com.example.Dep.get(Dep.java:3)",
+			"\t... 2 more",
+			"at com.example.Dep.<init>(Dep.java:1)",
+			"... 4 common frames omitted",
+		}},
+		{"python", []string{
+			"ERROR:root:request failed",
+			"Traceback (most recent call last):",
+			`  File "app.py", line 3, in <module>`,
+			"    main()",
+			`File "lib.py", line 7, in run`,
+			"return int(value)",
+			"ValueError: invalid literal",
+		}},
+		{"go", []string{
+			"panic: runtime error: index out of range",
+			"goroutine 1 [running]:",
+			"main.(*server).handle(0xc42000e0b0, 0x1)",
+			"\t/go/src/app/main.go:12 +0x1d",
+			"main.main()",
+			"\t/go/src/app/main.go:20 +0x2f",
+			"/go/src/app/main.go:20 +0x2f",
+			"exit status 2",
+		}},
+	}
+	for _, tt := range tests {
+		rule := multilinePresets[tt.preset]
+		c.Check(rule.continues(nil, []byte(tt.lines[0])), check.Equals, false, check.Commentf("preset %s", tt.preset))
+		for i := 1; i < len(tt.lines); i++ {
+			c.Check(rule.continues([]byte(tt.lines[i-1]), []byte(tt.lines[i])), check.Equals, true, check.Commentf("preset %s, line %q", tt.preset, tt.lines[i]))
+		}
+		last := []byte(tt.lines[len(tt.lines)-1])
+		c.Check(rule.continues(last, []byte("GET /healthcheck 200")), check.Equals, false, check.Commentf("preset %s", tt.preset))
+	}
+}
+
+func (s *S) TestMultilineAssembler(c *check.C) {
+	os.Setenv("LOG_MULTILINE_START_PATTERN", `^\d{4}-`)
+	os.Setenv("LOG_MULTILINE_FLUSH_TIMEOUT", "60")
+	os.Setenv("LOG_MULTILINE_MAX_SIZE", "40")
+	var recorder multilineRecorder
+	a, err := newMultilineAssembler(recorder.send)
+	c.Assert(err, check.IsNil)
+	lines := []struct {
+		container string
+		content   string
+	}{
+		{"c1", "2017-01-01 first"},
+		{"c2", "2017-01-01 other"},
+		{"c1", "  detail 1"},
+		{"c2", "  other detail"},
+		{"c1", "  detail 2"},
+		{"c1", "2017-01-01 second"},
+		{"c1", "  1234567890"},
+		{"c1", "  this line overflows"},
+	}
+	buf := make([]byte, 100)
+	for _, l := range lines {
+		// The same buffer is reused on every call, like the syslog server does.
+		n := copy(buf, l.content)
+		a.add(&rawLogParts{content: buf[:n], priority: []byte("30")}, "app", "web", l.container)
+	}
+	c.Assert(recorder.get(), check.DeepEquals, []string{
+		"c1|2017-01-01 first\n  detail 1\n  detail 2",
+		"c1|2017-01-01 second\n  1234567890",
+	})
+	a.stop()
+	messages := recorder.get()
+	c.Assert(messages, check.HasLen, 4)
+	sort.Strings(messages[2:])
+	c.Assert(messages[2:], check.DeepEquals, []string{"c1|  this line overflows", "c2|2017-01-01 other\n  other detail"})
+}
+
+func (s *S) TestMultilineAssemblerStructuredFirstLine(c *check.C) {
+	os.Setenv("LOG_MULTILINE_PRESET", "java")
+	os.Setenv("LOG_MULTILINE_FLUSH_TIMEOUT", "60")
+	var joined []*rawLogParts
+	a, err := newMultilineAssembler(func(parts *rawLogParts, appName, processName, container string) {
+		joined = append(joined, parts)
+	})
+	c.Assert(err, check.IsNil)
+	defer a.stop()
+	first := []byte(`{"level":"error","msg":"request failed","path":"/"}`)
+	a.add(&rawLogParts{
+		content:    first,
+		priority:   []byte("27"),
+		structured: true,
+		message:    first[24:38],
+		level:      "error",
+		fields:     []logField{{key: "path", value: "/"}},
+	}, "app", "web", "c1")
+	a.add(&rawLogParts{content: []byte("Caused by: java.lang.IllegalStateException: boom"), priority: []byte("27")}, "app", "web", "c1")
+	a.add(&rawLogParts{content: []byte("at com.example.App.run(App.java:10)"), priority: []byte("27")}, "app", "web", "c1")
+	copy(first, "overwritten by the next message")
+	a.add(&rawLogParts{content: []byte("2017-01-01 next"), priority: []byte("30")}, "app", "web", "c1")
+	c.Assert(joined, check.HasLen, 1)
+	c.Assert(string(joined[0].text()), check.Equals, "request failed\nCaused by: java.lang.IllegalStateException: boom\nat com.example.App.run(App.java:10)")
+	c.Assert(joined[0].level, check.Equals, "error")
+	c.Assert(joined[0].fields, check.DeepEquals, []logField{{key: "path", value: "/"}})
+}
+
+func (s *S) TestMultilineAssemblerKeepsContainerInfo(c *check.C) {
+	os.Setenv("LOG_MULTILINE_PRESET", "java")
+	var joined []*rawLogParts
+	a, err := newMultilineAssembler(func(parts *rawLogParts, appName, processName, container string) {
+		joined = append(joined, parts)
+	})
+	c.Assert(err, check.IsNil)
+	info := &container.Container{AppName: "app"}
+	a.add(&rawLogParts{content: []byte("first"), priority: []byte("30"), containerInfo: info}, "app", "web", "c1")
+	a.stop()
+	c.Assert(joined, check.HasLen, 1)
+	c.Assert(joined[0].containerInfo, check.Equals, info)
+}
+
+func (s *S) TestMultilineAssemblerDisabled(c *check.C) {
+	a, err := newMultilineAssembler(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(a, check.IsNil)
+}
+
+func (s *S) TestMultilineAssemblerInvalidConfig(c *check.C) {
+	tests := []struct {
+		env   string
+		value string
+		err   string
+	}{
+		{"LOG_MULTILINE_PRESET", "ruby", `invalid multiline preset "ruby", expected java, python or go`},
+		{"LOG_MULTILINE_START_PATTERN", "(", "invalid LOG_MULTILINE_START_PATTERN: .*"},
+		{"LOG_MULTILINE_CONTINUATION_PATTERN", "[", "invalid LOG_MULTILINE_CONTINUATION_PATTERN: .*"},
+	}
+	for _, tt := range tests {
+		os.Setenv(tt.env, tt.value)
+		_, err := newMultilineAssembler(nil)
+		c.Check(err, check.ErrorMatches, tt.err)
+		os.Unsetenv(tt.env)
+	}
+}
+
+func (s *S) TestLogForwarderMultiline(c *check.C) {
+	os.Setenv("LOG_MULTILINE_PRESET", "java")
+	os.Setenv("LOG_MULTILINE_FLUSH_TIMEOUT", "0.1")
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn, err := net.ListenUDP("udp", addr)
+	c.Assert(err, check.IsNil)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	lines := []string{
+		"java.lang.RuntimeException: boom",
+		"at com.example.App.main(App.java:5)",
+		"Caused by: java.io.IOException",
+	}
+	for _, line := range lines {
+		_, err = conn.Write([]byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: %s\n", s.id, line)))
+		c.Assert(err, check.IsNil)
+	}
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	expected := fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: %s\n", s.idShort, strings.Join(lines, "\n"))
+	c.Assert(string(buffer[:n]), check.Equals, expected)
+}
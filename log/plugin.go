@@ -0,0 +1,433 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/tsuru/bs/bslog"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+const (
+	pluginContentType = "application/vnd.docker.plugins.v1+json"
+	// maxPartialMessageSize is the size after which chunks of a partial
+	// message are sent without waiting for the last one.
+	maxPartialMessageSize = 1 << 20
+	// pluginLogContainers is the number of containers whose recent logs are
+	// kept for ReadLogs.
+	pluginLogContainers = 1000
+	pluginFollowBuffer  = 1000
+)
+
+// pluginLogInfo is the container info docker sends to log driver plugins.
+type pluginLogInfo struct {
+	ContainerID        string
+	ContainerName      string
+	ContainerImageName string
+	ContainerLabels    map[string]string
+	ContainerEnv       []string
+}
+
+type pluginStartRequest struct {
+	File string
+	Info pluginLogInfo
+}
+
+type pluginStopRequest struct {
+	File string
+}
+
+type pluginReadRequest struct {
+	Info   pluginLogInfo
+	Config pluginReadConfig
+}
+
+type pluginReadConfig struct {
+	Since  time.Time
+	Until  time.Time
+	Tail   int
+	Follow bool
+}
+
+type pluginResponse struct {
+	Err string
+}
+
+// dockerLogPlugin implements the docker log driver plugin API, reading the
+// logs written by docker to a FIFO for each container and handling them as
+// messages received by the syslog server.
+type dockerLogPlugin struct {
+	handler  syslog.Handler
+	listener net.Listener
+	path     string
+	maxLines int
+	mu       sync.Mutex
+	streams  map[string]*pluginStream
+	logs     *lru.Cache
+}
+
+// pluginStream reads the log entries of a container from the FIFO in file.
+type pluginStream struct {
+	path      string
+	file      *os.File
+	container []byte
+	logs      *pluginLogBuffer
+	partials  map[string]*pluginLogEntry
+}
+
+// pluginLogBuffer holds the last log entries of a container, returned by
+// ReadLogs, and the channels of ReadLogs requests following the logs.
+type pluginLogBuffer struct {
+	mu        sync.Mutex
+	maxLines  int
+	entries   []pluginLogEntry
+	followers map[chan pluginLogEntry]struct{}
+}
+
+func newDockerLogPlugin(handler syslog.Handler, path string, maxLines int) (*dockerLogPlugin, error) {
+	logs, err := lru.New(pluginLogContainers)
+	if err != nil {
+		return nil, err
+	}
+	p := &dockerLogPlugin{
+		handler:  handler,
+		path:     path,
+		maxLines: maxLines,
+		streams:  map[string]*pluginStream{},
+		logs:     logs,
+	}
+	err = listenUnixSocket(path, func() (listenErr error) {
+		p.listener, listenErr = net.Listen("unix", path)
+		return listenErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", p.activate)
+	mux.HandleFunc("/LogDriver.StartLogging", p.startLogging)
+	mux.HandleFunc("/LogDriver.StopLogging", p.stopLogging)
+	mux.HandleFunc("/LogDriver.Capabilities", p.capabilities)
+	mux.HandleFunc("/LogDriver.ReadLogs", p.readLogs)
+	stopWg.Add(1)
+	go func() {
+		defer stopWg.Done()
+		http.Serve(p.listener, mux)
+	}()
+	return p, nil
+}
+
+func (p *dockerLogPlugin) stop() {
+	p.listener.Close()
+	os.Remove(p.path)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for file, stream := range p.streams {
+		stream.file.Close()
+		stream.logs.close()
+		delete(p.streams, file)
+	}
+}
+
+func (p *dockerLogPlugin) activate(w http.ResponseWriter, r *http.Request) {
+	writePluginJSON(w, map[string][]string{"Implements": {"LogDriver"}})
+}
+
+func (p *dockerLogPlugin) capabilities(w http.ResponseWriter, r *http.Request) {
+	writePluginJSON(w, map[string]map[string]bool{"Cap": {"ReadLogs": p.maxLines > 0}})
+}
+
+func (p *dockerLogPlugin) startLogging(w http.ResponseWriter, r *http.Request) {
+	var req pluginStartRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil {
+		err = p.start(req.File, req.Info)
+	}
+	writePluginError(w, err)
+}
+
+func (p *dockerLogPlugin) stopLogging(w http.ResponseWriter, r *http.Request) {
+	var req pluginStopRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil {
+		p.mu.Lock()
+		stream := p.streams[req.File]
+		delete(p.streams, req.File)
+		p.mu.Unlock()
+		if stream != nil {
+			stream.file.Close()
+			stream.logs.close()
+		}
+	}
+	writePluginError(w, err)
+}
+
+func (p *dockerLogPlugin) start(file string, info pluginLogInfo) error {
+	if info.ContainerID == "" {
+		return fmt.Errorf("missing container id for %q", file)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.streams[file] != nil {
+		return fmt.Errorf("already logging from %q", file)
+	}
+	f, err := os.OpenFile(file, os.O_RDONLY, 0700)
+	if err != nil {
+		return fmt.Errorf("unable to open log fifo %q: %s", file, err)
+	}
+	stream := &pluginStream{
+		path:      file,
+		file:      f,
+		container: []byte(info.ContainerID),
+		logs:      p.containerLogs(info.ContainerID),
+		partials:  map[string]*pluginLogEntry{},
+	}
+	p.streams[file] = stream
+	stopWg.Add(1)
+	go func() {
+		defer stopWg.Done()
+		p.consume(stream)
+	}()
+	return nil
+}
+
+// containerLogs returns the log buffer of a container, reusing the one from
+// previous runs of the container.
+func (p *dockerLogPlugin) containerLogs(containerID string) *pluginLogBuffer {
+	if logs, ok := p.logs.Get(containerID); ok {
+		logs := logs.(*pluginLogBuffer)
+		logs.mu.Lock()
+		logs.followers = map[chan pluginLogEntry]struct{}{}
+		logs.mu.Unlock()
+		return logs
+	}
+	logs := &pluginLogBuffer{
+		maxLines:  p.maxLines,
+		followers: map[chan pluginLogEntry]struct{}{},
+	}
+	p.logs.Add(containerID, logs)
+	return logs
+}
+
+func (p *dockerLogPlugin) consume(stream *pluginStream) {
+	var buf []byte
+	for {
+		var entry pluginLogEntry
+		var err error
+		entry, buf, err = readPluginLogEntry(stream.file, buf)
+		if err != nil {
+			if err != io.EOF && p.running(stream) {
+				bslog.Errorf("[log forwarder] unable to read log entry for container %s: %s", stream.container, err)
+			}
+			break
+		}
+		p.add(stream, &entry)
+	}
+	for _, partial := range stream.partials {
+		p.handle(stream, partial)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.streams[stream.path] == stream {
+		delete(p.streams, stream.path)
+		stream.file.Close()
+		stream.logs.close()
+	}
+}
+
+// running reports whether stream wasn't stopped.
+func (p *dockerLogPlugin) running(stream *pluginStream) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.streams[stream.path] == stream
+}
+
+// add joins the chunks of partial messages, handling the message once its
+// last chunk is read. Chunks are joined while they have the same partial id,
+// what was joined of a message is handled as is when a chunk with a different
+// id is read.
+func (p *dockerLogPlugin) add(stream *pluginStream, entry *pluginLogEntry) {
+	partial := stream.partials[entry.source]
+	if partial != nil && partial.partialID() != entry.partialID() {
+		delete(stream.partials, entry.source)
+		p.handle(stream, partial)
+		partial = nil
+	}
+	if partial == nil {
+		if entry.complete() {
+			entry.line = append([]byte(nil), entry.line...)
+			p.handle(stream, entry)
+			return
+		}
+		partial = &pluginLogEntry{
+			source:   entry.source,
+			timeNano: entry.timeNano,
+		}
+		if entry.partialMeta != nil {
+			partial.partialMeta = &partialLogMetadata{id: entry.partialMeta.id}
+		}
+		stream.partials[entry.source] = partial
+	}
+	partial.line = append(partial.line, entry.line...)
+	if entry.complete() || len(partial.line) >= maxPartialMessageSize {
+		delete(stream.partials, entry.source)
+		p.handle(stream, partial)
+	}
+}
+
+func (p *dockerLogPlugin) handle(stream *pluginStream, entry *pluginLogEntry) {
+	stream.logs.add(*entry)
+	p.handler.Handle(format.LogParts{"parts": &rawLogParts{
+		content:   bytes.TrimRight(entry.line, "\r\n"),
+		ts:        time.Unix(0, entry.timeNano),
+		priority:  streamPriority(entry.source),
+		container: stream.container,
+		stream:    entry.source,
+	}}, int64(len(entry.line)), nil)
+}
+
+func (p *dockerLogPlugin) readLogs(w http.ResponseWriter, r *http.Request) {
+	var req pluginReadRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writePluginError(w, err)
+		return
+	}
+	var logs *pluginLogBuffer
+	if value, ok := p.logs.Get(req.Info.ContainerID); ok {
+		logs = value.(*pluginLogBuffer)
+	}
+	if p.maxLines == 0 || logs == nil {
+		writePluginError(w, fmt.Errorf("no logs available for container %q", req.Info.ContainerID))
+		return
+	}
+	entries, follow := logs.read(req.Config)
+	if follow != nil {
+		defer logs.unfollow(follow)
+	}
+	w.Header().Set("Content-Type", "application/x-json-stream")
+	for i := range entries {
+		err = writePluginLogEntry(w, &entries[i])
+		if err != nil {
+			return
+		}
+	}
+	if follow == nil {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	closeNotify := make(<-chan bool)
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closeNotify = notifier.CloseNotify()
+	}
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case entry, ok := <-follow:
+			if !ok {
+				return
+			}
+			if !req.Config.Until.IsZero() && time.Unix(0, entry.timeNano).After(req.Config.Until) {
+				return
+			}
+			err = writePluginLogEntry(w, &entry)
+			if err != nil {
+				return
+			}
+		case <-closeNotify:
+			return
+		}
+	}
+}
+
+func (b *pluginLogBuffer) add(entry pluginLogEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.maxLines > 0 {
+		if len(b.entries) >= b.maxLines {
+			copy(b.entries, b.entries[1:])
+			b.entries = b.entries[:len(b.entries)-1]
+		}
+		b.entries = append(b.entries, entry)
+	}
+	for ch := range b.followers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+}
+
+// read returns the entries matching cfg and, to follow the logs, a channel
+// receiving new entries.
+func (b *pluginLogBuffer) read(cfg pluginReadConfig) ([]pluginLogEntry, chan pluginLogEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var entries []pluginLogEntry
+	for _, entry := range b.entries {
+		ts := time.Unix(0, entry.timeNano)
+		if (!cfg.Since.IsZero() && ts.Before(cfg.Since)) || (!cfg.Until.IsZero() && ts.After(cfg.Until)) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if cfg.Tail >= 0 && cfg.Tail < len(entries) {
+		entries = entries[len(entries)-cfg.Tail:]
+	}
+	if !cfg.Follow || b.followers == nil {
+		return entries, nil
+	}
+	ch := make(chan pluginLogEntry, pluginFollowBuffer)
+	b.followers[ch] = struct{}{}
+	return entries, ch
+}
+
+func (b *pluginLogBuffer) unfollow(ch chan pluginLogEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.followers[ch]; ok {
+		delete(b.followers, ch)
+		close(ch)
+	}
+}
+
+// close ends ReadLogs requests following the logs, as the container stopped.
+func (b *pluginLogBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.followers {
+		close(ch)
+	}
+	b.followers = nil
+}
+
+func writePluginError(w http.ResponseWriter, err error) {
+	var resp pluginResponse
+	if err != nil {
+		resp.Err = err.Error()
+	}
+	writePluginJSON(w, resp)
+}
+
+func writePluginJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", pluginContentType)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		bslog.Errorf("[log forwarder] unable to write log plugin response: %s", err)
+	}
+}
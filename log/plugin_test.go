@@ -0,0 +1,266 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+var pluginTestTime = time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC).UnixNano()
+
+type pluginTestClient struct {
+	c      *check.C
+	client *http.Client
+}
+
+func newPluginTestClient(c *check.C, socket string) *pluginTestClient {
+	return &pluginTestClient{c: c, client: &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}}
+}
+
+func (p *pluginTestClient) post(path string, body interface{}) *http.Response {
+	data, err := json.Marshal(body)
+	p.c.Assert(err, check.IsNil)
+	resp, err := p.client.Post("http://plugin"+path, pluginContentType, bytes.NewReader(data))
+	p.c.Assert(err, check.IsNil)
+	p.c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+	return resp
+}
+
+func (p *pluginTestClient) call(path string, body interface{}) map[string]interface{} {
+	resp := p.post(path, body)
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	p.c.Assert(err, check.IsNil)
+	return result
+}
+
+// startPluginFifo creates a FIFO in dir and starts logging from it, returning
+// the FIFO path and its write end.
+func (s *S) startPluginFifo(c *check.C, client *pluginTestClient, dir, name string) (string, *os.File) {
+	fifo := filepath.Join(dir, name)
+	err := syscall.Mkfifo(fifo, 0700)
+	c.Assert(err, check.IsNil)
+	writerCh := make(chan *os.File)
+	go func() {
+		f, openErr := os.OpenFile(fifo, os.O_WRONLY, 0)
+		c.Check(openErr, check.IsNil)
+		writerCh <- f
+	}()
+	result := client.call("/LogDriver.StartLogging", pluginStartRequest{
+		File: fifo,
+		Info: pluginLogInfo{ContainerID: s.id},
+	})
+	c.Assert(result, check.DeepEquals, map[string]interface{}{"Err": ""})
+	return fifo, <-writerCh
+}
+
+func (s *S) startPluginForwarder(c *check.C, dir string) (*LogForwarder, *net.UDPConn, *pluginTestClient) {
+	udpConn := listenUDP(c)
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	socket := filepath.Join(dir, "bs.sock")
+	os.Setenv("LOG_PLUGIN_SOCKET", socket)
+	lf := &LogForwarder{
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	return lf, udpConn, newPluginTestClient(c, socket)
+}
+
+func writePluginEntries(c *check.C, w io.Writer, entries ...pluginLogEntry) {
+	for i := range entries {
+		err := writePluginLogEntry(w, &entries[i])
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *S) TestDockerLogPluginHandshake(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-plugin")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	lf, udpConn, client := s.startPluginForwarder(c, dir)
+	defer udpConn.Close()
+	c.Assert(client.call("/Plugin.Activate", nil), check.DeepEquals, map[string]interface{}{
+		"Implements": []interface{}{"LogDriver"},
+	})
+	c.Assert(client.call("/LogDriver.Capabilities", nil), check.DeepEquals, map[string]interface{}{
+		"Cap": map[string]interface{}{"ReadLogs": true},
+	})
+	c.Assert(client.call("/LogDriver.StopLogging", pluginStopRequest{File: "/unknown"}), check.DeepEquals, map[string]interface{}{"Err": ""})
+	result := client.call("/LogDriver.StartLogging", pluginStartRequest{File: filepath.Join(dir, "missing")})
+	c.Assert(result["Err"], check.Matches, `missing container id for ".*missing"`)
+	result = client.call("/LogDriver.StartLogging", pluginStartRequest{
+		File: filepath.Join(dir, "missing"),
+		Info: pluginLogInfo{ContainerID: s.id},
+	})
+	c.Assert(result["Err"], check.Matches, `unable to open log fifo ".*missing": .*`)
+	result = client.call("/LogDriver.ReadLogs", pluginReadRequest{Info: pluginLogInfo{ContainerID: "unknown"}})
+	c.Assert(result["Err"], check.Equals, `no logs available for container "unknown"`)
+	lf.stopWait()
+	_, err = os.Stat(filepath.Join(dir, "bs.sock"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestDockerLogPluginForwardsMessages(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-plugin")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	lf, udpConn, client := s.startPluginForwarder(c, dir)
+	defer udpConn.Close()
+	defer lf.stopWait()
+	fifo, writer := s.startPluginFifo(c, client, dir, "fifo")
+	defer writer.Close()
+	result := client.call("/LogDriver.StartLogging", pluginStartRequest{
+		File: fifo,
+		Info: pluginLogInfo{ContainerID: s.id},
+	})
+	c.Assert(result["Err"], check.Matches, `already logging from ".*fifo"`)
+	writePluginEntries(c, writer,
+		pluginLogEntry{source: "stdout", timeNano: pluginTestTime, line: []byte("hello\n")},
+		pluginLogEntry{source: "stdout", timeNano: pluginTestTime, line: []byte("old "), partial: true},
+		pluginLogEntry{source: "stderr", timeNano: pluginTestTime, line: []byte("boom")},
+		pluginLogEntry{source: "stdout", timeNano: pluginTestTime + 1, line: []byte("partial")},
+		pluginLogEntry{source: "stdout", timeNano: pluginTestTime, line: []byte("new "), partial: true, partialMeta: &partialLogMetadata{id: "x", ordinal: 1}},
+		pluginLogEntry{source: "stdout", timeNano: pluginTestTime + 1, line: []byte("partial"), partial: true, partialMeta: &partialLogMetadata{id: "x", ordinal: 2, last: true}},
+	)
+	c.Assert(readUDPMessages(c, udpConn), check.DeepEquals, []string{
+		fmt.Sprintf("<27>Jun  5 13:13:47 %s coolappname[procx]: boom\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: hello\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: new partial\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: old partial\n", s.idShort),
+	})
+	c.Assert(client.call("/LogDriver.StopLogging", pluginStopRequest{File: fifo}), check.DeepEquals, map[string]interface{}{"Err": ""})
+}
+
+func (s *S) TestDockerLogPluginPartialIDChanged(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-plugin")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	lf, udpConn, client := s.startPluginForwarder(c, dir)
+	defer udpConn.Close()
+	defer lf.stopWait()
+	_, writer := s.startPluginFifo(c, client, dir, "fifo")
+	defer writer.Close()
+	writePluginEntries(c, writer,
+		pluginLogEntry{source: "stdout", timeNano: pluginTestTime, line: []byte("lost"), partial: true, partialMeta: &partialLogMetadata{id: "a", ordinal: 1}},
+		pluginLogEntry{source: "stdout", timeNano: pluginTestTime, line: []byte("new "), partial: true, partialMeta: &partialLogMetadata{id: "b", ordinal: 1}},
+		pluginLogEntry{source: "stdout", timeNano: pluginTestTime, line: []byte("partial"), partial: true, partialMeta: &partialLogMetadata{id: "b", ordinal: 2, last: true}},
+		pluginLogEntry{source: "stdout", timeNano: pluginTestTime, line: []byte("unfinished"), partial: true, partialMeta: &partialLogMetadata{id: "c", ordinal: 1}},
+		pluginLogEntry{source: "stdout", timeNano: pluginTestTime, line: []byte("single")},
+	)
+	c.Assert(readUDPMessages(c, udpConn), check.DeepEquals, []string{
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: lost\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: new partial\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: single\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: unfinished\n", s.idShort),
+	})
+}
+
+func (s *S) TestDockerLogPluginReadLogs(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-plugin")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	os.Setenv("LOG_PLUGIN_READ_LOGS_LINES", "3")
+	lf, udpConn, client := s.startPluginForwarder(c, dir)
+	defer udpConn.Close()
+	defer lf.stopWait()
+	fifo, writer := s.startPluginFifo(c, client, dir, "fifo")
+	defer writer.Close()
+	for i := 0; i < 5; i++ {
+		writePluginEntries(c, writer, pluginLogEntry{
+			source:   "stdout",
+			timeNano: pluginTestTime + int64(i)*int64(time.Second),
+			line:     []byte(fmt.Sprintf("msg %d", i)),
+		})
+	}
+	c.Assert(readUDPMessages(c, udpConn), check.HasLen, 5)
+	readLines := func(resp *http.Response) []string {
+		var lines []string
+		var buf []byte
+		for {
+			var entry pluginLogEntry
+			var readErr error
+			entry, buf, readErr = readPluginLogEntry(resp.Body, buf)
+			if readErr != nil {
+				c.Check(readErr, check.Equals, io.EOF)
+				resp.Body.Close()
+				return lines
+			}
+			lines = append(lines, string(entry.line))
+		}
+	}
+	resp := client.post("/LogDriver.ReadLogs", pluginReadRequest{
+		Info:   pluginLogInfo{ContainerID: s.id},
+		Config: pluginReadConfig{Tail: -1},
+	})
+	c.Assert(readLines(resp), check.DeepEquals, []string{"msg 2", "msg 3", "msg 4"})
+	resp = client.post("/LogDriver.ReadLogs", pluginReadRequest{
+		Info:   pluginLogInfo{ContainerID: s.id},
+		Config: pluginReadConfig{Tail: 1},
+	})
+	c.Assert(readLines(resp), check.DeepEquals, []string{"msg 4"})
+	resp = client.post("/LogDriver.ReadLogs", pluginReadRequest{
+		Info: pluginLogInfo{ContainerID: s.id},
+		Config: pluginReadConfig{
+			Tail:  -1,
+			Since: time.Unix(0, pluginTestTime+3*int64(time.Second)),
+		},
+	})
+	c.Assert(readLines(resp), check.DeepEquals, []string{"msg 3", "msg 4"})
+	resp = client.post("/LogDriver.ReadLogs", pluginReadRequest{
+		Info:   pluginLogInfo{ContainerID: s.id},
+		Config: pluginReadConfig{Tail: 0, Follow: true},
+	})
+	linesCh := make(chan []string)
+	go func() {
+		linesCh <- readLines(resp)
+	}()
+	writePluginEntries(c, writer, pluginLogEntry{source: "stdout", timeNano: pluginTestTime, line: []byte("followed")})
+	c.Assert(readUDPMessages(c, udpConn), check.HasLen, 1)
+	client.call("/LogDriver.StopLogging", pluginStopRequest{File: fifo})
+	select {
+	case lines := <-linesCh:
+		c.Assert(lines, check.DeepEquals, []string{"followed"})
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for followed logs")
+	}
+}
+
+func (s *S) TestDockerLogPluginReadLogsDisabled(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-plugin")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	os.Setenv("LOG_PLUGIN_READ_LOGS_LINES", "0")
+	lf, udpConn, client := s.startPluginForwarder(c, dir)
+	defer udpConn.Close()
+	defer lf.stopWait()
+	c.Assert(client.call("/LogDriver.Capabilities", nil), check.DeepEquals, map[string]interface{}{
+		"Cap": map[string]interface{}{"ReadLogs": false},
+	})
+	_, writer := s.startPluginFifo(c, client, dir, "fifo")
+	defer writer.Close()
+	result := client.call("/LogDriver.ReadLogs", pluginReadRequest{Info: pluginLogInfo{ContainerID: s.id}})
+	c.Assert(result["Err"], check.Equals, fmt.Sprintf("no logs available for container %q", s.id))
+}
@@ -0,0 +1,216 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/config"
+	"github.com/tsuru/bs/container"
+)
+
+const (
+	rateLimitEnv        = "BS_LOG_RATE_LIMIT"
+	rateLimitBurstEnv   = "BS_LOG_RATE_LIMIT_BURST"
+	rateLimitLabel      = "bs.log.rate-limit"
+	rateLimitBurstLabel = "bs.log.rate-limit-burst"
+)
+
+// rateLimit is the number of messages per second allowed for an app, with
+// bursts of up to burst messages. A zero rate means no limit.
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+type tokenBucket struct {
+	limit       rateLimit
+	tokens      float64
+	last        time.Time
+	suppressed  int
+	priority    int
+	container   string
+	appName     string
+	processName string
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.rate
+	if b.tokens > b.limit.burst {
+		b.tokens = b.limit.burst
+	}
+	b.last = now
+}
+
+// rateLimiter limits the rate of messages for each app, or each app process,
+// using token buckets. Once messages are allowed again for a throttled app, a
+// message with the number of suppressed messages is sent in its log stream.
+type rateLimiter struct {
+	defaultLimit rateLimit
+	byProcess    bool
+	send         func(parts *rawLogParts, appName, processName, container string)
+	now          func() time.Time
+	limits       *lru.Cache
+	mu           sync.Mutex
+	buckets      map[string]*tokenBucket
+	quit         chan struct{}
+	done         chan struct{}
+}
+
+// newRateLimiter loads the default limit from LOG_RATE_LIMIT* environment
+// variables. Limits can be overridden for each container with the
+// BS_LOG_RATE_LIMIT and BS_LOG_RATE_LIMIT_BURST environment variables or the
+// bs.log.rate-limit and bs.log.rate-limit-burst labels.
+func newRateLimiter(send func(*rawLogParts, string, string, string)) (*rateLimiter, error) {
+	rate := config.IntEnvOrDefault(0, "LOG_RATE_LIMIT")
+	byProcess, _ := strconv.ParseBool(os.Getenv("LOG_RATE_LIMIT_BY_PROCESS"))
+	limits, err := lru.New(100)
+	if err != nil {
+		return nil, err
+	}
+	l := &rateLimiter{
+		defaultLimit: rateLimit{
+			rate:  float64(rate),
+			burst: float64(config.IntEnvOrDefault(rate, "LOG_RATE_LIMIT_BURST")),
+		},
+		byProcess: byProcess,
+		send:      send,
+		now:       time.Now,
+		limits:    limits,
+		buckets:   map[string]*tokenBucket{},
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go l.summaryLoop()
+	return l, nil
+}
+
+// containerLimit returns the limit for messages from cont, considering its
+// overrides.
+func (l *rateLimiter) containerLimit(cont *container.Container) rateLimit {
+	if limit, ok := l.limits.Get(cont.ID); ok {
+		return limit.(rateLimit)
+	}
+	limit := l.defaultLimit
+	if value := cont.Setting(rateLimitEnv, rateLimitLabel); value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			bslog.Warnf("invalid log rate limit %q for container %s, using the default", value, cont.ID)
+		} else {
+			limit = rateLimit{rate: rate, burst: rate}
+		}
+	}
+	if value := cont.Setting(rateLimitBurstEnv, rateLimitBurstLabel); value != "" {
+		burst, err := strconv.ParseFloat(value, 64)
+		if err != nil || burst < 0 {
+			bslog.Warnf("invalid log rate limit burst %q for container %s, using the default", value, cont.ID)
+		} else {
+			limit.burst = burst
+		}
+	}
+	if limit.burst < 1 {
+		limit.burst = 1
+	}
+	l.limits.Add(cont.ID, limit)
+	return limit
+}
+
+// allow reports whether the message in parts should be sent. Messages above
+// the limit are counted and a summary is sent before the next allowed one.
+// Containers of an app share a bucket only when their limits are the same,
+// each overridden limit is enforced on its own.
+func (l *rateLimiter) allow(parts *rawLogParts, cont *container.Container) bool {
+	limit := l.containerLimit(cont)
+	if limit.rate <= 0 {
+		return true
+	}
+	key := cont.AppName
+	if l.byProcess {
+		key += "/" + cont.ProcessName
+	}
+	key += fmt.Sprintf("|%g|%g", limit.rate, limit.burst)
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{limit: limit, tokens: limit.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		if b.suppressed > 0 {
+			l.sendSummary(b, now)
+		}
+		return true
+	}
+	b.suppressed++
+	b.priority, _ = strconv.Atoi(string(parts.priority))
+	b.container = string(parts.container)
+	b.appName = cont.AppName
+	b.processName = cont.ProcessName
+	messagesSuppressed.WithLabelValues(cont.AppName).Inc()
+	return false
+}
+
+// sendSummary sends a warning with the number of messages suppressed in the
+// stream of the last suppressed message.
+func (l *rateLimiter) sendSummary(b *tokenBucket, now time.Time) {
+	priority := b.priority&^7 | 4
+	l.send(&rawLogParts{
+		ts:        now,
+		priority:  []byte(strconv.Itoa(priority)),
+		content:   []byte(fmt.Sprintf("%d messages suppressed by bs due to log rate limit", b.suppressed)),
+		container: []byte(b.container),
+	}, b.appName, b.processName, b.container)
+	b.suppressed = 0
+}
+
+// summaryLoop sends summaries for apps no longer throttled even if they don't
+// send new messages and removes buckets that are full.
+func (l *rateLimiter) summaryLoop() {
+	defer close(l.done)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.quit:
+			return
+		case <-t.C:
+			l.mu.Lock()
+			l.flush(false)
+			l.mu.Unlock()
+		}
+	}
+}
+
+func (l *rateLimiter) flush(all bool) {
+	now := l.now()
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.suppressed > 0 && (all || b.tokens >= 1) {
+			l.sendSummary(b, now)
+		}
+		if b.suppressed == 0 && b.tokens >= b.limit.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// stop sends the summaries for all apps with suppressed messages.
+func (l *rateLimiter) stop() {
+	close(l.quit)
+	<-l.done
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flush(true)
+}
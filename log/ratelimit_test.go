@@ -0,0 +1,164 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/container"
+	"gopkg.in/check.v1"
+)
+
+func newTestContainer(id, appName, processName string, env []string, labels map[string]string) *container.Container {
+	return &container.Container{
+		Container: docker.Container{
+			ID:     id,
+			Config: &docker.Config{Env: env, Labels: labels},
+		},
+		AppName:     appName,
+		ProcessName: processName,
+	}
+}
+
+func (s *S) TestRateLimiter(c *check.C) {
+	os.Setenv("LOG_RATE_LIMIT", "2")
+	os.Setenv("LOG_RATE_LIMIT_BURST", "3")
+	var recorder multilineRecorder
+	l, err := newRateLimiter(recorder.send)
+	c.Assert(err, check.IsNil)
+	defer l.stop()
+	now := time.Date(2017, 3, 9, 10, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	app1 := newTestContainer("c1", "app1", "web", nil, nil)
+	app1Worker := newTestContainer("c2", "app1", "worker", nil, nil)
+	app2 := newTestContainer("c3", "app2", "web", nil, nil)
+	parts := &rawLogParts{priority: []byte("30"), container: []byte("c1")}
+	var allowed []bool
+	for i := 0; i < 5; i++ {
+		allowed = append(allowed, l.allow(parts, app1))
+	}
+	c.Assert(allowed, check.DeepEquals, []bool{true, true, true, false, false})
+	c.Assert(l.allow(parts, app1Worker), check.Equals, false)
+	c.Assert(l.allow(parts, app2), check.Equals, true)
+	c.Assert(recorder.get(), check.HasLen, 0)
+	now = now.Add(500 * time.Millisecond)
+	c.Assert(l.allow(parts, app1), check.Equals, true)
+	c.Assert(recorder.get(), check.DeepEquals, []string{"c1|3 messages suppressed by bs due to log rate limit"})
+	c.Assert(l.allow(parts, app1), check.Equals, false)
+	c.Assert(messagesSuppressed.WithLabelValues("app1").Value(), check.Equals, uint64(4))
+}
+
+func (s *S) TestRateLimiterSummaryWithoutNewMessages(c *check.C) {
+	os.Setenv("LOG_RATE_LIMIT", "1")
+	os.Setenv("LOG_RATE_LIMIT_BY_PROCESS", "true")
+	var recorder multilineRecorder
+	var sentParts []rawLogParts
+	l, err := newRateLimiter(func(parts *rawLogParts, appName, processName, container string) {
+		sentParts = append(sentParts, *parts)
+		recorder.send(parts, appName, processName, container)
+	})
+	c.Assert(err, check.IsNil)
+	close(l.quit)
+	<-l.done
+	now := time.Date(2017, 3, 9, 10, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	web := newTestContainer("c1", "app1", "web", nil, nil)
+	worker := newTestContainer("c2", "app1", "worker", nil, nil)
+	c.Assert(l.allow(&rawLogParts{priority: []byte("14"), container: []byte("c1")}, web), check.Equals, true)
+	c.Assert(l.allow(&rawLogParts{priority: []byte("14"), container: []byte("c1")}, web), check.Equals, false)
+	c.Assert(l.allow(&rawLogParts{priority: []byte("30"), container: []byte("c2")}, worker), check.Equals, true)
+	l.flush(false)
+	c.Assert(recorder.get(), check.HasLen, 0)
+	now = now.Add(time.Second)
+	l.flush(false)
+	c.Assert(recorder.get(), check.DeepEquals, []string{"c1|1 messages suppressed by bs due to log rate limit"})
+	c.Assert(string(sentParts[0].priority), check.Equals, "12")
+	c.Assert(sentParts[0].ts, check.DeepEquals, now)
+	now = now.Add(time.Second)
+	l.flush(false)
+	c.Assert(l.buckets, check.HasLen, 0)
+}
+
+func (s *S) TestRateLimiterContainerOverrides(c *check.C) {
+	os.Setenv("LOG_RATE_LIMIT", "100")
+	l, err := newRateLimiter(nil)
+	c.Assert(err, check.IsNil)
+	defer l.stop()
+	tests := []struct {
+		env      []string
+		labels   map[string]string
+		expected rateLimit
+	}{
+		{nil, nil, rateLimit{rate: 100, burst: 100}},
+		{[]string{"BS_LOG_RATE_LIMIT=10"}, nil, rateLimit{rate: 10, burst: 10}},
+		{[]string{"BS_LOG_RATE_LIMIT=0"}, nil, rateLimit{rate: 0, burst: 1}},
+		{nil, map[string]string{"bs.log.rate-limit": "5", "bs.log.rate-limit-burst": "50"}, rateLimit{rate: 5, burst: 50}},
+		{[]string{"BS_LOG_RATE_LIMIT=7"}, map[string]string{"bs.log.rate-limit": "5"}, rateLimit{rate: 7, burst: 7}},
+		{[]string{"BS_LOG_RATE_LIMIT=abc", "BS_LOG_RATE_LIMIT_BURST=-1"}, nil, rateLimit{rate: 100, burst: 100}},
+	}
+	for i, tt := range tests {
+		cont := newTestContainer(fmt.Sprintf("c%d", i), "app", "web", tt.env, tt.labels)
+		c.Check(l.containerLimit(cont), check.DeepEquals, tt.expected, check.Commentf("test %d", i))
+	}
+	c.Assert(l.allow(&rawLogParts{}, newTestContainer("c2", "app", "web", nil, nil)), check.Equals, true)
+	c.Assert(l.buckets, check.HasLen, 0)
+}
+
+func (s *S) TestRateLimiterContainersWithDifferentLimits(c *check.C) {
+	os.Setenv("LOG_RATE_LIMIT", "1")
+	l, err := newRateLimiter(nil)
+	c.Assert(err, check.IsNil)
+	close(l.quit)
+	<-l.done
+	now := time.Date(2017, 3, 9, 10, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	limited := newTestContainer("c1", "app1", "web", nil, nil)
+	overridden := newTestContainer("c2", "app1", "web", []string{"BS_LOG_RATE_LIMIT=3"}, nil)
+	parts := &rawLogParts{priority: []byte("30")}
+	var allowed []bool
+	for i := 0; i < 4; i++ {
+		allowed = append(allowed, l.allow(parts, limited), l.allow(parts, overridden))
+	}
+	c.Assert(allowed, check.DeepEquals, []bool{true, true, false, true, false, true, false, false})
+	c.Assert(l.buckets, check.HasLen, 2)
+}
+
+func (s *S) TestLogForwarderRateLimit(c *check.C) {
+	os.Setenv("LOG_RATE_LIMIT", "1")
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn, err := net.ListenUDP("udp", addr)
+	c.Assert(err, check.IsNil)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write([]byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: msg%d\n", s.id, i)))
+		c.Assert(err, check.IsNil)
+	}
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: msg0\n", s.idShort))
+	time.Sleep(100 * time.Millisecond)
+	lf.stopWait()
+	n, err = udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Matches, fmt.Sprintf(`<28>\w+ +\d+ [\d:]+ %s coolappname\[procx\]: 2 messages suppressed by bs due to log rate limit\n`, s.idShort))
+}
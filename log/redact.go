@@ -0,0 +1,259 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tsuru/bs/config"
+)
+
+const defaultRedactionMask = "[REDACTED]"
+
+var builtinRedactionRuleNames = []string{"bearer", "aws", "password", "url", "card"}
+
+type redactionRule struct {
+	name        string
+	pattern     *regexp.Regexp
+	replacement []byte
+	// locate, when set, returns the start and end of the sensitive part of a
+	// match, or -1 if there's none. It's called again for the rest of the
+	// match after each part found.
+	locate func(match []byte) (int, int)
+}
+
+// apply replaces every match of the rule in content, expanding references to
+// capture groups in the replacement. It returns the number of replaced
+// matches.
+func (r *redactionRule) apply(content []byte) ([]byte, int) {
+	matches := r.pattern.FindAllSubmatchIndex(content, -1)
+	if len(matches) == 0 {
+		return content, 0
+	}
+	var buf []byte
+	var last, count int
+	for _, m := range matches {
+		if r.locate == nil {
+			buf = append(buf, content[last:m[0]]...)
+			buf = r.pattern.Expand(buf, r.replacement, content, m)
+			last = m[1]
+			count++
+			continue
+		}
+		for offset := m[0]; offset < m[1]; {
+			start, end := r.locate(content[offset:m[1]])
+			if start < 0 {
+				break
+			}
+			part := []int{offset + start, offset + end}
+			buf = append(buf, content[last:part[0]]...)
+			buf = r.pattern.Expand(buf, r.replacement, content, part)
+			last = part[1]
+			offset = part[1]
+			count++
+		}
+	}
+	if count == 0 {
+		return content, 0
+	}
+	return append(buf, content[last:]...), count
+}
+
+// builtinRedactionRules returns the built-in rules, using mask as the
+// replacement for the sensitive part of each match.
+func builtinRedactionRules(mask string) map[string]redactionRule {
+	mask = strings.Replace(mask, "$", "$$", -1)
+	return map[string]redactionRule{
+		"bearer": {
+			pattern:     regexp.MustCompile(`(?i)(\bbearer\s+)[\w\-.~+/]{8,}=*`),
+			replacement: []byte("${1}" + mask),
+		},
+		"aws": {
+			pattern:     regexp.MustCompile(`(?i)\b(?:AKIA|ASIA)[0-9A-Z]{16}\b|(\baws_secret_access_key\s*[=:]\s*)[\w/+]{40}`),
+			replacement: []byte("${1}" + mask),
+		},
+		"password": {
+			pattern:     regexp.MustCompile(`(?i)(\b(?:password|passwd|pwd|secret|token|api_?key)"?\s*[=:]\s*)("[^"]*"|[^\s&,;"'})\]]+)`),
+			replacement: []byte("${1}" + mask),
+		},
+		"url": {
+			pattern:     regexp.MustCompile(`(://[^:/@\s]+:)[^@/\s]+@`),
+			replacement: []byte("${1}" + mask + "@"),
+		},
+		"card": {
+			pattern:     regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+			replacement: []byte(mask),
+			locate:      locateCardNumber,
+		},
+	}
+}
+
+// locateCardNumber returns the start and end of the first card number in
+// match, a sequence of digit groups separated by spaces or dashes. Card
+// numbers are made of whole groups, so trailing or leading numbers, like a
+// CVV or an amount, are left out, and pass the Luhn checksum. The longest
+// number is used when more than one starting at the same group is valid.
+func locateCardNumber(match []byte) (int, int) {
+	var groups [][2]int
+	for i := 0; i < len(match); {
+		if match[i] < '0' || match[i] > '9' {
+			i++
+			continue
+		}
+		start := i
+		for i < len(match) && match[i] >= '0' && match[i] <= '9' {
+			i++
+		}
+		groups = append(groups, [2]int{start, i})
+	}
+	for i := range groups {
+		end, digits := -1, 0
+		for j := i; j < len(groups); j++ {
+			digits += groups[j][1] - groups[j][0]
+			if digits > 19 {
+				break
+			}
+			if digits >= 13 && isLuhnValid(match[groups[i][0]:groups[j][1]]) {
+				end = groups[j][1]
+			}
+		}
+		if end >= 0 {
+			return groups[i][0], end
+		}
+	}
+	return -1, -1
+}
+
+// isLuhnValid reports whether the digits in number, ignoring spaces and
+// dashes, pass the Luhn checksum used by card numbers.
+func isLuhnValid(number []byte) bool {
+	var sum, digits int
+	for i := len(number) - 1; i >= 0; i-- {
+		if number[i] == ' ' || number[i] == '-' {
+			continue
+		}
+		d := int(number[i] - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
+
+// redactor removes sensitive data from messages before they are sent to any
+// backend.
+type redactor struct {
+	rules []redactionRule
+}
+
+type customRedactionRule struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// newRedactor loads the rules from LOG_REDACT_RULES, a list of built-in rule
+// names, and LOG_REDACT_CUSTOM_RULES, a JSON list of rules. It returns nil if
+// no rule is enabled.
+func newRedactor() (*redactor, error) {
+	mask := config.StringEnvOrDefault(defaultRedactionMask, "LOG_REDACT_MASK")
+	builtin := builtinRedactionRules(mask)
+	var r redactor
+	names := config.StringsEnvOrDefault(nil, "LOG_REDACT_RULES")
+	if len(names) == 1 && names[0] == "all" {
+		names = builtinRedactionRuleNames
+	}
+	for _, name := range names {
+		rule, ok := builtin[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid redaction rule %q, expected all or some of %s", name, strings.Join(builtinRedactionRuleNames, ", "))
+		}
+		rule.name = name
+		r.rules = append(r.rules, rule)
+	}
+	customRules := config.StringEnvOrDefault("", "LOG_REDACT_CUSTOM_RULES")
+	if customRules != "" {
+		var rules []customRedactionRule
+		err := json.Unmarshal([]byte(customRules), &rules)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse LOG_REDACT_CUSTOM_RULES: %s", err)
+		}
+		for i, rule := range rules {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern in LOG_REDACT_CUSTOM_RULES: %s", err)
+			}
+			if rule.Name == "" {
+				rule.Name = fmt.Sprintf("custom%d", i)
+			}
+			if rule.Replacement == "" {
+				rule.Replacement = strings.Replace(mask, "$", "$$", -1)
+			}
+			r.rules = append(r.rules, redactionRule{
+				name:        rule.Name,
+				pattern:     pattern,
+				replacement: []byte(rule.Replacement),
+			})
+		}
+	}
+	if len(r.rules) == 0 {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// redact returns content with all rules applied, counting the redactions for
+// appName.
+func (r *redactor) redact(content []byte, appName string) []byte {
+	for i := range r.rules {
+		var count int
+		content, count = r.rules[i].apply(content)
+		if count > 0 {
+			messagesRedacted.WithLabelValues(appName, r.rules[i].name).Add(uint64(count))
+		}
+	}
+	return content
+}
+
+// redactFields returns a copy of fields with all rules applied to the string
+// values, including the ones nested in maps and slices.
+func (r *redactor) redactFields(fields []logField, appName string) []logField {
+	if len(fields) == 0 {
+		return fields
+	}
+	redacted := make([]logField, len(fields))
+	for i, field := range fields {
+		redacted[i] = logField{key: field.key, value: r.redactValue(field.value, appName)}
+	}
+	return redacted
+}
+
+func (r *redactor) redactValue(value interface{}, appName string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return string(r.redact([]byte(v), appName))
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i := range v {
+			values[i] = r.redactValue(v[i], appName)
+		}
+		return values
+	case map[string]interface{}:
+		values := make(map[string]interface{}, len(v))
+		for k := range v {
+			values[k] = r.redactValue(v[k], appName)
+		}
+		return values
+	}
+	return value
+}
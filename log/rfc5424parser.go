@@ -0,0 +1,133 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// isRFC5424 reports whether line starts with a PRI followed by the RFC 5424
+// version, which can't be mistaken for the timestamp of BSD style messages.
+func isRFC5424(line []byte) bool {
+	if len(line) == 0 || line[0] != '<' {
+		return false
+	}
+	end := bytes.IndexByte(line, '>')
+	return end > 1 && len(line) > end+2 && line[end+1] == '1' && line[end+2] == ' '
+}
+
+// parseRFC5424 parses a RFC 5424 message into parts. The container is taken
+// from the APP-NAME, after the first slash as in BSD style tags, and
+// structured data params are stored as fields.
+func parseRFC5424(line []byte, parts *rawLogParts) error {
+	end := bytes.IndexByte(line, '>')
+	for _, c := range line[1:end] {
+		if c < '0' || c > '9' {
+			return &parseError{line: line, msg: "invalid priority"}
+		}
+	}
+	parts.priority = line[1:end]
+	rest := line[end+3:]
+	var header [5][]byte
+	for i := range header {
+		idx := bytes.IndexByte(rest, ' ')
+		if idx <= 0 {
+			return &parseError{line: line, msg: "missing header fields"}
+		}
+		header[i] = rest[:idx]
+		rest = rest[idx+1:]
+	}
+	timestamp, appName := header[0], header[2]
+	if isNilValue(timestamp) {
+		parts.ts = time.Now()
+	} else {
+		var err error
+		parts.ts, err = time.Parse(time.RFC3339Nano, string(timestamp))
+		if err != nil {
+			return &parseError{line: line, msg: "unable to parse time as RFC3339"}
+		}
+	}
+	if !isNilValue(appName) {
+		parts.container = appName
+		if idx := bytes.IndexByte(appName, '/'); idx != -1 {
+			parts.container = appName[idx+1:]
+		}
+	}
+	fields, rest, err := parseStructuredData(rest)
+	if err != nil {
+		return &parseError{line: line, msg: err.Error()}
+	}
+	parts.fields = fields
+	if len(rest) > 0 {
+		if rest[0] != ' ' {
+			return &parseError{line: line, msg: "missing space after structured data"}
+		}
+		rest = bytes.TrimPrefix(rest[1:], utf8BOM)
+	}
+	parts.content = rest
+	return nil
+}
+
+func isNilValue(value []byte) bool {
+	return len(value) == 1 && value[0] == '-'
+}
+
+// parseStructuredData returns the params of the structured data elements at
+// the start of data, keyed by param name, and the remaining data.
+func parseStructuredData(data []byte) ([]logField, []byte, error) {
+	if len(data) > 0 && data[0] == '-' {
+		return nil, data[1:], nil
+	}
+	if len(data) == 0 || data[0] != '[' {
+		return nil, nil, errors.New("invalid structured data")
+	}
+	var fields []logField
+	i := 0
+	for i < len(data) && data[i] == '[' {
+		i++
+		for i < len(data) && data[i] != ' ' && data[i] != ']' {
+			i++
+		}
+		for {
+			for i < len(data) && data[i] == ' ' {
+				i++
+			}
+			if i >= len(data) {
+				return nil, nil, errors.New("unterminated structured data element")
+			}
+			if data[i] == ']' {
+				i++
+				break
+			}
+			start := i
+			for i < len(data) && data[i] != '=' && data[i] != ' ' && data[i] != ']' {
+				i++
+			}
+			if i+1 >= len(data) || data[i] != '=' || data[i+1] != '"' || i == start {
+				return nil, nil, errors.New("invalid structured data param")
+			}
+			name := string(data[start:i])
+			i += 2
+			var value []byte
+			for i < len(data) && data[i] != '"' {
+				if data[i] == '\\' && i+1 < len(data) && (data[i+1] == '"' || data[i+1] == '\\' || data[i+1] == ']') {
+					i++
+				}
+				value = append(value, data[i])
+				i++
+			}
+			if i >= len(data) {
+				return nil, nil, errors.New("unterminated structured data param value")
+			}
+			i++
+			fields = append(fields, logField{key: name, value: string(value)})
+		}
+	}
+	return fields, data[i:], nil
+}
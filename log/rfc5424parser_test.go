@@ -0,0 +1,127 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"gopkg.in/check.v1"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+func (s *S) TestIsRFC5424(c *check.C) {
+	c.Assert(isRFC5424([]byte("<30>1 2015-06-05T16:13:47Z host app - - - msg")), check.Equals, true)
+	c.Assert(isRFC5424([]byte("<30>2015-06-05T16:13:47Z host docker/id: msg")), check.Equals, false)
+	c.Assert(isRFC5424([]byte("<30> May 13 21:10:17 host docker/id: msg")), check.Equals, false)
+	c.Assert(isRFC5424([]byte("<30>1")), check.Equals, false)
+	c.Assert(isRFC5424([]byte("30>1 x")), check.Equals, false)
+}
+
+func (s *S) TestLenientParserParseRFC5424(c *check.C) {
+	examples := []string{
+		"<30>1 2015-06-05T16:13:47Z myhost docker/00dfa98fe8e0 4843 - - hey",
+		"<27>1 2015-06-05T16:13:47.123456-03:00 myhost 00dfa98fe8e0 - msgid - \xef\xbb\xbfhey there",
+		`<30>1 2015-06-05T16:13:47Z myhost 00dfa98fe8e0 - - [meta seq="1" a="x\"y\]z\\"][origin ip="10.0.0.1"] hey`,
+		`<30>1 2015-06-05T16:13:47Z myhost 00dfa98fe8e0 - - [exampleSDID@32473]`,
+	}
+	expected := []format.LogParts{
+		{"parts": &rawLogParts{
+			ts:        time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+			priority:  []byte("30"),
+			content:   []byte("hey"),
+			container: []byte("00dfa98fe8e0"),
+		}},
+		{"parts": &rawLogParts{
+			ts:        time.Date(2015, 6, 5, 19, 13, 47, 123456000, time.UTC),
+			priority:  []byte("27"),
+			content:   []byte("hey there"),
+			container: []byte("00dfa98fe8e0"),
+		}},
+		{"parts": &rawLogParts{
+			ts:        time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+			priority:  []byte("30"),
+			content:   []byte("hey"),
+			container: []byte("00dfa98fe8e0"),
+			fields: []logField{
+				{key: "seq", value: "1"},
+				{key: "a", value: `x"y]z\`},
+				{key: "ip", value: "10.0.0.1"},
+			},
+		}},
+		{"parts": &rawLogParts{
+			ts:        time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+			priority:  []byte("30"),
+			content:   []byte{},
+			container: []byte("00dfa98fe8e0"),
+		}},
+	}
+	for i, line := range examples {
+		lp := LenientParser{line: []byte(line)}
+		err := lp.Parse()
+		c.Assert(err, check.IsNil, check.Commentf("error in %d", i))
+		parts := lp.Dump()["parts"].(*rawLogParts)
+		c.Check(parts.ts.Equal(expected[i]["parts"].(*rawLogParts).ts), check.Equals, true, check.Commentf("error in %d", i))
+		parts.ts = expected[i]["parts"].(*rawLogParts).ts
+		c.Check(parts, check.DeepEquals, expected[i]["parts"], check.Commentf("error in %d", i))
+	}
+}
+
+func (s *S) TestLenientParserParseRFC5424NilValues(c *check.C) {
+	lp := LenientParser{line: []byte("<30>1 - - - - - - hey")}
+	err := lp.Parse()
+	c.Assert(err, check.IsNil)
+	parts := lp.Dump()["parts"].(*rawLogParts)
+	c.Assert(time.Since(parts.ts) < time.Minute, check.Equals, true)
+	c.Assert(parts.container, check.IsNil)
+	c.Assert(string(parts.content), check.Equals, "hey")
+}
+
+func (s *S) TestLenientParserParseRFC5424Invalid(c *check.C) {
+	examples := map[string]string{
+		"<3x>1 - - - - - - hey":                        "invalid priority",
+		"<30>1 - - app":                                "missing header fields",
+		"<30>1 yesterday host app - - - hey":           "unable to parse time as RFC3339",
+		"<30>1 - host app - - hey":                     "invalid structured data",
+		`<30>1 - host app - - [id a="b"`:               "unterminated structured data element",
+		`<30>1 - host app - - [id a=b] hey`:            "invalid structured data param",
+		`<30>1 - host app - - [id a="b] hey`:           "unterminated structured data param value",
+		`<30>1 - host app - - [id a="b"]hey`:           "missing space after structured data",
+		"<30>1 2015-06-05T16:13:47 host app - - - hey": "unable to parse time as RFC3339",
+	}
+	for line, msg := range examples {
+		lp := LenientParser{line: []byte(line)}
+		err := lp.Parse()
+		c.Check(err, check.ErrorMatches, fmt.Sprintf("could not parse .*: %s", msg), check.Commentf("line: %s", line))
+	}
+}
+
+func (s *S) TestLogForwarderRFC5424OctetCountedTCP(c *check.C) {
+	udpConn := listenUDP(c)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	lf := LogForwarder{
+		BindAddress:     "tcp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("tcp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	frame := fmt.Sprintf(`<30>1 2015-06-05T16:13:47Z myhost docker/%s - - [meta seq="1"] first line`+"\nsecond line", s.id)
+	_, err = conn.Write([]byte(fmt.Sprintf("%d %s", len(frame), frame)))
+	c.Assert(err, check.IsNil)
+	_, err = conn.Write([]byte(fmt.Sprintf("<27>2015-06-05T16:13:47Z myhost docker/%s: lenient\n", s.id)))
+	c.Assert(err, check.IsNil)
+	c.Assert(readUDPMessages(c, udpConn), check.DeepEquals, []string{
+		fmt.Sprintf("<27>Jun  5 13:13:47 %s coolappname[procx]: lenient\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: first line\nsecond line\n", s.idShort),
+	})
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+
+	severityErr  = 3
+	severityInfo = 6
+	// facilityUser is used for messages without a valid priority.
+	facilityUser = 1 << 3
+)
+
+var syslogSeverityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+var levelNames = map[string]string{
+	"emerg":       "emerg",
+	"emergency":   "emerg",
+	"panic":       "emerg",
+	"alert":       "alert",
+	"crit":        "crit",
+	"critical":    "crit",
+	"fatal":       "crit",
+	"err":         "err",
+	"error":       "err",
+	"warn":        "warning",
+	"warning":     "warning",
+	"notice":      "notice",
+	"info":        "info",
+	"information": "info",
+	"debug":       "debug",
+	"trace":       "debug",
+}
+
+// defaultLevelFields are the keys holding the level of structured messages.
+var defaultLevelFields = []string{"level", "severity", "lvl"}
+
+// parseLevel returns the syslog severity name for a level name commonly used
+// by logging libraries, or an empty string if it's unknown.
+func parseLevel(level string) string {
+	return levelNames[strings.ToLower(level)]
+}
+
+// severityValue returns the numeric value of a syslog severity name.
+func severityValue(name string) int {
+	for i, severity := range syslogSeverityNames {
+		if severity == name {
+			return i
+		}
+	}
+	return severityInfo
+}
+
+// severity returns the name of the message severity. The level found in the
+// message takes precedence over the syslog priority, which takes precedence
+// over the output stream. Other messages are considered info.
+func (p *rawLogParts) severity() string {
+	if p.level != "" {
+		return p.level
+	}
+	priority, err := strconv.Atoi(string(p.priority))
+	if err == nil && priority >= 0 {
+		return syslogSeverityNames[priority&7]
+	}
+	if p.stream == streamStderr {
+		return syslogSeverityNames[severityErr]
+	}
+	return syslogSeverityNames[severityInfo]
+}
+
+// resolveSeverity sets the level of parts to its severity, looking for level
+// markers in the content when no level was parsed, and updates the priority
+// to match it, so every backend sees the same severity.
+func resolveSeverity(parts *rawLogParts) {
+	if parts.level == "" {
+		parts.level = messageLevel(parts.content)
+	}
+	parts.level = parts.severity()
+	facility := facilityUser
+	if priority, err := strconv.Atoi(string(parts.priority)); err == nil && priority >= 0 {
+		facility = priority &^ 7
+	}
+	priority := strconv.Itoa(facility | severityValue(parts.level))
+	if priority != string(parts.priority) {
+		parts.priority = []byte(priority)
+	}
+}
+
+// messageLevel returns the severity name of a level marker in content, either
+// a level=value pair or a leading level word such as ERROR, [warn] or INFO:.
+func messageLevel(content []byte) string {
+	if level := leadingLevel(content); level != "" {
+		return level
+	}
+	for _, field := range parseLogfmtFields(content) {
+		if containsString(defaultLevelFields, field.key) {
+			if level := parseLevel(fieldString(field.value)); level != "" {
+				return level
+			}
+		}
+	}
+	return ""
+}
+
+// leadingLevel returns the severity name of the first word of content if it's
+// a level name in upper case or between brackets, optionally followed by a
+// colon.
+func leadingLevel(content []byte) string {
+	content = bytes.TrimLeft(content, " \t")
+	end := bytes.IndexAny(content, " \t")
+	if end == -1 {
+		end = len(content)
+	}
+	word := bytes.TrimSuffix(content[:end], []byte(":"))
+	if len(word) > 2 && word[0] == '[' && word[len(word)-1] == ']' {
+		return parseLevel(string(word[1 : len(word)-1]))
+	}
+	if !bytes.Equal(word, bytes.ToUpper(word)) {
+		return ""
+	}
+	return parseLevel(string(word))
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestRawLogPartsSeverity(c *check.C) {
+	tests := []struct {
+		parts    rawLogParts
+		expected string
+	}{
+		{rawLogParts{}, "info"},
+		{rawLogParts{priority: []byte("27")}, "err"},
+		{rawLogParts{priority: []byte("30")}, "info"},
+		{rawLogParts{priority: []byte("31")}, "debug"},
+		{rawLogParts{priority: []byte("x"), stream: "stderr"}, "err"},
+		{rawLogParts{stream: "stdout"}, "info"},
+		{rawLogParts{priority: []byte("30"), stream: "stderr"}, "info"},
+		{rawLogParts{priority: []byte("27"), level: "warning"}, "warning"},
+	}
+	for i, tt := range tests {
+		c.Check(tt.parts.severity(), check.Equals, tt.expected, check.Commentf("test %d", i))
+	}
+}
+
+func (s *S) TestMessageLevel(c *check.C) {
+	tests := []struct {
+		content  string
+		expected string
+	}{
+		{"ERROR something failed", "err"},
+		{"  WARN: disk almost full", "warning"},
+		{"[error] something failed", "err"},
+		{"[Info] started", "info"},
+		{"FATAL", "crit"},
+		{"Error connecting is just text", ""},
+		{"ERRORS everywhere", ""},
+		{"request done level=error status=500", "err"},
+		{`lvl=debug msg="x"`, "debug"},
+		{"level=verbose severity=notice", "notice"},
+		{"mylevel=error", ""},
+		{"nothing here", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		c.Check(messageLevel([]byte(tt.content)), check.Equals, tt.expected, check.Commentf("content: %q", tt.content))
+	}
+}
+
+func (s *S) TestResolveSeverity(c *check.C) {
+	tests := []struct {
+		parts    rawLogParts
+		level    string
+		priority string
+	}{
+		{rawLogParts{priority: []byte("30"), content: []byte("all good")}, "info", "30"},
+		{rawLogParts{priority: []byte("30"), content: []byte("level=error boom")}, "err", "27"},
+		{rawLogParts{priority: []byte("27"), content: []byte("INFO: started")}, "info", "30"},
+		{rawLogParts{priority: []byte("27"), content: []byte("boom"), stream: "stderr"}, "err", "27"},
+		{rawLogParts{priority: []byte("134"), content: []byte("[warn] slow")}, "warning", "132"},
+		{rawLogParts{priority: []byte("30"), content: []byte("level=error"), level: "notice"}, "notice", "29"},
+		{rawLogParts{content: []byte("boom"), stream: "stderr"}, "err", "11"},
+	}
+	for i, tt := range tests {
+		resolveSeverity(&tt.parts)
+		c.Check(tt.parts.level, check.Equals, tt.level, check.Commentf("test %d", i))
+		c.Check(string(tt.parts.priority), check.Equals, tt.priority, check.Commentf("test %d", i))
+	}
+}
+
+func (s *S) TestLogForwarderSeverityAllBackends(c *check.C) {
+	bodyCh := make(chan string, 10)
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		scanner := bufio.NewScanner(ws)
+		for scanner.Scan() {
+			bodyCh <- scanner.Text()
+		}
+	}))
+	defer srv.Close()
+	os.Setenv("TSURU_ENDPOINT", srv.URL)
+	os.Setenv("TSURU_TOKEN", "mytoken")
+	udpConn := listenUDP(c)
+	defer udpConn.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+udpConn.LocalAddr().String())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"tsuru", "syslog"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: request failed level=error\n", s.id)))
+	c.Assert(err, check.IsNil)
+	var entry tsuruLogEntry
+	err = json.Unmarshal([]byte(recvTimeout(c, bodyCh)), &entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(entry.Message, check.Equals, "request failed level=error")
+	c.Assert(entry.Severity, check.Equals, "err")
+	buffer := make([]byte, 1024)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buffer[:n]), check.Equals, fmt.Sprintf("<27>Jun  5 13:13:47 %s coolappname[procx]: request failed level=error\n", s.idShort))
+}
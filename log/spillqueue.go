@@ -0,0 +1,531 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tsuru/bs/bslog"
+)
+
+const (
+	defaultSpillMaxSize     = 100 * 1024 * 1024
+	defaultSpillSegmentSize = 4 * 1024 * 1024
+
+	spillSegmentSuffix = ".seg"
+	spillCursorFile    = "cursor"
+	spillRecordHeader  = 4
+
+	// Segments are numbered starting at this base so that messages recovered
+	// from the in-memory buffer on shutdown can be placed in segments that
+	// come before the ones already on disk.
+	spillFirstSegment = uint64(1) << 32
+)
+
+var errSpillFull = errors.New("spill queue size limit reached")
+
+// spillCodec is implemented by forwarders whose messages can be written to a
+// disk spill queue.
+type spillCodec interface {
+	encodeMessage(msg LogMessage) ([]byte, error)
+	decodeMessage(data []byte) (LogMessage, error)
+}
+
+// diskQueue is a FIFO of opaque records stored in segment files inside dir.
+// Fully consumed segments are removed and the read position in the first
+// segment is saved in a cursor file on close, so pending records survive a
+// restart.
+type diskQueue struct {
+	mu           sync.Mutex
+	dir          string
+	maxSize      int64
+	segmentSize  int64
+	size         int64
+	count        int
+	segments     []uint64
+	writer       *os.File
+	writeSize    int64
+	reader       *os.File
+	readOffset   int64
+	head         []byte
+	cursorSeq    uint64
+	cursorOffset int64
+	available    chan struct{}
+}
+
+func newDiskQueue(dir string, maxSize, segmentSize int) (*diskQueue, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	q := &diskQueue{
+		dir:         dir,
+		maxSize:     int64(maxSize),
+		segmentSize: int64(segmentSize),
+		available:   make(chan struct{}, 1),
+	}
+	err = q.load()
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *diskQueue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, spillSegmentSuffix))
+}
+
+func (q *diskQueue) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, spillCursorFile))
+	if err == nil {
+		parts := strings.Fields(string(data))
+		if len(parts) == 2 {
+			q.cursorSeq, _ = strconv.ParseUint(parts[0], 10, 64)
+			q.cursorOffset, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// Glob returns the names sorted and segment names are zero padded, so
+	// segments are loaded in order.
+	files, err := filepath.Glob(filepath.Join(q.dir, "*"+spillSegmentSuffix))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(f), spillSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, seq)
+	}
+	for _, seq := range q.segments {
+		count, size, err := q.scanSegment(seq)
+		if err != nil {
+			return err
+		}
+		q.count += count
+		q.size += size
+	}
+	if q.count == 0 {
+		return q.reset()
+	}
+	return nil
+}
+
+// scanSegment counts the pending records in a segment, truncating a partial
+// record left behind by an unclean shutdown.
+func (q *diskQueue) scanSegment(seq uint64) (int, int64, error) {
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_RDWR, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	var offset int64
+	count := 0
+	header := make([]byte, spillRecordHeader)
+	for {
+		_, err = f.ReadAt(header, offset)
+		if err != nil {
+			break
+		}
+		next := offset + spillRecordHeader + int64(binary.BigEndian.Uint32(header))
+		if next > stat.Size() {
+			break
+		}
+		offset = next
+		if seq != q.cursorSeq || offset > q.cursorOffset {
+			count++
+		}
+	}
+	if offset < stat.Size() {
+		err = f.Truncate(offset)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return count, offset, nil
+}
+
+// reset removes every segment and the cursor, leaving an empty queue.
+func (q *diskQueue) reset() error {
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+	if q.writer != nil {
+		q.writer.Close()
+		q.writer = nil
+	}
+	for _, seq := range q.segments {
+		err := os.Remove(q.segmentPath(seq))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := os.Remove(filepath.Join(q.dir, spillCursorFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.segments = nil
+	q.size = 0
+	q.count = 0
+	q.writeSize = 0
+	q.readOffset = 0
+	q.head = nil
+	q.cursorSeq = 0
+	q.cursorOffset = 0
+	return nil
+}
+
+func (q *diskQueue) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+func encodeRecord(data []byte) []byte {
+	record := make([]byte, spillRecordHeader+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[spillRecordHeader:], data)
+	return record
+}
+
+func (q *diskQueue) push(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	record := encodeRecord(data)
+	recordSize := int64(len(record))
+	if q.size+recordSize > q.maxSize {
+		return errSpillFull
+	}
+	if q.writer == nil || (q.writeSize > 0 && q.writeSize+recordSize > q.segmentSize) {
+		err := q.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := q.writer.Write(record)
+	q.writeSize += int64(n)
+	q.size += int64(n)
+	if err != nil {
+		return err
+	}
+	q.count++
+	select {
+	case q.available <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *diskQueue) rotate() error {
+	seq := spillFirstSegment
+	if len(q.segments) > 0 {
+		seq = q.segments[len(q.segments)-1] + 1
+	}
+	if q.writer != nil {
+		q.writer.Close()
+	}
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		q.writer = nil
+		return err
+	}
+	q.writer = f
+	q.writeSize = 0
+	q.segments = append(q.segments, seq)
+	return nil
+}
+
+// prepend stores records in a new segment placed before every existing one,
+// so they are the first to be read.
+func (q *diskQueue) prepend(records [][]byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	seq := spillFirstSegment
+	if len(q.segments) > 0 {
+		seq = q.segments[0] - 1
+	}
+	var buf []byte
+	for _, data := range records {
+		buf = append(buf, encodeRecord(data)...)
+	}
+	err := ioutil.WriteFile(q.segmentPath(seq), buf, 0600)
+	if err != nil {
+		return err
+	}
+	if q.reader != nil {
+		q.cursorSeq, q.cursorOffset = q.segments[0], q.readOffset
+		q.reader.Close()
+		q.reader = nil
+		q.head = nil
+	}
+	q.segments = append([]uint64{seq}, q.segments...)
+	q.size += int64(len(buf))
+	q.count += len(records)
+	return nil
+}
+
+// peek returns the oldest pending record without removing it, or nil if the
+// queue is empty.
+func (q *diskQueue) peek() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.count == 0 {
+		return nil, nil
+	}
+	if q.head != nil {
+		return q.head, nil
+	}
+	header := make([]byte, spillRecordHeader)
+	for {
+		if q.reader == nil {
+			err := q.openReader()
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err := io.ReadFull(q.reader, header)
+		if err == io.EOF && len(q.segments) > 1 {
+			err = q.nextSegment()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header))
+	_, err := io.ReadFull(q.reader, data)
+	if err != nil {
+		return nil, err
+	}
+	q.head = data
+	return data, nil
+}
+
+func (q *diskQueue) openReader() error {
+	seq := q.segments[0]
+	f, err := os.Open(q.segmentPath(seq))
+	if err != nil {
+		return err
+	}
+	q.readOffset = 0
+	if seq == q.cursorSeq {
+		q.readOffset = q.cursorOffset
+	}
+	_, err = f.Seek(q.readOffset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	q.reader = f
+	return nil
+}
+
+// pop removes the record returned by the last call to peek.
+func (q *diskQueue) pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.head == nil {
+		return nil
+	}
+	q.readOffset += int64(spillRecordHeader + len(q.head))
+	q.head = nil
+	q.count--
+	if q.count == 0 {
+		return q.reset()
+	}
+	if len(q.segments) > 1 {
+		stat, err := q.reader.Stat()
+		if err == nil && q.readOffset >= stat.Size() {
+			return q.nextSegment()
+		}
+	}
+	return nil
+}
+
+// skip discards the oldest record, it's used when a record cannot be read or
+// decoded.
+func (q *diskQueue) skip() error {
+	q.mu.Lock()
+	if q.head == nil {
+		// The record is unreadable, drop the whole segment.
+		q.mu.Unlock()
+		return q.dropSegment()
+	}
+	q.mu.Unlock()
+	return q.pop()
+}
+
+func (q *diskQueue) dropSegment() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.segments) <= 1 {
+		return q.reset()
+	}
+	count, _, err := q.scanSegment(q.segments[0])
+	if err == nil {
+		q.count -= count
+	}
+	return q.nextSegment()
+}
+
+func (q *diskQueue) nextSegment() error {
+	seq := q.segments[0]
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+	stat, err := os.Stat(q.segmentPath(seq))
+	if err == nil {
+		q.size -= stat.Size()
+	}
+	err = os.Remove(q.segmentPath(seq))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if seq == q.cursorSeq {
+		q.cursorSeq, q.cursorOffset = 0, 0
+	}
+	q.segments = q.segments[1:]
+	q.readOffset = 0
+	q.head = nil
+	return nil
+}
+
+// close releases open files and saves the read position in the cursor file.
+func (q *diskQueue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.writer != nil {
+		q.writer.Close()
+		q.writer = nil
+	}
+	if q.reader != nil {
+		q.cursorSeq, q.cursorOffset = q.segments[0], q.readOffset
+		q.reader.Close()
+		q.reader = nil
+		q.head = nil
+	}
+	if q.count == 0 {
+		return q.reset()
+	}
+	data := fmt.Sprintf("%d %d", q.cursorSeq, q.cursorOffset)
+	return ioutil.WriteFile(filepath.Join(q.dir, spillCursorFile), []byte(data), 0600)
+}
+
+func (q *messageQueue) startSpill(forwarder forwarderBackend, cfg queueConfig) error {
+	codec, ok := forwarder.(spillCodec)
+	if !ok {
+		return fmt.Errorf("log backend %q does not support spilling messages to disk", cfg.name)
+	}
+	spill, err := newDiskQueue(cfg.spillDir, cfg.spillMaxSize, cfg.spillSegmentSize)
+	if err != nil {
+		return fmt.Errorf("unable to open spill queue in %q: %s", cfg.spillDir, err)
+	}
+	q.spill = spill
+	q.codec = codec
+	stopWg.Add(1)
+	go q.replaySpill()
+	return nil
+}
+
+func (q *messageQueue) spillMessage(msg LogMessage) {
+	data, err := q.codec.encodeMessage(msg)
+	if err == nil {
+		err = q.spill.push(data)
+	}
+	if err != nil {
+		q.notifyDrop(fmt.Sprintf("error writing to spill queue: %s", err))
+		return
+	}
+	q.spilled.Inc()
+}
+
+// replaySpill moves messages from disk back to the in-memory channel, in
+// order, as the forwarder makes room for them.
+func (q *messageQueue) replaySpill() {
+	defer stopWg.Done()
+	for {
+		data, err := q.spill.peek()
+		if err != nil {
+			bslog.Errorf("[log forwarder] unable to read %s spill queue, discarding message: %s", q.name, err)
+			q.spill.skip()
+			continue
+		}
+		if data == nil {
+			select {
+			case <-q.spill.available:
+				continue
+			case <-q.quit:
+				return
+			}
+		}
+		msg, err := q.codec.decodeMessage(data)
+		if err != nil {
+			bslog.Errorf("[log forwarder] unable to decode %s spilled message, discarding: %s", q.name, err)
+			q.spill.skip()
+			continue
+		}
+		select {
+		case q.ch <- msg:
+			q.spill.pop()
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// flushSpill saves messages still in the in-memory channel ahead of the ones
+// already on disk and closes the spill queue.
+func (q *messageQueue) flushSpill() {
+	var records [][]byte
+loop:
+	for {
+		select {
+		case msg := <-q.ch:
+			if msg == nil {
+				continue
+			}
+			data, err := q.codec.encodeMessage(msg)
+			if err != nil {
+				bslog.Errorf("[log forwarder] unable to encode %s message on shutdown: %s", q.name, err)
+				continue
+			}
+			records = append(records, data)
+		default:
+			break loop
+		}
+	}
+	err := q.spill.prepend(records)
+	if err != nil {
+		bslog.Errorf("[log forwarder] unable to store %d pending %s messages: %s", len(records), q.name, err)
+	}
+	err = q.spill.close()
+	if err != nil {
+		bslog.Errorf("[log forwarder] unable to close %s spill queue: %s", q.name, err)
+	}
+}
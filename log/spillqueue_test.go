@@ -0,0 +1,305 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Graylog2/go-gelf/gelf"
+	"github.com/tsuru/tsuru/app"
+	"gopkg.in/check.v1"
+)
+
+type blockingForwarder struct {
+	release  chan struct{}
+	abort    chan struct{}
+	started  chan struct{}
+	received chan string
+}
+
+func newBlockingForwarder() *blockingForwarder {
+	return &blockingForwarder{
+		release:  make(chan struct{}),
+		abort:    make(chan struct{}),
+		started:  make(chan struct{}, 1),
+		received: make(chan string, 100),
+	}
+}
+
+func (f *blockingForwarder) connect() (net.Conn, error) {
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func (f *blockingForwarder) process(conn net.Conn, msg LogMessage) error {
+	select {
+	case f.started <- struct{}{}:
+	default:
+	}
+	select {
+	case <-f.release:
+	case <-f.abort:
+		return errors.New("aborted")
+	}
+	f.received <- msg.(string)
+	return nil
+}
+
+func (f *blockingForwarder) close(conn net.Conn) {
+	conn.Close()
+}
+
+func (f *blockingForwarder) encodeMessage(msg LogMessage) ([]byte, error) {
+	return []byte(msg.(string)), nil
+}
+
+func (f *blockingForwarder) decodeMessage(data []byte) (LogMessage, error) {
+	return string(data), nil
+}
+
+func withSpillDir(c *check.C) string {
+	dir, err := ioutil.TempDir("", "bs-spill")
+	c.Assert(err, check.IsNil)
+	return dir
+}
+
+func popAll(c *check.C, q *diskQueue) []string {
+	var result []string
+	for {
+		data, err := q.peek()
+		c.Assert(err, check.IsNil)
+		if data == nil {
+			return result
+		}
+		result = append(result, string(data))
+		err = q.pop()
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *S) TestDiskQueuePushPop(c *check.C) {
+	dir := withSpillDir(c)
+	defer os.RemoveAll(dir)
+	q, err := newDiskQueue(dir, 1024, 20)
+	c.Assert(err, check.IsNil)
+	var expected []string
+	for i := 0; i < 10; i++ {
+		msg := fmt.Sprintf("msg-%d", i)
+		err = q.push([]byte(msg))
+		c.Assert(err, check.IsNil)
+		expected = append(expected, msg)
+	}
+	c.Assert(q.pending(), check.Equals, 10)
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	c.Assert(err, check.IsNil)
+	c.Assert(len(files) > 1, check.Equals, true)
+	c.Assert(popAll(c, q), check.DeepEquals, expected)
+	c.Assert(q.pending(), check.Equals, 0)
+	files, err = filepath.Glob(filepath.Join(dir, "*"))
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.HasLen, 0)
+}
+
+func (s *S) TestDiskQueueMaxSize(c *check.C) {
+	dir := withSpillDir(c)
+	defer os.RemoveAll(dir)
+	q, err := newDiskQueue(dir, 20, 1024)
+	c.Assert(err, check.IsNil)
+	err = q.push([]byte("0123456789"))
+	c.Assert(err, check.IsNil)
+	err = q.push([]byte("0123456789"))
+	c.Assert(err, check.Equals, errSpillFull)
+	c.Assert(q.pending(), check.Equals, 1)
+}
+
+func (s *S) TestDiskQueueReopen(c *check.C) {
+	dir := withSpillDir(c)
+	defer os.RemoveAll(dir)
+	q, err := newDiskQueue(dir, 1024, 20)
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 6; i++ {
+		err = q.push([]byte(fmt.Sprintf("msg-%d", i)))
+		c.Assert(err, check.IsNil)
+	}
+	data, err := q.peek()
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "msg-0")
+	err = q.pop()
+	c.Assert(err, check.IsNil)
+	data, err = q.peek()
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "msg-1")
+	err = q.close()
+	c.Assert(err, check.IsNil)
+	q, err = newDiskQueue(dir, 1024, 20)
+	c.Assert(err, check.IsNil)
+	c.Assert(q.pending(), check.Equals, 5)
+	err = q.push([]byte("msg-6"))
+	c.Assert(err, check.IsNil)
+	c.Assert(popAll(c, q), check.DeepEquals, []string{"msg-1", "msg-2", "msg-3", "msg-4", "msg-5", "msg-6"})
+}
+
+func (s *S) TestDiskQueueReopenPartialRecord(c *check.C) {
+	dir := withSpillDir(c)
+	defer os.RemoveAll(dir)
+	q, err := newDiskQueue(dir, 1024, 1024)
+	c.Assert(err, check.IsNil)
+	err = q.push([]byte("msg-0"))
+	c.Assert(err, check.IsNil)
+	q.writer.Write([]byte{0, 0, 0, 10, 'x'})
+	q.writer.Close()
+	q, err = newDiskQueue(dir, 1024, 1024)
+	c.Assert(err, check.IsNil)
+	c.Assert(q.pending(), check.Equals, 1)
+	c.Assert(popAll(c, q), check.DeepEquals, []string{"msg-0"})
+}
+
+func (s *S) TestDiskQueuePrepend(c *check.C) {
+	dir := withSpillDir(c)
+	defer os.RemoveAll(dir)
+	q, err := newDiskQueue(dir, 1024, 1024)
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 3; i++ {
+		err = q.push([]byte(fmt.Sprintf("msg-%d", i)))
+		c.Assert(err, check.IsNil)
+	}
+	data, err := q.peek()
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "msg-0")
+	err = q.pop()
+	c.Assert(err, check.IsNil)
+	err = q.prepend([][]byte{[]byte("old-0"), []byte("old-1")})
+	c.Assert(err, check.IsNil)
+	err = q.close()
+	c.Assert(err, check.IsNil)
+	q, err = newDiskQueue(dir, 1024, 1024)
+	c.Assert(err, check.IsNil)
+	c.Assert(popAll(c, q), check.DeepEquals, []string{"old-0", "old-1", "msg-1", "msg-2"})
+}
+
+func (s *S) TestMessageQueueSpillReplayInOrder(c *check.C) {
+	dir := withSpillDir(c)
+	defer os.RemoveAll(dir)
+	fwd := newBlockingForwarder()
+	q, err := processMessages(fwd, queueConfig{
+		name:             "test",
+		bufferSize:       1,
+		spillDir:         dir,
+		spillMaxSize:     1024,
+		spillSegmentSize: 30,
+	})
+	c.Assert(err, check.IsNil)
+	defer func() {
+		q.stop()
+		stopWg.Wait()
+	}()
+	for i := 0; i < 10; i++ {
+		q.send(fmt.Sprintf("msg-%d", i))
+	}
+	c.Assert(q.spill.pending() > 0, check.Equals, true)
+	close(fwd.release)
+	for i := 0; i < 10; i++ {
+		select {
+		case msg := <-fwd.received:
+			c.Assert(msg, check.Equals, fmt.Sprintf("msg-%d", i))
+		case <-time.After(5 * time.Second):
+			c.Fatal("timeout waiting for message")
+		}
+	}
+}
+
+func (s *S) TestMessageQueueSpillSurvivesRestart(c *check.C) {
+	dir := withSpillDir(c)
+	defer os.RemoveAll(dir)
+	cfg := queueConfig{
+		name:             "test",
+		bufferSize:       2,
+		spillDir:         dir,
+		spillMaxSize:     1024,
+		spillSegmentSize: 1024,
+	}
+	fwd := newBlockingForwarder()
+	q, err := processMessages(fwd, cfg)
+	c.Assert(err, check.IsNil)
+	for i := 0; i < 5; i++ {
+		q.send(fmt.Sprintf("msg-%d", i))
+	}
+	select {
+	case <-fwd.started:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for forwarder")
+	}
+	close(fwd.abort)
+	q.stop()
+	stopWg.Wait()
+	fwd = newBlockingForwarder()
+	close(fwd.release)
+	q, err = processMessages(fwd, cfg)
+	c.Assert(err, check.IsNil)
+	defer func() {
+		q.stop()
+		stopWg.Wait()
+	}()
+	for i := 1; i < 5; i++ {
+		select {
+		case msg := <-fwd.received:
+			c.Assert(msg, check.Equals, fmt.Sprintf("msg-%d", i))
+		case <-time.After(5 * time.Second):
+			c.Fatal("timeout waiting for message")
+		}
+	}
+}
+
+func (s *S) TestSpillCodecs(c *check.C) {
+	syslogFwd := &syslogForwarder{bufferPool: &sync.Pool{
+		New: func() interface{} { return make([]byte, 10) },
+	}}
+	tests := []struct {
+		codec spillCodec
+		msg   LogMessage
+	}{
+		{
+			codec: syslogFwd,
+			msg:   bufferWithIdx{buffer: []byte("<30>header: content trailer\n"), headerIdx: 12, contentIdx: 19},
+		},
+		{
+			codec: &wsForwarder{},
+			msg: &tsuruLogEntry{
+				Applog: app.Applog{
+					Date:    time.Date(2017, 3, 21, 21, 28, 22, 0, time.UTC),
+					AppName: "myapp",
+					Message: "mymsg",
+					Source:  "web",
+					Unit:    "cont1",
+				},
+				Severity: "err",
+			},
+		},
+		{
+			codec: &gelfForwarder{},
+			msg: &gelf.Message{
+				Version: "1.1",
+				Host:    "cont1",
+				Short:   "mymsg",
+				Level:   gelf.LOG_ERR,
+				Extra:   map[string]interface{}{"_app": "myapp", "_pid": "web"},
+			},
+		},
+	}
+	for i, tt := range tests {
+		data, err := tt.codec.encodeMessage(tt.msg)
+		c.Assert(err, check.IsNil)
+		msg, err := tt.codec.decodeMessage(data)
+		c.Assert(err, check.IsNil)
+		c.Assert(msg, check.DeepEquals, tt.msg, check.Commentf("test %d", i))
+	}
+}
@@ -5,35 +5,87 @@
 package log
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/hashicorp/golang-lru"
 	"github.com/tsuru/bs/bslog"
 	"github.com/tsuru/bs/config"
+	"github.com/tsuru/bs/node"
 )
 
 const (
 	udpMessageDefaultMTU = 1500
 	udpHeaderSz          = 100 // Exagerated a bit due to possibility of ipv6 extensions, ipsec, etc.
+
+	syslogFormatRFC3164 = "rfc3164"
+	syslogFormatRFC5424 = "rfc5424"
+
+	// RFC 5424 allows at most 6 digits in the fraction of second.
+	rfc5424TimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+	// 32473 is the enterprise number reserved for documentation (RFC 5612),
+	// deployments with their own number should set
+	// LOG_SYSLOG_STRUCTURED_DATA_ID.
+	defaultStructuredDataID = "tsuru@32473"
+
+	syslogFramingNewline       = "newline"
+	syslogFramingOctetCounting = "octet-counting"
+
+	rfc5424HostnameMaxLen  = 255
+	rfc5424AppNameMaxLen   = 48
+	rfc5424ProcIDMaxLen    = 128
+	rfc5424ParamNameMaxLen = 32
+
+	syslogDestinationsLabel  = "bs.log.destinations"
+	syslogDefaultDestination = "default"
 )
 
 type syslogBackend struct {
 	syslogLocation   *time.Location
 	syslogExtraStart []byte
 	syslogExtraEnd   []byte
-	msgChans         []chan<- LogMessage
-	quitChans        []chan<- bool
+	syslogFormat     string
+	hostname         string
+	nodeAddr         string
+	structuredDataID string
+	addresses        []string
+	queues           []*messageQueue
 	bufferPool       sync.Pool
-	nextNotify       *time.Timer
+	forwarderCfg     syslogForwarder
+	queueCfg         queueConfig
+	routes           *lru.Cache
+	idleTimeout      time.Duration
+	mu               sync.Mutex
+	destinations     map[string]*syslogDestination
+	destErrors       map[string]time.Time
+	quit             chan struct{}
+}
+
+// syslogDestination is a forward address set in the container of some app,
+// its queue is stopped when no messages are sent to it for idleTimeout.
+type syslogDestination struct {
+	queue    *messageQueue
+	lastUsed time.Time
 }
 
 type syslogForwarder struct {
 	url           *url.URL
 	bufferPool    *sync.Pool
+	tlsConfig     *tls.Config
+	octetCounting bool
 	mtu           int
 	messageLimit  int
 	connCreatedAt time.Time
@@ -49,10 +101,10 @@ func (b *syslogBackend) initialize() error {
 	if extra != "" {
 		b.syslogExtraEnd = []byte(" " + os.ExpandEnv(extra))
 	}
-	bufferSize := config.IntEnvOrDefault(config.DefaultBufferSize, "LOG_SYSLOG_BUFFER_SIZE", "LOG_BUFFER_SIZE")
 	forwardAddresses := config.StringsEnvOrDefault(nil, "LOG_SYSLOG_FORWARD_ADDRESSES", "SYSLOG_FORWARD_ADDRESSES")
-	if len(forwardAddresses) == 0 {
-		return nil
+	err := b.initializeFormat()
+	if err != nil {
+		return err
 	}
 	syslogTimezone := config.StringEnvOrDefault("", "LOG_SYSLOG_TIMEZONE", "SYSLOG_TIMEZONE")
 	b.syslogLocation = time.Local
@@ -79,24 +131,125 @@ func (b *syslogBackend) initialize() error {
 			return make([]byte, 200)
 		},
 	}
-	b.nextNotify = time.NewTimer(0)
-	connMaxAge := config.SecondsEnvOrDefault(-1, "LOG_SYSLOG_CONN_MAX_AGE")
+	framing := config.StringEnvOrDefault(syslogFramingNewline, "LOG_SYSLOG_FRAMING")
+	if framing != syslogFramingNewline && framing != syslogFramingOctetCounting {
+		return fmt.Errorf("invalid syslog framing %q, expected %s or %s", framing, syslogFramingNewline, syslogFramingOctetCounting)
+	}
+	b.forwarderCfg = syslogForwarder{
+		bufferPool:    &b.bufferPool,
+		octetCounting: framing == syslogFramingOctetCounting,
+		mtu:           mtu,
+		connMaxAge:    config.SecondsEnvOrDefault(-1, "LOG_SYSLOG_CONN_MAX_AGE"),
+	}
+	b.queueCfg = newQueueConfig("syslog")
 	for _, addr := range forwardAddresses {
-		forwardUrl, err := url.Parse(addr)
+		queue, err := b.newQueue(addr, false)
 		if err != nil {
-			return fmt.Errorf("unable to parse %q: %s", addr, err)
+			return err
 		}
-		forwardChan, quitChan, err := processMessages(&syslogForwarder{
-			url:        forwardUrl,
-			bufferPool: &b.bufferPool,
-			mtu:        mtu,
-			connMaxAge: connMaxAge,
-		}, bufferSize)
+		b.addresses = append(b.addresses, addr)
+		b.queues = append(b.queues, queue)
+	}
+	b.routes, err = lru.New(100)
+	if err != nil {
+		return err
+	}
+	b.idleTimeout = config.SecondsEnvOrDefault(300, "LOG_SYSLOG_DESTINATION_IDLE_TIMEOUT")
+	b.destinations = map[string]*syslogDestination{}
+	b.destErrors = map[string]time.Time{}
+	b.quit = make(chan struct{})
+	go b.removeIdleDestinations()
+	return nil
+}
+
+// newQueue starts a forwarder to addr. With lazyConnect the first connection
+// is made by the forwarder goroutine, otherwise it's made before returning.
+func (b *syslogBackend) newQueue(addr string, lazyConnect bool) (*messageQueue, error) {
+	forwardUrl, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %q: %s", addr, err)
+	}
+	if isTLSScheme(forwardUrl.Scheme) && b.forwarderCfg.tlsConfig == nil {
+		b.forwarderCfg.tlsConfig, err = syslogTLSConfig()
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+	addrCfg := b.queueCfg
+	addrCfg.destination = addr
+	addrCfg.lazyConnect = lazyConnect
+	if addrCfg.spillDir != "" {
+		addrCfg.spillDir = filepath.Join(addrCfg.spillDir, forwardUrl.Scheme+"_"+strings.Replace(forwardUrl.Host, ":", "_", -1))
+	}
+	forwarder := b.forwarderCfg
+	forwarder.url = forwardUrl
+	return processMessages(&forwarder, addrCfg)
+}
+
+func isTLSScheme(scheme string) bool {
+	return scheme == "tls" || scheme == "tcp+tls"
+}
+
+// syslogTLSConfig loads the TLS settings used by tls:// and tcp+tls://
+// forward addresses from the LOG_SYSLOG_TLS_* environment variables.
+func syslogTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: config.StringEnvOrDefault("", "LOG_SYSLOG_TLS_SERVER_NAME"),
+	}
+	caFile := config.StringEnvOrDefault("", "LOG_SYSLOG_TLS_CA_FILE")
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read syslog tls ca file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in syslog tls ca file %q", caFile)
+		}
+	}
+	certFile := config.StringEnvOrDefault("", "LOG_SYSLOG_TLS_CERT_FILE")
+	keyFile := config.StringEnvOrDefault("", "LOG_SYSLOG_TLS_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("both LOG_SYSLOG_TLS_CERT_FILE and LOG_SYSLOG_TLS_KEY_FILE must be set to use a client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load syslog tls client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (b *syslogBackend) initializeFormat() error {
+	b.syslogFormat = config.StringEnvOrDefault(syslogFormatRFC3164, "LOG_SYSLOG_FORMAT")
+	switch b.syslogFormat {
+	case syslogFormatRFC3164:
+		return nil
+	case syslogFormatRFC5424:
+	default:
+		return fmt.Errorf("invalid syslog format %q, expected %s or %s", b.syslogFormat, syslogFormatRFC3164, syslogFormatRFC5424)
+	}
+	b.structuredDataID = config.StringEnvOrDefault(defaultStructuredDataID, "LOG_SYSLOG_STRUCTURED_DATA_ID")
+	b.hostname = config.StringEnvOrDefault("", "LOG_SYSLOG_HOSTNAME")
+	if b.hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			bslog.Warnf("unable to read hostname for syslog messages: %s", err)
+		}
+		b.hostname = hostname
+	}
+	addrs, err := node.GetNodeAddrs()
+	if err != nil {
+		bslog.Warnf("unable to read node address for syslog messages: %s", err)
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip != nil && !ip.IsLoopback() {
+			b.nodeAddr = addr
+			break
 		}
-		b.msgChans = append(b.msgChans, forwardChan)
-		b.quitChans = append(b.quitChans, quitChan)
 	}
 	return nil
 }
@@ -107,8 +260,141 @@ type bufferWithIdx struct {
 	contentIdx int
 }
 
+// containerDestinations returns the forward addresses set in the
+// bs.log.destinations label of the container of parts, nil means the default
+// addresses should be used. The environment of the container is not used, as
+// it's controlled by the app owners.
+func (b *syslogBackend) containerDestinations(parts *rawLogParts, containerID string) []string {
+	cont := parts.containerInfo
+	if cont == nil {
+		return nil
+	}
+	if dests, ok := b.routes.Get(containerID); ok {
+		return dests.([]string)
+	}
+	var dests []string
+	var labels map[string]string
+	if cont.Config != nil {
+		labels = cont.Config.Labels
+	}
+	for _, dest := range strings.Split(labels[syslogDestinationsLabel], ",") {
+		dest = strings.TrimSpace(dest)
+		if dest != "" {
+			dests = append(dests, dest)
+		}
+	}
+	b.routes.Add(containerID, dests)
+	return dests
+}
+
+// routeQueues returns the queues for dests, starting forwarders for new
+// addresses. The default destination refers to the addresses in
+// LOG_SYSLOG_FORWARD_ADDRESSES. Messages to addresses whose forwarders can't
+// be started are counted as dropped, they're never sent somewhere else. It
+// must be called with b.mu held.
+func (b *syslogBackend) routeQueues(dests []string) []*messageQueue {
+	var queues []*messageQueue
+	now := time.Now()
+	useDefault := false
+loop:
+	for _, dest := range dests {
+		if dest == syslogDefaultDestination {
+			useDefault = true
+			continue
+		}
+		for i, addr := range b.addresses {
+			if addr == dest {
+				queues = append(queues, b.queues[i])
+				continue loop
+			}
+		}
+		d := b.destinations[dest]
+		if d == nil {
+			queue, err := b.newQueue(dest, true)
+			if err != nil {
+				messagesDropped.WithLabelValues("syslog", dest).Inc()
+				if now.Sub(b.destErrors[dest]) >= time.Minute {
+					bslog.Errorf("[log forwarder] unable to forward logs to %q, dropping messages: %s", dest, err)
+					b.destErrors[dest] = now
+				}
+				continue
+			}
+			d = &syslogDestination{queue: queue}
+			b.destinations[dest] = d
+		}
+		d.lastUsed = now
+		queues = append(queues, d.queue)
+	}
+	if !useDefault {
+		return queues
+	}
+	routed := len(queues)
+defaultLoop:
+	for _, queue := range b.queues {
+		for _, q := range queues[:routed] {
+			if q == queue {
+				continue defaultLoop
+			}
+		}
+		queues = append(queues, queue)
+	}
+	return queues
+}
+
+func (b *syslogBackend) removeIdleDestinations() {
+	interval := b.idleTimeout / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.quit:
+			return
+		case now := <-t.C:
+			var idle []*messageQueue
+			b.mu.Lock()
+			for dest, d := range b.destinations {
+				unused := now.Sub(d.lastUsed)
+				if unused < b.idleTimeout {
+					continue
+				}
+				// Queues are only stopped after the messages in them are
+				// sent, unless the destination is unreachable for another
+				// idleTimeout.
+				if !d.queue.drained() && unused < 2*b.idleTimeout {
+					continue
+				}
+				idle = append(idle, d.queue)
+				delete(b.destinations, dest)
+			}
+			for dest, t := range b.destErrors {
+				if now.Sub(t) >= time.Minute {
+					delete(b.destErrors, dest)
+				}
+			}
+			b.mu.Unlock()
+			for _, queue := range idle {
+				queue.stopPending()
+			}
+		}
+	}
+}
+
 func (b *syslogBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
-	lenSyslogs := len(b.msgChans)
+	dests := b.containerDestinations(parts, container)
+	if dests == nil {
+		b.sendToQueues(b.queues, parts, appName, processName)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sendToQueues(b.routeQueues(dests), parts, appName, processName)
+}
+
+func (b *syslogBackend) sendToQueues(queues []*messageQueue, parts *rawLogParts, appName, processName string) {
+	lenSyslogs := len(queues)
 	if lenSyslogs == 0 {
 		return
 	}
@@ -117,24 +403,23 @@ func (b *syslogBackend) sendMessage(parts *rawLogParts, appName, processName, co
 		contID = contID[:containerIDTrimSize]
 	}
 	buffer := b.bufferPool.Get().([]byte)[:0]
-	buffer = append(buffer, '<')
-	buffer = append(buffer, parts.priority...)
-	buffer = append(buffer, '>')
-	buffer = append(buffer, parts.ts.In(b.syslogLocation).Format(time.Stamp)...)
-	buffer = append(buffer, ' ')
-	buffer = append(buffer, contID...)
-	buffer = append(buffer, ' ')
-	buffer = append(buffer, appName...)
-	buffer = append(buffer, '[')
-	buffer = append(buffer, processName...)
-	buffer = append(buffer, ']', ':', ' ')
+	if b.syslogFormat == syslogFormatRFC5424 {
+		buffer = b.appendRFC5424Header(buffer, parts, appName, processName, contID)
+	} else {
+		buffer = b.appendRFC3164Header(buffer, parts, appName, processName, contID)
+	}
 	buffer = append(buffer, b.syslogExtraStart...)
 	headerIdx := len(buffer)
-	buffer = append(buffer, parts.content...)
+	if b.syslogFormat == syslogFormatRFC5424 {
+		// Fields are sent as structured data.
+		buffer = append(buffer, parts.text()...)
+	} else {
+		buffer = append(buffer, parts.content...)
+	}
 	contentIdx := len(buffer)
 	buffer = append(buffer, b.syslogExtraEnd...)
 	buffer = append(buffer, '\n')
-	for i, ch := range b.msgChans {
+	for i, queue := range queues {
 		var chBuffer []byte
 		if i == lenSyslogs-1 {
 			chBuffer = buffer
@@ -142,35 +427,147 @@ func (b *syslogBackend) sendMessage(parts *rawLogParts, appName, processName, co
 			chBuffer = b.bufferPool.Get().([]byte)[:0]
 			chBuffer = append(chBuffer, buffer...)
 		}
-		select {
-		case ch <- bufferWithIdx{
+		queue.send(bufferWithIdx{
 			buffer:     chBuffer,
 			headerIdx:  headerIdx,
 			contentIdx: contentIdx,
-		}:
-		default:
-			select {
-			case <-b.nextNotify.C:
-				bslog.Errorf("Dropping log messages to syslog due to full channel buffer.")
-				b.nextNotify.Reset(time.Minute)
-			default:
-			}
+		})
+	}
+}
+
+func (b *syslogBackend) appendRFC3164Header(buffer []byte, parts *rawLogParts, appName, processName string, contID []byte) []byte {
+	buffer = append(buffer, '<')
+	buffer = append(buffer, parts.priority...)
+	buffer = append(buffer, '>')
+	buffer = append(buffer, parts.ts.In(b.syslogLocation).Format(time.Stamp)...)
+	buffer = append(buffer, ' ')
+	buffer = append(buffer, contID...)
+	buffer = append(buffer, ' ')
+	buffer = append(buffer, appName...)
+	buffer = append(buffer, '[')
+	buffer = append(buffer, processName...)
+	buffer = append(buffer, ']', ':', ' ')
+	return buffer
+}
+
+// appendRFC5424Header appends the header and the structured data of a RFC
+// 5424 message, MSGID is always nil.
+func (b *syslogBackend) appendRFC5424Header(buffer []byte, parts *rawLogParts, appName, processName string, contID []byte) []byte {
+	buffer = append(buffer, '<')
+	buffer = append(buffer, parts.priority...)
+	buffer = append(buffer, '>', '1', ' ')
+	buffer = append(buffer, parts.ts.In(b.syslogLocation).Format(rfc5424TimeFormat)...)
+	buffer = append(buffer, ' ')
+	buffer = appendHeaderField(buffer, b.hostname, rfc5424HostnameMaxLen)
+	buffer = append(buffer, ' ')
+	buffer = appendHeaderField(buffer, appName, rfc5424AppNameMaxLen)
+	buffer = append(buffer, ' ')
+	buffer = appendHeaderField(buffer, processName, rfc5424ProcIDMaxLen)
+	buffer = append(buffer, " - ["...)
+	buffer = append(buffer, b.structuredDataID...)
+	buffer = append(buffer, ` unit="`...)
+	buffer = appendParamValue(buffer, string(contID))
+	buffer = append(buffer, `" app="`...)
+	buffer = appendParamValue(buffer, appName)
+	buffer = append(buffer, `" process="`...)
+	buffer = appendParamValue(buffer, processName)
+	buffer = append(buffer, `" node="`...)
+	buffer = appendParamValue(buffer, b.nodeAddr)
+	buffer = append(buffer, '"')
+	for _, field := range parts.fields {
+		buffer = append(buffer, ' ')
+		buffer = appendParamName(buffer, field.key)
+		buffer = append(buffer, '=', '"')
+		buffer = appendParamValue(buffer, fieldString(field.value))
+		buffer = append(buffer, '"')
+	}
+	buffer = append(buffer, ']', ' ')
+	return buffer
+}
+
+// appendHeaderField appends value as a RFC 5424 header field, replacing
+// characters not allowed in the header and using the nil value for empty
+// fields.
+func appendHeaderField(buffer []byte, value string, maxLen int) []byte {
+	if value == "" {
+		return append(buffer, '-')
+	}
+	if len(value) > maxLen {
+		value = value[:maxLen]
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < '!' || c > '~' {
+			c = '_'
 		}
+		buffer = append(buffer, c)
 	}
+	return buffer
+}
+
+// appendParamName appends name as a RFC 5424 structured data parameter
+// name, replacing characters not allowed in names.
+func appendParamName(buffer []byte, name string) []byte {
+	if len(name) > rfc5424ParamNameMaxLen {
+		name = name[:rfc5424ParamNameMaxLen]
+	}
+	if name == "" {
+		return append(buffer, '_')
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < '!' || c > '~' || c == '=' || c == ']' || c == '"' {
+			c = '_'
+		}
+		buffer = append(buffer, c)
+	}
+	return buffer
+}
+
+func appendParamValue(buffer []byte, value string) []byte {
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"', '\\', ']':
+			buffer = append(buffer, '\\')
+		}
+		buffer = append(buffer, value[i])
+	}
+	return buffer
 }
 
 func (b *syslogBackend) stop() {
-	for _, ch := range b.quitChans {
-		close(ch)
+	for _, queue := range b.queues {
+		queue.stop()
+	}
+	if b.quit == nil {
+		return
+	}
+	close(b.quit)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for dest, d := range b.destinations {
+		d.queue.stopPending()
+		delete(b.destinations, dest)
 	}
 }
 
+func (f *syslogForwarder) isStream() bool {
+	return f.url.Scheme == "tcp" || isTLSScheme(f.url.Scheme)
+}
+
 func (f *syslogForwarder) connect() (net.Conn, error) {
-	conn, err := net.DialTimeout(f.url.Scheme, f.url.Host, forwardConnDialTimeout)
+	var conn net.Conn
+	var err error
+	if isTLSScheme(f.url.Scheme) {
+		dialer := &net.Dialer{Timeout: forwardConnDialTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", f.url.Host, f.tlsConfig)
+	} else {
+		conn, err = net.DialTimeout(f.url.Scheme, f.url.Host, forwardConnDialTimeout)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("[log forwarder] unable to connect to %q: %s", f.url, err)
 	}
-	if f.url.Scheme == "tcp" {
+	if f.isStream() {
 		conn = newBufferedConn(conn, time.Second)
 		f.connCreatedAt = time.Now()
 	} else {
@@ -229,7 +626,7 @@ func (f *syslogForwarder) process(conn net.Conn, msg LogMessage) error {
 	if err != nil {
 		return err
 	}
-	if f.url.Scheme == "tcp" && f.connMaxAge >= 0 && time.Since(f.connCreatedAt) >= f.connMaxAge {
+	if f.isStream() && f.connMaxAge >= 0 && time.Since(f.connCreatedAt) >= f.connMaxAge {
 		return errConnMaxAgeExceeded
 	}
 	return nil
@@ -240,6 +637,18 @@ func (f *syslogForwarder) writePart(conn net.Conn, buf []byte) error {
 	if err != nil {
 		return err
 	}
+	if f.octetCounting && f.isStream() {
+		// RFC 5425 frames are prefixed by the message length, the trailing
+		// newline is not needed as a separator.
+		if len(buf) > 0 && buf[len(buf)-1] == '\n' {
+			buf = buf[:len(buf)-1]
+		}
+		var prefix [24]byte
+		_, err = conn.Write(append(strconv.AppendInt(prefix[:0], int64(len(buf)), 10), ' '))
+		if err != nil {
+			return err
+		}
+	}
 	lenMsg := len(buf)
 	n, err := conn.Write(buf)
 	if err != nil {
@@ -251,6 +660,36 @@ func (f *syslogForwarder) writePart(conn net.Conn, buf []byte) error {
 	return nil
 }
 
+func (f *syslogForwarder) encodeMessage(msg LogMessage) ([]byte, error) {
+	bufIdx := msg.(bufferWithIdx)
+	data := make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(bufIdx.buffer))
+	n := binary.PutUvarint(data, uint64(bufIdx.headerIdx))
+	n += binary.PutUvarint(data[n:], uint64(bufIdx.contentIdx))
+	data = append(data[:n], bufIdx.buffer...)
+	f.bufferPool.Put(bufIdx.buffer)
+	return data, nil
+}
+
+func (f *syslogForwarder) decodeMessage(data []byte) (LogMessage, error) {
+	headerIdx, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("invalid header index")
+	}
+	contentIdx, m := binary.Uvarint(data[n:])
+	if m <= 0 {
+		return nil, errors.New("invalid content index")
+	}
+	buffer := append(f.bufferPool.Get().([]byte)[:0], data[n+m:]...)
+	if contentIdx > uint64(len(buffer)) || headerIdx > contentIdx {
+		return nil, errors.New("invalid message indexes")
+	}
+	return bufferWithIdx{
+		buffer:     buffer,
+		headerIdx:  int(headerIdx),
+		contentIdx: int(contentIdx),
+	}, nil
+}
+
 func (f *syslogForwarder) close(conn net.Conn) {
 	// Reset deadline, if we don't do this the connection remains open
 	// on the other end (causing tests to fail) for some weird reason.
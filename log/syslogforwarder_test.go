@@ -0,0 +1,447 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/bs/container"
+	"gopkg.in/check.v1"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// writeTestCert writes a self signed certificate, valid both as server and
+// client certificate for 127.0.0.1 and bs.test, and its key to dir.
+func writeTestCert(c *check.C, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bs.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"bs.test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	c.Assert(err, check.IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.IsNil)
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	c.Assert(err, check.IsNil)
+	return certFile, keyFile
+}
+
+// readOctetCounted reads a RFC 5425 frame from r.
+func readOctetCounted(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(length[:len(length)-1])
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return string(data), err
+}
+
+func (s *S) TestLogForwarderSyslogTLSOctetCounting(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-tls")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(c, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	c.Assert(err, check.IsNil)
+	pool := x509.NewCertPool()
+	pool.AddCert(mustParseCert(c, cert))
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	serverNameCh := make(chan string, 1)
+	data := make(chan string, 2)
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if tlsConn.Handshake() != nil {
+			return
+		}
+		serverNameCh <- tlsConn.ConnectionState().ServerName
+		reader := bufio.NewReader(conn)
+		for {
+			msg, readErr := readOctetCounted(reader)
+			if readErr != nil {
+				return
+			}
+			data <- msg
+		}
+	}()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "tls://"+listener.Addr().String())
+	os.Setenv("LOG_SYSLOG_FRAMING", "octet-counting")
+	os.Setenv("LOG_SYSLOG_TLS_CA_FILE", certFile)
+	os.Setenv("LOG_SYSLOG_TLS_CERT_FILE", certFile)
+	os.Setenv("LOG_SYSLOG_TLS_KEY_FILE", keyFile)
+	os.Setenv("LOG_SYSLOG_TLS_SERVER_NAME", "bs.test")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	c.Assert(recvTimeout(c, serverNameCh), check.Equals, "bs.test")
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, content := range []string{"mymsg", "my other msg"} {
+		msg := []byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: %s\n", s.id, content))
+		_, err = conn.Write(msg)
+		c.Assert(err, check.IsNil)
+		c.Assert(recvTimeout(c, data), check.Equals, fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: %s", s.idShort, content))
+	}
+}
+
+func (s *S) TestLogForwarderSyslogTLSNewlineFraming(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-tls")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(c, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	c.Assert(err, check.IsNil)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	data := make(chan string, 1)
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			data <- scanner.Text()
+		}
+	}()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "tcp+tls://"+listener.Addr().String())
+	os.Setenv("LOG_SYSLOG_TLS_CA_FILE", certFile)
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err = lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	msg := []byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: mymsg\n", s.id))
+	_, err = conn.Write(msg)
+	c.Assert(err, check.IsNil)
+	c.Assert(recvTimeout(c, data), check.Equals, fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: mymsg", s.idShort))
+}
+
+func (s *S) TestLogForwarderSyslogTLSInvalidConfig(c *check.C) {
+	dir, err := ioutil.TempDir("", "bs-tls")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(c, dir)
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "tls://127.0.0.1:6514")
+	tests := []struct {
+		envs        map[string]string
+		expectedErr string
+	}{
+		{
+			envs:        map[string]string{"LOG_SYSLOG_TLS_CA_FILE": keyFile},
+			expectedErr: `no certificates found in syslog tls ca file ".*"`,
+		},
+		{
+			envs:        map[string]string{"LOG_SYSLOG_TLS_CERT_FILE": certFile},
+			expectedErr: `both LOG_SYSLOG_TLS_CERT_FILE and LOG_SYSLOG_TLS_KEY_FILE must be set to use a client certificate`,
+		},
+		{
+			envs:        map[string]string{"LOG_SYSLOG_FRAMING": "none"},
+			expectedErr: `invalid syslog framing "none", expected newline or octet-counting`,
+		},
+	}
+	for _, tt := range tests {
+		for k, v := range tt.envs {
+			os.Setenv(k, v)
+		}
+		backend := &syslogBackend{}
+		err = backend.initialize()
+		c.Assert(err, check.ErrorMatches, tt.expectedErr)
+		for k := range tt.envs {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func mustParseCert(c *check.C, cert tls.Certificate) *x509.Certificate {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	c.Assert(err, check.IsNil)
+	return parsed
+}
+
+func createAppContainer(c *check.C, dockerURL, name string, env []string, labels map[string]string) string {
+	dockerClient, err := docker.NewClient(dockerURL)
+	c.Assert(err, check.IsNil)
+	cont, err := dockerClient.CreateContainer(docker.CreateContainerOptions{Name: name, Config: &docker.Config{
+		Image:  "myimg",
+		Env:    append(env, "TSURU_APPNAME="+name, "TSURU_PROCESSNAME=web"),
+		Labels: labels,
+	}})
+	c.Assert(err, check.IsNil)
+	return cont.ID
+}
+
+func listenUDP(c *check.C) *net.UDPConn {
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	udpConn, err := net.ListenUDP("udp", addr)
+	c.Assert(err, check.IsNil)
+	return udpConn
+}
+
+func readUDPMessages(c *check.C, conn *net.UDPConn) []string {
+	var messages []string
+	buffer := make([]byte, 1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			break
+		}
+		messages = append(messages, string(buffer[:n]))
+	}
+	sort.Strings(messages)
+	return messages
+}
+
+func (s *S) TestLogForwarderSyslogContainerDestinations(c *check.C) {
+	global := listenUDP(c)
+	defer global.Close()
+	regulated := listenUDP(c)
+	defer regulated.Close()
+	team := listenUDP(c)
+	defer team.Close()
+	regulatedID := createAppContainer(c, s.dockerServer.URL(), "regulatedapp", nil, map[string]string{
+		"bs.log.destinations": "udp://" + regulated.LocalAddr().String(),
+	})
+	teamID := createAppContainer(c, s.dockerServer.URL(), "teamapp", []string{
+		"BS_LOG_DESTINATIONS=udp://" + regulated.LocalAddr().String(),
+	}, map[string]string{"bs.log.destinations": "default, udp://" + team.LocalAddr().String()})
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+global.LocalAddr().String())
+	os.Setenv("LOG_SYSLOG_DESTINATION_IDLE_TIMEOUT", "0.5")
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	conn, err := net.Dial("udp", "127.0.0.1:59317")
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	for _, id := range []string{s.id, regulatedID, teamID} {
+		_, err = conn.Write([]byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: mymsg\n", id)))
+		c.Assert(err, check.IsNil)
+	}
+	expected := []string{
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s coolappname[procx]: mymsg\n", s.idShort),
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s teamapp[web]: mymsg\n", teamID[:12]),
+	}
+	sort.Strings(expected)
+	c.Assert(readUDPMessages(c, global), check.DeepEquals, expected)
+	c.Assert(readUDPMessages(c, regulated), check.DeepEquals, []string{
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s regulatedapp[web]: mymsg\n", regulatedID[:12]),
+	})
+	c.Assert(readUDPMessages(c, team), check.DeepEquals, []string{
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s teamapp[web]: mymsg\n", teamID[:12]),
+	})
+	backend := lf.backends[0].(*syslogBackend)
+	timeout := time.After(5 * time.Second)
+	for {
+		backend.mu.Lock()
+		n := len(backend.destinations)
+		backend.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		select {
+		case <-timeout:
+			c.Fatalf("timeout waiting for idle destinations to be removed, %d left", n)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	_, err = conn.Write([]byte(fmt.Sprintf("<30>2015-06-05T16:13:47Z myhost docker/%s: othermsg\n", regulatedID)))
+	c.Assert(err, check.IsNil)
+	c.Assert(readUDPMessages(c, regulated), check.DeepEquals, []string{
+		fmt.Sprintf("<30>Jun  5 13:13:47 %s regulatedapp[web]: othermsg\n", regulatedID[:12]),
+	})
+}
+
+func (s *S) TestLogForwarderSyslogContainerDestinationsUnavailable(c *check.C) {
+	global := listenUDP(c)
+	defer global.Close()
+	os.Setenv("LOG_SYSLOG_FORWARD_ADDRESSES", "udp://"+global.LocalAddr().String())
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	appParts := func(id, dests string) format.LogParts {
+		return format.LogParts{"parts": &rawLogParts{
+			ts:        time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+			priority:  []byte("30"),
+			content:   []byte("mymsg"),
+			container: []byte(id),
+			containerInfo: &container.Container{
+				Container: docker.Container{ID: id, Config: &docker.Config{
+					Labels: map[string]string{"bs.log.destinations": dests},
+				}},
+				AppName:     "myapp",
+				ProcessName: "web",
+			},
+		}}
+	}
+	start := time.Now()
+	lf.Handle(appParts("unreachable1", "tcp://192.0.2.1:514"), 0, nil)
+	lf.Handle(appParts("invaliddest1", "%zz"), 0, nil)
+	c.Assert(time.Since(start) < forwardConnDialTimeout/2, check.Equals, true)
+	c.Assert(readUDPMessages(c, global), check.HasLen, 0)
+	c.Assert(messagesDropped.WithLabelValues("syslog", "%zz").Value(), check.Equals, uint64(1))
+	backend := lf.backends[0].(*syslogBackend)
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	c.Assert(backend.destinations, check.HasLen, 1)
+	c.Assert(backend.destinations["tcp://192.0.2.1:514"], check.NotNil)
+}
+
+func (s *S) TestLogForwarderSyslogContainerDestinationsWithoutDefault(c *check.C) {
+	team := listenUDP(c)
+	defer team.Close()
+	lf := LogForwarder{
+		BindAddress:     "udp://127.0.0.1:59317",
+		DockerEndpoint:  s.dockerServer.URL(),
+		EnabledBackends: []string{"syslog"},
+	}
+	err := lf.Start()
+	c.Assert(err, check.IsNil)
+	defer lf.stopWait()
+	lf.Handle(format.LogParts{"parts": &rawLogParts{
+		ts:        time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+		priority:  []byte("30"),
+		content:   []byte("mymsg"),
+		container: []byte("teamcont1"),
+		containerInfo: &container.Container{
+			Container: docker.Container{ID: "teamcont1", Config: &docker.Config{
+				Labels: map[string]string{"bs.log.destinations": "default,udp://" + team.LocalAddr().String()},
+			}},
+			AppName:     "teamapp",
+			ProcessName: "web",
+		},
+	}}, 0, nil)
+	c.Assert(readUDPMessages(c, team), check.DeepEquals, []string{
+		"<30>Jun  5 13:13:47 teamcont1 teamapp[web]: mymsg\n",
+	})
+}
+
+func (s *S) TestSyslogBackendRemoveIdleDestinationsDrains(c *check.C) {
+	os.Setenv("LOG_SYSLOG_DESTINATION_IDLE_TIMEOUT", "0.5")
+	backend := &syslogBackend{}
+	err := backend.initialize()
+	c.Assert(err, check.IsNil)
+	defer backend.stop()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	addr := ln.Addr().String()
+	ln.Close()
+	parts := &rawLogParts{
+		ts:        time.Date(2015, 6, 5, 16, 13, 47, 0, time.UTC),
+		priority:  []byte("30"),
+		content:   []byte("mymsg"),
+		container: []byte("cont1"),
+	}
+	backend.mu.Lock()
+	queues := backend.routeQueues([]string{"tcp://" + addr})
+	c.Assert(queues, check.HasLen, 1)
+	for i := 0; i < 3; i++ {
+		backend.sendToQueues(queues, parts, "myapp", "web")
+	}
+	backend.mu.Unlock()
+	time.Sleep(700 * time.Millisecond)
+	backend.mu.Lock()
+	c.Assert(backend.destinations, check.HasLen, 1)
+	backend.mu.Unlock()
+	ln, err = net.Listen("tcp", addr)
+	c.Assert(err, check.IsNil)
+	defer ln.Close()
+	conn, err := ln.Accept()
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		line, err := reader.ReadString('\n')
+		c.Assert(err, check.IsNil)
+		c.Assert(line, check.Equals, "<30>Jun  5 13:13:47 cont1 myapp[web]: mymsg\n")
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		backend.mu.Lock()
+		n := len(backend.destinations)
+		backend.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		select {
+		case <-timeout:
+			c.Fatal("timeout waiting for idle destination to be removed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
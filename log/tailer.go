@@ -0,0 +1,319 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tsuru/bs/bslog"
+)
+
+const (
+	tailReadSize    = 32 * 1024
+	maxTailLineSize = 1024 * 1024
+	tailHeadSize    = 256
+)
+
+var tailPollInterval = 250 * time.Millisecond
+
+// fileTailer reads lines written to a file, following it like tail -F when
+// it's rotated, either by renaming it and creating a new one or by copying
+// and truncating it. Whatever is left in the rotated file is read before
+// switching to the new one.
+type fileTailer struct {
+	path      string
+	file      *os.File
+	info      os.FileInfo
+	offset    int64
+	modTime   time.Time
+	head      []byte
+	buf       []byte
+	start     int
+	draining  bool
+	skipping  bool
+	quit      chan struct{}
+	closeOnce sync.Once
+	// gone is 1 when the end of the file was reached and there's no file in
+	// path anymore.
+	gone int32
+}
+
+func newFileTailer(path string) *fileTailer {
+	return &fileTailer{
+		path: path,
+		quit: make(chan struct{}),
+	}
+}
+
+// open opens the file, reading it from offset when it's still the file with
+// the given inode or from the start otherwise. It returns true if reading is
+// resumed from offset.
+func (t *fileTailer) open(inode uint64, offset int64) (bool, error) {
+	f, info, err := openFileInfo(t.path)
+	if err != nil {
+		return false, err
+	}
+	resumed := inode != 0 && fileInode(info) == inode && offset <= info.Size()
+	if !resumed {
+		offset = 0
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	t.setFile(f, info, offset)
+	return resumed, nil
+}
+
+// position returns the inode of the file being read and the offset right
+// after the last line returned by readLine.
+func (t *fileTailer) position() (uint64, int64) {
+	if t.info == nil {
+		return 0, 0
+	}
+	return fileInode(t.info), t.offset - int64(len(t.buf)-t.start)
+}
+
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+func openFileInfo(path string) (*os.File, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// fileGone reports whether the file was fully read and removed or renamed
+// without a new one being created, it may be called from other goroutines.
+func (t *fileTailer) fileGone() bool {
+	return atomic.LoadInt32(&t.gone) == 1
+}
+
+func (t *fileTailer) setGone(gone bool) {
+	var v int32
+	if gone {
+		v = 1
+	}
+	atomic.StoreInt32(&t.gone, v)
+}
+
+func (t *fileTailer) setFile(f *os.File, info os.FileInfo, offset int64) {
+	t.setGone(false)
+	if t.file != nil && t.file != f {
+		t.file.Close()
+	}
+	t.file, t.info, t.offset = f, info, offset
+	t.buf, t.start = t.buf[:0], 0
+	t.modTime = info.ModTime()
+	t.head = t.head[:0]
+	if offset > 0 {
+		head := make([]byte, tailHeadSize)
+		n, _ := f.ReadAt(head, 0)
+		t.head = head[:n]
+	}
+}
+
+// close makes readLine return io.EOF.
+func (t *fileTailer) close() {
+	t.closeOnce.Do(func() {
+		close(t.quit)
+	})
+}
+
+// readLine returns the next line without the trailing newline, waiting for
+// it to be written. Lines longer than maxTailLineSize are discarded. It
+// returns io.EOF after close is called.
+func (t *fileTailer) readLine() ([]byte, error) {
+	line, err := t.nextLine()
+	if err != nil && t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	return line, err
+}
+
+func (t *fileTailer) nextLine() ([]byte, error) {
+	for {
+		select {
+		case <-t.quit:
+			return nil, io.EOF
+		default:
+		}
+		data := t.buf[t.start:]
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			t.start += i + 1
+			if t.skipping || i >= maxTailLineSize {
+				if !t.skipping {
+					bslog.Errorf("[log forwarder] discarding line longer than %d bytes in %q", maxTailLineSize, t.path)
+				}
+				t.skipping = false
+				continue
+			}
+			return append([]byte(nil), data[:i]...), nil
+		}
+		if len(data) >= maxTailLineSize {
+			bslog.Errorf("[log forwarder] discarding line longer than %d bytes in %q", maxTailLineSize, t.path)
+			t.start = len(t.buf)
+			t.skipping = true
+			continue
+		}
+		n, err := t.fill()
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			t.setGone(false)
+			continue
+		}
+		if t.draining {
+			// The rotated file was fully read, a line without a trailing
+			// newline is returned before switching to the new file.
+			f, info, err := openFileInfo(t.path)
+			if err == nil {
+				line := append([]byte(nil), t.buf[t.start:]...)
+				t.draining = false
+				t.setFile(f, info, 0)
+				if len(line) > 0 && !t.skipping {
+					return line, nil
+				}
+				t.skipping = false
+				continue
+			}
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			t.setGone(true)
+		} else {
+			rotated, err := t.checkRotation()
+			if err != nil {
+				return nil, err
+			}
+			if rotated {
+				continue
+			}
+		}
+		select {
+		case <-t.quit:
+			return nil, io.EOF
+		case <-time.After(tailPollInterval):
+		}
+	}
+}
+
+// fill reads up to tailReadSize bytes into the buffer, returning 0 at the
+// end of the file.
+func (t *fileTailer) fill() (int, error) {
+	if t.start > 0 {
+		n := copy(t.buf, t.buf[t.start:])
+		t.buf, t.start = t.buf[:n], 0
+	}
+	if cap(t.buf)-len(t.buf) < tailReadSize {
+		buf := make([]byte, len(t.buf), 2*cap(t.buf)+tailReadSize)
+		copy(buf, t.buf)
+		t.buf = buf
+	}
+	n, err := t.file.Read(t.buf[len(t.buf) : len(t.buf)+tailReadSize])
+	if missing := tailHeadSize - len(t.head); missing > 0 && t.offset == int64(len(t.head)) {
+		if missing > n {
+			missing = n
+		}
+		t.head = append(t.head, t.buf[len(t.buf):len(t.buf)+missing]...)
+	}
+	t.buf = t.buf[:len(t.buf)+n]
+	t.offset += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// checkRotation is called at the end of the file, it returns true if the
+// file was rotated and there's something else to be read.
+func (t *fileTailer) checkRotation() (bool, error) {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			t.setGone(true)
+			return false, nil
+		}
+		return false, err
+	}
+	t.setGone(false)
+	if !os.SameFile(info, t.info) {
+		// Renamed and created again, what's left in the old file is read
+		// before switching.
+		t.draining = true
+		return true, nil
+	}
+	if info.Size() >= t.offset {
+		t.modTime = info.ModTime()
+		return false, nil
+	}
+	// Copied and truncated, lines written after the last read are in the
+	// copy, when it's found.
+	rotatedPath := t.path + ".1"
+	if rotatedInfo, err := os.Stat(rotatedPath); err == nil && t.isCopy(rotatedPath, rotatedInfo) {
+		f, err := os.Open(rotatedPath)
+		if err == nil {
+			_, err = f.Seek(t.offset, io.SeekStart)
+			if err == nil {
+				t.file.Close()
+				t.file, t.info = f, rotatedInfo
+				t.draining = true
+				return true, nil
+			}
+			f.Close()
+		}
+	}
+	bslog.Warnf("[log forwarder] file %q truncated, reading from the start", t.path)
+	_, err = t.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	t.setFile(t.file, info, 0)
+	return true, nil
+}
+
+// isCopy reports whether the file in path, with the given info, is a copy of
+// the file being read made when it was truncated. A copy is at least as large
+// as what was read and it was modified after the last read or starts with the
+// same bytes, an unrelated file left by a previous rotation is ignored.
+func (t *fileTailer) isCopy(path string, info os.FileInfo) bool {
+	if os.SameFile(info, t.info) || info.Size() < t.offset {
+		return false
+	}
+	if !info.ModTime().Before(t.modTime) {
+		return true
+	}
+	if len(t.head) == 0 {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, len(t.head))
+	_, err = io.ReadFull(f, head)
+	return err == nil && bytes.Equal(head, t.head)
+}
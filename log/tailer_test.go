@@ -0,0 +1,149 @@
+// Copyright 2017 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func newTestTailer(c *check.C, content string) (*fileTailer, string, func()) {
+	oldInterval := tailPollInterval
+	tailPollInterval = 10 * time.Millisecond
+	dir, err := ioutil.TempDir("", "bs-tailer")
+	c.Assert(err, check.IsNil)
+	path := filepath.Join(dir, "app.log")
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	c.Assert(err, check.IsNil)
+	t := newFileTailer(path)
+	_, err = t.open(0, 0)
+	c.Assert(err, check.IsNil)
+	return t, path, func() {
+		t.close()
+		os.RemoveAll(dir)
+		tailPollInterval = oldInterval
+	}
+}
+
+func readTailerLines(c *check.C, t *fileTailer, n int) []string {
+	type result struct {
+		line []byte
+		err  error
+	}
+	var lines []string
+	for i := 0; i < n; i++ {
+		ch := make(chan result, 1)
+		go func() {
+			line, err := t.readLine()
+			ch <- result{line: line, err: err}
+		}()
+		select {
+		case r := <-ch:
+			c.Assert(r.err, check.IsNil)
+			lines = append(lines, string(r.line))
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timeout waiting for line %d", i)
+		}
+	}
+	return lines
+}
+
+func appendFile(c *check.C, path, content string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	_, err = f.Write([]byte(content))
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestFileTailerReadLines(c *check.C) {
+	t, path, cleanup := newTestTailer(c, "l1\nl2\npart")
+	defer cleanup()
+	c.Assert(readTailerLines(c, t, 2), check.DeepEquals, []string{"l1", "l2"})
+	appendFile(c, path, "ial\n\nl4\n")
+	c.Assert(readTailerLines(c, t, 3), check.DeepEquals, []string{"partial", "", "l4"})
+}
+
+func (s *S) TestFileTailerRenameRotation(c *check.C) {
+	t, path, cleanup := newTestTailer(c, "l1\n")
+	defer cleanup()
+	c.Assert(readTailerLines(c, t, 1), check.DeepEquals, []string{"l1"})
+	err := os.Rename(path, path+".1")
+	c.Assert(err, check.IsNil)
+	appendFile(c, path+".1", "l2\nl3")
+	appendFile(c, path, "l4\n")
+	c.Assert(readTailerLines(c, t, 3), check.DeepEquals, []string{"l2", "l3", "l4"})
+	appendFile(c, path, "l5\n")
+	c.Assert(readTailerLines(c, t, 1), check.DeepEquals, []string{"l5"})
+}
+
+func (s *S) TestFileTailerCopyTruncate(c *check.C) {
+	t, path, cleanup := newTestTailer(c, "l1\nl2\n")
+	defer cleanup()
+	c.Assert(readTailerLines(c, t, 2), check.DeepEquals, []string{"l1", "l2"})
+	appendFile(c, path, "l3\n")
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(path+".1", data, 0600)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(path, []byte("l4\n"), 0600)
+	c.Assert(err, check.IsNil)
+	c.Assert(readTailerLines(c, t, 2), check.DeepEquals, []string{"l3", "l4"})
+}
+
+func (s *S) TestFileTailerTruncateWithOldRotatedFile(c *check.C) {
+	t, path, cleanup := newTestTailer(c, "line1\nline2\n")
+	defer cleanup()
+	err := ioutil.WriteFile(path+".1", []byte("old1\nold2\nold3\nold4\n"), 0600)
+	c.Assert(err, check.IsNil)
+	old := time.Now().Add(-time.Hour)
+	err = os.Chtimes(path+".1", old, old)
+	c.Assert(err, check.IsNil)
+	c.Assert(readTailerLines(c, t, 2), check.DeepEquals, []string{"line1", "line2"})
+	err = ioutil.WriteFile(path, []byte("l3\n"), 0600)
+	c.Assert(err, check.IsNil)
+	c.Assert(readTailerLines(c, t, 1), check.DeepEquals, []string{"l3"})
+}
+
+func (s *S) TestFileTailerTruncate(c *check.C) {
+	t, path, cleanup := newTestTailer(c, "line1\nline2\n")
+	defer cleanup()
+	c.Assert(readTailerLines(c, t, 2), check.DeepEquals, []string{"line1", "line2"})
+	err := ioutil.WriteFile(path, []byte("l3\n"), 0600)
+	c.Assert(err, check.IsNil)
+	c.Assert(readTailerLines(c, t, 1), check.DeepEquals, []string{"l3"})
+}
+
+func (s *S) TestFileTailerLongLine(c *check.C) {
+	long := string(bytes.Repeat([]byte("x"), maxTailLineSize+10))
+	t, _, cleanup := newTestTailer(c, "l1\n"+long+"\nl2\n")
+	defer cleanup()
+	c.Assert(readTailerLines(c, t, 2), check.DeepEquals, []string{"l1", "l2"})
+}
+
+func (s *S) TestFileTailerClose(c *check.C) {
+	t, _, cleanup := newTestTailer(c, "")
+	defer cleanup()
+	done := make(chan error)
+	go func() {
+		_, err := t.readLine()
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	t.close()
+	select {
+	case err := <-done:
+		c.Assert(err, check.Equals, io.EOF)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for readLine")
+	}
+	c.Assert(t.file, check.IsNil)
+}
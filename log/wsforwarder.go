@@ -30,10 +30,21 @@ var (
 	errConnMaxAgeExceeded = errors.New("max connection age exceeded")
 )
 
+const (
+	tsuruMessageOriginal = "original"
+	tsuruMessageReadable = "readable"
+)
+
+// tsuruLogEntry is an app.Applog with the severity of the message, which
+// older tsuru API servers ignore.
+type tsuruLogEntry struct {
+	app.Applog
+	Severity string `json:",omitempty"`
+}
+
 type tsuruBackend struct {
-	msgCh      chan<- LogMessage
-	quitCh     chan<- bool
-	nextNotify *time.Timer
+	readableMessages bool
+	queue            *messageQueue
 }
 
 type wsForwarder struct {
@@ -55,7 +66,6 @@ func (b *tsuruBackend) initialize() error {
 	if config.Config.TsuruEndpoint == "" {
 		return fmt.Errorf("environment variable for TSURU_ENDPOINT must be set")
 	}
-	bufferSize := config.IntEnvOrDefault(config.DefaultBufferSize, "LOG_TSURU_BUFFER_SIZE", "LOG_BUFFER_SIZE")
 	wsPingInterval := config.SecondsEnvOrDefault(config.DefaultWsPingInterval, "LOG_TSURU_PING_INTERVAL", "LOG_WS_PING_INTERVAL")
 	wsPongInterval := config.SecondsEnvOrDefault(0, "LOG_TSURU_PONG_INTERVAL", "LOG_WS_PONG_INTERVAL")
 	if wsPongInterval < wsPingInterval {
@@ -64,7 +74,11 @@ func (b *tsuruBackend) initialize() error {
 		wsPongInterval = newPongInterval
 	}
 	wsConnMaxAge := config.SecondsEnvOrDefault(-1, "LOG_TSURU_CONN_MAX_AGE")
-	b.nextNotify = time.NewTimer(0)
+	messageFormat := config.StringEnvOrDefault(tsuruMessageOriginal, "LOG_TSURU_MESSAGE_FORMAT")
+	if messageFormat != tsuruMessageOriginal && messageFormat != tsuruMessageReadable {
+		return fmt.Errorf("invalid tsuru message format %q, expected %s or %s", messageFormat, tsuruMessageOriginal, tsuruMessageReadable)
+	}
+	b.readableMessages = messageFormat == tsuruMessageReadable
 	tsuruUrl, err := url.Parse(config.Config.TsuruEndpoint)
 	if err != nil {
 		return err
@@ -75,46 +89,53 @@ func (b *tsuruBackend) initialize() error {
 	} else {
 		tsuruUrl.Scheme = "ws"
 	}
-	forwardChan, quitChan, err := processMessages(&wsForwarder{
-		url:          tsuruUrl.String(),
+	queueCfg := newQueueConfig("tsuru")
+	queueCfg.destination = tsuruUrl.String()
+	b.queue, err = processMessages(&wsForwarder{
+		url:          queueCfg.destination,
 		token:        config.Config.TsuruToken,
 		pingInterval: wsPingInterval,
 		pongInterval: wsPongInterval,
 		connMaxAge:   wsConnMaxAge,
-	}, bufferSize)
-	if err != nil {
-		return err
-	}
-	b.msgCh = forwardChan
-	b.quitCh = quitChan
-	return nil
+	}, queueCfg)
+	return err
 }
 
 func (b *tsuruBackend) sendMessage(parts *rawLogParts, appName, processName, container string) {
 	if len(container) > containerIDTrimSize {
 		container = container[:containerIDTrimSize]
 	}
-	msg := &app.Applog{
-		Date:    parts.ts,
-		AppName: appName,
-		Message: string(parts.content),
-		Source:  processName,
-		Unit:    container,
+	msg := &tsuruLogEntry{
+		Applog: app.Applog{
+			Date:    parts.ts,
+			AppName: appName,
+			Message: b.message(parts),
+			Source:  processName,
+			Unit:    container,
+		},
+		Severity: parts.severity(),
 	}
-	select {
-	case b.msgCh <- msg:
-	default:
-		select {
-		case <-b.nextNotify.C:
-			bslog.Errorf("Dropping log messages to tsuru due to full channel buffer.")
-			b.nextNotify.Reset(time.Minute)
-		default:
+	b.queue.send(msg)
+}
+
+// message returns the content of parts or, for readable messages, the
+// message and fields found in structured content.
+func (b *tsuruBackend) message(parts *rawLogParts) string {
+	if !b.readableMessages || (parts.message == nil && len(parts.fields) == 0) {
+		return string(parts.content)
+	}
+	buf := append([]byte(nil), parts.message...)
+	if len(parts.fields) > 0 {
+		if len(buf) > 0 {
+			buf = append(buf, ' ')
 		}
+		buf = appendLogfmt(buf, parts.fields)
 	}
+	return string(buf)
 }
 
 func (b *tsuruBackend) stop() {
-	close(b.quitCh)
+	b.queue.stop()
 }
 
 func (f *wsForwarder) initialize(quitCh <-chan bool) {
@@ -247,7 +268,7 @@ func (f *wsForwarder) process(conn net.Conn, msg LogMessage) error {
 	if err != nil {
 		return fmt.Errorf("error setting deadline: %s", err)
 	}
-	entry := msg.(*app.Applog)
+	entry := msg.(*tsuruLogEntry)
 	err = f.jsonEncoder.Encode(entry)
 	if err != nil {
 		return fmt.Errorf("error sending message: %s", err)
@@ -259,6 +280,19 @@ func (f *wsForwarder) process(conn net.Conn, msg LogMessage) error {
 	return nil
 }
 
+func (f *wsForwarder) encodeMessage(msg LogMessage) ([]byte, error) {
+	return json.Marshal(msg.(*tsuruLogEntry))
+}
+
+func (f *wsForwarder) decodeMessage(data []byte) (LogMessage, error) {
+	var entry tsuruLogEntry
+	err := json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
 func (f *wsForwarder) close(conn net.Conn) {
 	// Reset deadline, if we don't do this the connection remains open
 	// on the other end (causing tests to fail) for some weird reason.
@@ -13,6 +13,7 @@ import (
 
 	"github.com/google/gops/agent"
 	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/bsmetric"
 	"github.com/tsuru/bs/config"
 	"github.com/tsuru/bs/log"
 	"github.com/tsuru/bs/metric"
@@ -86,6 +87,14 @@ func main() {
 	if reporter != nil {
 		monitorEl = append(monitorEl, reporter)
 	}
+	if config.Config.MetricsListenAddress != "" {
+		metricsServer, err := bsmetric.NewServer(config.Config.MetricsListenAddress)
+		if err != nil {
+			bslog.Warnf("Unable to initialize metrics server: %s\n", err)
+		} else {
+			monitorEl = append(monitorEl, metricsServer)
+		}
+	}
 	var signaled bool
 	startSignalHandler(func(signal os.Signal) {
 		signaled = true
@@ -6,13 +6,18 @@ package metric
 
 import (
 	"sync"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/bsmetric"
 	"github.com/tsuru/bs/container"
 	"github.com/tsuru/bs/node"
 )
 
+var reportDuration = bsmetric.NewHistogram("bs_metrics_report_duration_seconds",
+	"Time spent collecting and sending container and host metrics.", bsmetric.DefaultBuckets)
+
 type Reporter struct {
 	backend               Backend
 	infoClient            *container.InfoClient
@@ -21,6 +26,7 @@ type Reporter struct {
 }
 
 func (r *Reporter) Do() {
+	defer reportDuration.ObserveSince(time.Now())
 	containers, err := r.infoClient.ListContainers()
 	if err != nil {
 		bslog.Errorf("failed to list containers: %s", err)
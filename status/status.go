@@ -19,6 +19,7 @@ import (
 	"github.com/ajg/form"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/tsuru/bs/bslog"
+	"github.com/tsuru/bs/bsmetric"
 	"github.com/tsuru/bs/container"
 	node "github.com/tsuru/bs/node"
 	"github.com/tsuru/tsuru/provision"
@@ -67,6 +68,9 @@ const (
 
 var errRouteNotFound = errors.New("route not found")
 
+var statusReports = bsmetric.NewCounterVec("bs_status_reports_total",
+	"Number of status reports sent to the tsuru API, by result.", "result")
+
 // NewReporter starts the status reporter. It will run intermitently, sending a
 // message in the exit channel in case it exits. It's possible to arbitrarily
 // interrupt the reporter by sending a message in the abort channel.
@@ -137,6 +141,7 @@ func (r *Reporter) reportStatus() {
 	containers, err := client.ListContainers(opts)
 	if err != nil {
 		bslog.Errorf("[status reporter] failed to list containers in the Docker server at %q: %s", r.config.DockerEndpoint, err)
+		statusReports.WithLabelValues("failure").Inc()
 		return
 	}
 	containerStatuses := r.retrieveContainerStatuses(containers)
@@ -152,12 +157,16 @@ func (r *Reporter) reportStatus() {
 	}
 	if err != nil {
 		bslog.Errorf("[status reporter] failed to send data to the tsuru server at %q: %s", r.config.TsuruEndpoint, err)
+		statusReports.WithLabelValues("failure").Inc()
 		return
 	}
 	err = r.handleTsuruResponse(resp)
 	if err != nil {
 		bslog.Errorf("[status reporter] failed to handle tsuru response: %s", err)
+		statusReports.WithLabelValues("failure").Inc()
+		return
 	}
+	statusReports.WithLabelValues("success").Inc()
 }
 
 func (r *Reporter) retrieveContainerStatuses(containers []docker.APIContainers) []containerStatus {